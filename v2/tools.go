@@ -1,28 +1,137 @@
 package toolkit
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/xml"
 	"errors"
 	"fmt"
+	"hash"
+	"html"
+	"image"
+	"image/color"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
 	"io"
+	"io/fs"
+	"math/big"
+	"mime"
+	"mime/multipart"
+	"net"
 	"net/http"
+	"net/mail"
+	"net/textproto"
+	"net/url"
 	"os"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
 const randomStringSource = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_+"
 
+// base62Alphabet is in ASCII order so that fixed width encodings sort the same way as the numbers they encode
+const base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+
+// sortableIDLength is the number of base62 characters needed to encode the 22 bytes of a sortable id
+const sortableIDLength = 30
+
 // Tools is the type used to instantiate this module. Any variable of this type will have access
 // to all the methods with the reciever *Tools
 type Tools struct {
-	MaxFileSize        int
-	AllowedFileTypes   []string
-	MaxJSONSize        int
-	AllowUnknownFields bool
+	MaxFileSize             int
+	MinFileSize             int
+	MultipartMemoryLimit    int64
+	AllowedFileTypes        []string
+	MaxJSONSize             int
+	AllowUnknownFields      bool
+	StrictFieldCase         bool
+	ContentTypeFn           func(head []byte, filename string) string
+	SniffBytes              int
+	MaxPushRetries          int
+	VerifyFileSignature     bool
+	DeduplicateUploads      bool
+	MaxJSONDepth            int
+	HealthCheckTimeout      time.Duration
+	LowercaseExtensions     bool
+	UseJSONNumber           bool
+	RequiredFormFields      []string
+	SafeOutboundOnly        bool
+	Metrics                 MetricsObserver
+	DebugErrors             bool
+	RejectPolyglots         bool
+	RequireJSONContentType  bool
+	ThumbnailSizes          []ImageSize
+	MaxJSONArrayElements    int
+	DetectAnimation         bool
+	CursorSecret            string
+	DefaultDateRange        time.Duration
+	CompressUploads         bool
+	ValidatePDFUploads      bool
+	PreventOverwrite        bool
+	OverwriteMode           OverwriteMode
+	TrimStringFields        bool
+	RejectDuplicateJSONKeys bool
+	DetectUploadCharset     bool
+	UploadIdleTimeout       time.Duration
+	RejectUnsafeSVG         bool
+	AllowNonTLSRequests     bool
+	MinAspectRatio          float64
+	MaxAspectRatio          float64
+	JSONRewriteFn           func(body []byte) ([]byte, error)
+	AutoDecompressUploads   bool
+	MaxDecompressedSize     int64
+	MaxArchiveEntries       int
+	MaxImagePixels          int
+	MaxFileCount            int
+	MaxRetryWait            time.Duration
+	UploadQuotaKeyFn        func(r *http.Request) string
+}
+
+// ImageSize is a bounding box for a resized copy of an uploaded image
+type ImageSize struct {
+	Width  int
+	Height int
+}
+
+// MetricsObserver receives measurements of toolkit operations when set as Tools.Metrics, so that they can
+// be reported to a metrics system such as Prometheus without the toolkit depending on it
+type MetricsObserver interface {
+	// ObserveUpload is called for each file written by UploadFiles
+	ObserveUpload(bytes int64, dur time.Duration)
+	// ObserveJSONRead is called after each ReadJSONFile with the number of body bytes read
+	ObserveJSONRead(bytes int64, dur time.Duration, err error)
+	// ObservePush is called after each PushJSONToRemote with the final status code, which is 0 on error
+	ObservePush(status int, dur time.Duration, err error)
 }
 
 // RandomString returns a string of random characters of length n, using randomStringSource
@@ -38,11 +147,103 @@ func (t *Tools) RandomString(n int) string {
 	return string(s)
 }
 
+// SortableID returns a 30 character base62 id made up of a millisecond timestamp followed by 16 random bytes,
+// so that ids sort lexically in roughly the order they were created
+func (t *Tools) SortableID() string {
+	b := make([]byte, 22)
+
+	ms := uint64(time.Now().UnixMilli())
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+
+	_, _ = rand.Read(b[6:])
+
+	n := new(big.Int).SetBytes(b)
+	base, mod := big.NewInt(62), new(big.Int)
+
+	id := make([]byte, sortableIDLength)
+	for i := sortableIDLength - 1; i >= 0; i-- {
+		n.DivMod(n, base, mod)
+		id[i] = base62Alphabet[mod.Int64()]
+	}
+
+	return string(id)
+}
+
+// HashStruct returns the hex encoded SHA-256 hash of v, computed over its canonical JSON encoding
+// (all object keys sorted) so that equal values always produce the same hash
+func (t *Tools) HashStruct(v interface{}) (string, error) {
+	out, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	// round trip through a generic value so struct fields are sorted the same way as map keys
+	var generic interface{}
+	dec := json.NewDecoder(bytes.NewReader(out))
+	dec.UseNumber()
+	if err := dec.Decode(&generic); err != nil {
+		return "", err
+	}
+
+	canonical, err := json.Marshal(generic)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(canonical)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// SetAllowedFileTypes sets AllowedFileTypes to types, trimmed, lowercased and with duplicates removed, so
+// that a list like "Image/PNG", "image/png" is stored as a single entry
+func (t *Tools) SetAllowedFileTypes(types ...string) {
+	seen := make(map[string]bool, len(types))
+	allowed := make([]string, 0, len(types))
+
+	for _, ft := range types {
+		ft = strings.ToLower(strings.TrimSpace(ft))
+		if ft == "" || seen[ft] {
+			continue
+		}
+		seen[ft] = true
+		allowed = append(allowed, ft)
+	}
+
+	t.AllowedFileTypes = allowed
+}
+
 // UploadedFile is a struct used to save information about an uploaded file
 type UploadedFile struct {
 	NewFileName      string
 	OriginalFileName string
 	FileSize         int64
+	FileType         string
+	Checksum         string
+	Duplicate        bool
+	Variants         []string
+	Animated         bool
+	Duration         time.Duration
+	CompressedSize   int64
+	Charset          string
+	Decompressed     bool
+}
+
+// FileError describes an uploaded file that was rejected
+type FileError struct {
+	FileName string
+	Err      error
+}
+
+func (e FileError) Error() string {
+	return fmt.Sprintf("%s: %s", e.FileName, e.Err.Error())
+}
+
+func (e FileError) Unwrap() error {
+	return e.Err
 }
 
 // UploadOneFile is a method that handles the uploading of a single file. It takes a request, the directory to upload to, and optionally a boolean to rename the file
@@ -56,12 +257,37 @@ func (t *Tools) UploadOneFile(r *http.Request, uploadDir string, rename ...bool)
 	if err != nil {
 		return nil, err
 	}
+	if len(files) == 0 {
+		return nil, errors.New("no file was uploaded")
+	}
 
 	return files[0], nil
 }
 
 // UploadFiles is a method that handles the uploading of files. It takes a request, the directory to upload
+// to, and optionally a boolean to rename the files. Renamed files keep the extension exactly as it was
+// uploaded (so "photo.JPG" gets a ".JPG" extension) unless LowercaseExtensions is set. If CompressUploads
+// is set each file is stored gzip compressed with ".gz" appended to its name; FileSize is still the size of
+// the file as uploaded and CompressedSize is the size stored. If PreventOverwrite is set an existing file is
+// never replaced, see OverwriteMode, and NewFileName is the name the file was finally stored under. If
+// AutoDecompressUploads is set, gzipped files are decompressed before they are checked and stored, see
+// decompressUpload. A request with more than MaxFileCount files is rejected without storing any
+//
+// The first file that is rejected aborts the upload and its error is returned. To skip rejected files
+// instead and find out why each was rejected, use UploadFilesCollect
 func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, error) {
+	uploadedFiles, _, err := t.uploadFiles(r, uploadDir, false, rename...)
+	return uploadedFiles, err
+}
+
+// UploadFilesCollect is UploadFiles, except that files which are rejected are skipped and described by the
+// returned FileErrors while the rest are stored. The error is only non-nil when the upload failed as a whole
+func (t *Tools) UploadFilesCollect(r *http.Request, uploadDir string, rename ...bool) ([]*UploadedFile, []FileError, error) {
+	return t.uploadFiles(r, uploadDir, true, rename...)
+}
+
+// uploadFiles does the work of UploadFiles, collecting the errors for rejected files if collect is set
+func (t *Tools) uploadFiles(r *http.Request, uploadDir string, collect bool, rename ...bool) ([]*UploadedFile, []FileError, error) {
 	renameFile := true
 	if len(rename) > 0 {
 		renameFile = rename[0]
@@ -75,17 +301,33 @@ func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename ...bool) (
 
 	err := t.CreateDirIfNotExist(uploadDir)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+
+	err = t.parseMultipartForm(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = t.checkRequiredFields(r.MultipartForm)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	err = r.ParseMultipartForm(int64(t.MaxFileSize))
+	err = t.checkFileCount(r.MultipartForm)
 	if err != nil {
-		return nil, errors.New("the uploaded file is too big")
+		return nil, nil, err
 	}
 
+	var uploadErrors []FileError
+
+	// new file names of the files written so far, keyed by checksum
+	written := make(map[string]string)
+
 	for _, fHeaders := range r.MultipartForm.File {
 		for _, hdr := range fHeaders {
-			uploadedFiles, err = func(uploadedFiles []*UploadedFile) ([]*UploadedFile, error) {
+			files, err := func(uploadedFiles []*UploadedFile) ([]*UploadedFile, error) {
+				start := time.Now()
 				var uploadedFile UploadedFile
 				infile, err := hdr.Open()
 				if err != nil {
@@ -93,242 +335,5427 @@ func (t *Tools) UploadFiles(r *http.Request, uploadDir string, rename ...bool) (
 				}
 				defer infile.Close()
 
-				buff := make([]byte, 512)
-				_, err = infile.Read(buff)
-				if err != nil {
-					return nil, err
-				}
-
-				// check to see if the file type is permitted
-				allowed := false
-				fileType := http.DetectContentType(buff)
+				uploadedFile.OriginalFileName = hdr.Filename
 
-				if len(t.AllowedFileTypes) > 0 {
-					for _, x := range t.AllowedFileTypes {
-						if strings.EqualFold(fileType, x) {
-							allowed = true
-						}
+				hdr := hdr
+				if t.AutoDecompressUploads {
+					var decompressed multipart.File
+					decompressed, hdr, err = t.decompressUpload(infile, hdr)
+					if err != nil {
+						return nil, err
+					}
+					if decompressed != infile {
+						defer decompressed.Close()
+						infile = decompressed
+						uploadedFile.Decompressed = true
 					}
-				} else {
-					allowed = true
 				}
 
-				if !allowed {
-					return nil, errors.New("the uploaded file type is not permitted")
+				fileType, err := t.checkFile(infile, hdr)
+				if err != nil {
+					return nil, err
 				}
 
-				_, err = infile.Seek(0, 0)
+				checksum, err := fileChecksum(infile)
 				if err != nil {
 					return nil, err
 				}
 
+				uploadedFile.FileType = fileType
+				uploadedFile.Checksum = checksum
+
+				// skip writing a file that is identical to one already written for this request
+				if original, ok := written[checksum]; ok && t.DeduplicateUploads {
+					uploadedFile.NewFileName = original
+					uploadedFile.FileSize = hdr.Size
+					uploadedFile.Duplicate = true
+					uploadedFile.Duration = time.Since(start)
+
+					return append(uploadedFiles, &uploadedFile), nil
+				}
+
 				if renameFile {
-					uploadedFile.NewFileName = fmt.Sprintf("%s%s", t.RandomString(25), filepath.Ext(hdr.Filename))
+					ext := filepath.Ext(hdr.Filename)
+					if t.LowercaseExtensions {
+						ext = strings.ToLower(ext)
+					}
+					uploadedFile.NewFileName = fmt.Sprintf("%s%s", t.RandomString(25), ext)
 				} else {
 					uploadedFile.NewFileName = hdr.Filename
 				}
+				if t.CompressUploads {
+					uploadedFile.NewFileName += ".gz"
+				}
 
-				uploadedFile.OriginalFileName = hdr.Filename
-
-				var outfile *os.File
+				outfile, newFileName, err := t.createUploadFile(uploadDir, uploadedFile.NewFileName)
+				if err != nil {
+					return nil, err
+				}
 				defer outfile.Close()
+				uploadedFile.NewFileName = newFileName
 
-				if outfile, err = os.Create(filepath.Join(uploadDir, uploadedFile.NewFileName)); err != nil {
-					return nil, err
+				// discard closes and removes a partially written file, which must be closed first on Windows
+				discard := func() {
+					outfile.Close()
+					os.Remove(outfile.Name())
+				}
+
+				if t.CompressUploads {
+					gz := gzip.NewWriter(outfile)
+					fileSize, err := t.CopyN(gz, infile, int64(t.MaxFileSize))
+					if errors.Is(err, ErrLimitExceeded) {
+						discard()
+						return nil, fmt.Errorf("the uploaded file is larger than %d bytes", t.MaxFileSize)
+					}
+					if err != nil {
+						discard()
+						return nil, err
+					}
+					if err := gz.Close(); err != nil {
+						discard()
+						return nil, err
+					}
+					uploadedFile.FileSize = fileSize
+
+					info, err := outfile.Stat()
+					if err != nil {
+						return nil, err
+					}
+					uploadedFile.CompressedSize = info.Size()
 				} else {
-					fileSize, err := io.Copy(outfile, infile)
+					fileSize, err := t.CopyN(outfile, infile, int64(t.MaxFileSize))
+					if errors.Is(err, ErrLimitExceeded) {
+						discard()
+						return nil, fmt.Errorf("the uploaded file is larger than %d bytes", t.MaxFileSize)
+					}
 					if err != nil {
+						discard()
 						return nil, err
 					}
 					uploadedFile.FileSize = fileSize
 				}
 
+				if t.DetectAnimation && (fileType == "image/gif" || fileType == "image/webp" || fileType == "image/png") {
+					if _, err := infile.Seek(0, 0); err != nil {
+						return nil, err
+					}
+					uploadedFile.Animated = isAnimated(infile)
+				}
+
+				if t.DetectUploadCharset && strings.HasPrefix(fileType, "text/") {
+					if _, err := infile.Seek(0, 0); err != nil {
+						return nil, err
+					}
+					sample := make([]byte, 4096)
+					n, err := io.ReadFull(infile, sample)
+					if err != nil && err != io.ErrUnexpectedEOF {
+						return nil, err
+					}
+					// don't let a character cut off at the end of the sample make it invalid UTF-8
+					if n == len(sample) {
+						for i := n - 1; i >= n-utf8.UTFMax; i-- {
+							if utf8.RuneStart(sample[i]) {
+								if !utf8.FullRune(sample[i:n]) {
+									n = i
+								}
+								break
+							}
+						}
+					}
+					uploadedFile.Charset, _ = t.DetectCharset(sample[:n])
+				}
+
+				if len(t.ThumbnailSizes) > 0 {
+					uploadedFile.Variants, err = t.writeThumbnails(infile, fileType, uploadDir, uploadedFile.NewFileName)
+					if err != nil {
+						discard()
+						return nil, err
+					}
+				}
+
+				uploadedFile.Duration = time.Since(start)
+
+				if t.Metrics != nil {
+					t.Metrics.ObserveUpload(uploadedFile.FileSize, uploadedFile.Duration)
+				}
+
+				written[checksum] = uploadedFile.NewFileName
 				uploadedFiles = append(uploadedFiles, &uploadedFile)
 
 				return uploadedFiles, nil
 			}(uploadedFiles)
 			if err != nil {
-				return uploadedFiles, err
+				if collect {
+					uploadErrors = append(uploadErrors, FileError{FileName: hdr.Filename, Err: err})
+					continue
+				}
+				return uploadedFiles, nil, err
 			}
+			uploadedFiles = files
 		}
 	}
-	return uploadedFiles, nil
+
+	return uploadedFiles, uploadErrors, nil
 }
 
-// CreateDirIfNotExist creates a directory if it does not exist
-func (t *Tools) CreateDirIfNotExist(path string) error {
-	const mode = 0755
-	if _, err := os.Stat(path); os.IsNotExist(err) {
-		err := os.MkdirAll(path, mode)
-		if err != nil {
-			return err
-		}
+// decompressUpload returns the decompressed content of an uploaded file whose name ends in ".gz" or whose
+// content is gzip, along with a header describing it with the ".gz" removed from its name. The content is
+// written to a temporary file, removed when it is closed, and may be no larger than MaxDecompressedSize,
+// which defaults to MaxFileSize. Any other file is returned unchanged
+func (t *Tools) decompressUpload(infile multipart.File, hdr *multipart.FileHeader) (multipart.File, *multipart.FileHeader, error) {
+	magic := make([]byte, 2)
+	n, err := infile.ReadAt(magic, 0)
+	if err != nil && err != io.EOF {
+		return nil, nil, err
 	}
-	return nil
-}
 
-// Slugify returns a slugified version of a string (e.g. "Hello World" becomes "hello-world")
-func (t *Tools) Slugify(s string) (string, error) {
-	if s == "" {
-		return "", errors.New("string is empty")
+	named := strings.EqualFold(filepath.Ext(hdr.Filename), ".gz")
+	if !named && !bytes.Equal(magic[:n], []byte{0x1f, 0x8b}) {
+		return infile, hdr, nil
 	}
 
-	var re = regexp.MustCompile(`[^a-z\d]+`)
-	slug := strings.Trim(re.ReplaceAllString(strings.ToLower(s), "-"), "-")
-	if len(slug) == 0 {
-		return "", errors.New("slug is empty")
+	gz, err := gzip.NewReader(io.NewSectionReader(infile, 0, hdr.Size))
+	if err != nil {
+		return nil, nil, fmt.Errorf("the uploaded file %s is not valid gzip", hdr.Filename)
 	}
-	return slug, nil
-}
+	defer gz.Close()
 
-// DownLoadStaticFile downloads a static file and does not display it in the browser by setting the Content-Disposition
-func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, pathName, displayName string) {
-	// fp := path.Join(p, file)
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", displayName))
+	tmp, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	decompressed := &removeOnClose{tmp}
 
-	http.ServeFile(w, r, pathName)
+	limit := t.MaxDecompressedSize
+	if limit <= 0 {
+		limit = int64(t.MaxFileSize)
+	}
 
-}
+	size, err := t.CopyN(decompressed, gz, limit)
+	if err == nil {
+		_, err = decompressed.Seek(0, 0)
+	}
+	if err != nil {
+		decompressed.Close()
+		if errors.Is(err, ErrLimitExceeded) {
+			return nil, nil, fmt.Errorf("the uploaded file %s decompresses to more than %d bytes", hdr.Filename, limit)
+		}
+		if errors.Is(err, gzip.ErrChecksum) || errors.Is(err, gzip.ErrHeader) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, nil, fmt.Errorf("the uploaded file %s is not valid gzip", hdr.Filename)
+		}
+		return nil, nil, err
+	}
 
-// ReadJSONFile reads a json file and unmarshals it into the interface v
-type JSONResponse struct {
-	Error   bool        `json:"error"`
-	Message string      `json:"message"`
-	Data    interface{} `json:"data,omitempty"`
+	inner := *hdr
+	if named {
+		inner.Filename = hdr.Filename[:len(hdr.Filename)-len(".gz")]
+	}
+	inner.Size = size
+
+	return decompressed, &inner, nil
 }
 
-// ReadJSONFile reads a json file and unmarshals it into the interface v and returns a JSONResponse struct with the data field set to v and error set to false
-func (t *Tools) ReadJSONFile(w http.ResponseWriter, r *http.Request, data interface{}) error {
+// removeOnClose is a temporary file that is removed when it is closed
+type removeOnClose struct {
+	*os.File
+}
 
-	maxBytes := 1024 * 1024
-	if t.MaxJSONSize != 0 {
-		maxBytes = t.MaxJSONSize
+func (f *removeOnClose) Close() error {
+	err := f.File.Close()
+	if rmErr := os.Remove(f.Name()); err == nil {
+		err = rmErr
 	}
+	return err
+}
 
-	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+// OverwriteMode is what UploadFiles does with PreventOverwrite set when a file with the same name exists
+type OverwriteMode int
 
-	dec := json.NewDecoder(r.Body)
+const (
+	// OverwriteError rejects the upload
+	OverwriteError OverwriteMode = iota
+	// OverwriteRename stores the upload with a numeric suffix, e.g. "report-1.pdf"
+	OverwriteRename
+)
 
-	if !t.AllowUnknownFields {
-		dec.DisallowUnknownFields()
+// createUploadFile creates the file name in dir for an upload, returning it and the name it was created
+// with. If PreventOverwrite is set an existing file is never replaced; instead OverwriteMode decides whether
+// that is an error or the next free numeric suffix is used
+func (t *Tools) createUploadFile(dir, name string) (*os.File, string, error) {
+	if !t.PreventOverwrite {
+		f, err := os.Create(filepath.Join(dir, name))
+		return f, name, err
 	}
 
-	err := dec.Decode(data)
-	if err != nil {
-		var syntaxError *json.SyntaxError
-		var unmarshalTypeError *json.UnmarshalTypeError
-		var invalidUnmarshalError *json.InvalidUnmarshalError
+	ext := filepath.Ext(name)
+	if ext == ".gz" && t.CompressUploads {
+		ext = filepath.Ext(strings.TrimSuffix(name, ext)) + ext
+	}
+	base := strings.TrimSuffix(name, ext)
 
-		switch {
-		case errors.As(err, &syntaxError):
-			return fmt.Errorf("body contains badly-formed JSON (at position %d)", syntaxError.Offset)
+	candidate := name
+	for i := 1; ; i++ {
+		// O_EXCL makes the existence check and the create a single step
+		f, err := os.OpenFile(filepath.Join(dir, candidate), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if err == nil {
+			return f, candidate, nil
+		}
+		if !errors.Is(err, fs.ErrExist) {
+			return nil, name, err
+		}
+		if t.OverwriteMode != OverwriteRename {
+			return nil, name, fmt.Errorf("a file named %s already exists", name)
+		}
+		candidate = fmt.Sprintf("%s-%d%s", base, i, ext)
+	}
+}
 
-		case errors.Is(err, io.ErrUnexpectedEOF):
-			return errors.New("body contains badly-formed JSON")
+// ErrUploadTimeout is returned when UploadIdleTimeout is set and no data arrives for that long during an
+// upload
+var ErrUploadTimeout = errors.New("upload timed out waiting for data")
 
-		case errors.As(err, &unmarshalTypeError):
-			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
-			}
-			return fmt.Errorf("body contains incorrect JSON type (at position %d)", unmarshalTypeError.Offset)
+// parseMultipartForm parses a multipart request, keeping up to MultipartMemoryLimit bytes of file parts in
+// memory and storing the rest in temporary files. The limit defaults to MaxFileSize. If UploadIdleTimeout
+// is set, the upload is abandoned with ErrUploadTimeout and the body closed when the client stops sending
+// data for that long
+func (t *Tools) parseMultipartForm(r *http.Request) error {
+	memoryLimit := int64(t.MaxFileSize)
+	if t.MultipartMemoryLimit > 0 {
+		memoryLimit = t.MultipartMemoryLimit
+	}
 
-		case errors.Is(err, io.EOF):
-			return errors.New("body must not be empty")
+	if t.UploadIdleTimeout > 0 {
+		r.Body = &idleTimeoutReader{ReadCloser: r.Body, timeout: t.UploadIdleTimeout}
+	}
 
-		case strings.HasPrefix(err.Error(), "json: unknown field "):
-			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
-			return fmt.Errorf("body contains unknown key %s", fieldName)
+	if err := r.ParseMultipartForm(memoryLimit); err != nil {
+		if errors.Is(err, ErrUploadTimeout) {
+			return err
+		}
+		return errors.New("the uploaded file is too big")
+	}
 
-		case err.Error() == "http: request body too large":
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+	return nil
+}
 
-		case errors.As(err, &invalidUnmarshalError):
-			return fmt.Errorf("error unmarshalling JSON: %s", err.Error())
+// idleTimeoutReader fails with ErrUploadTimeout when a read takes longer than timeout, and closes the
+// underlying body so the stalled read is released and every later read fails. net/http's request bodies
+// cannot be closed while a read is in progress, so for those the stalled read is only freed when the
+// connection is, and the server's own ReadTimeout is still needed
+type idleTimeoutReader struct {
+	io.ReadCloser
+	timeout time.Duration
+	buf     []byte
+	err     error
+}
 
-		default:
-			return err
-		}
+func (ir *idleTimeoutReader) Read(p []byte) (int, error) {
+	if ir.err != nil {
+		return 0, ir.err
 	}
 
-	err = dec.Decode(&struct{}{})
-	if err != io.EOF {
-		return errors.New("body must only contain a single JSON value")
+	// read into a buffer of our own, as a read that times out may still write to it later
+	if len(ir.buf) < len(p) {
+		ir.buf = make([]byte, len(p))
 	}
+	buf := ir.buf[:len(p)]
 
-	return nil
+	type result struct {
+		n   int
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		n, err := ir.ReadCloser.Read(buf)
+		done <- result{n, err}
+	}()
+
+	timer := time.NewTimer(ir.timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-done:
+		copy(p, buf[:res.n])
+		return res.n, res.err
+	case <-timer.C:
+		ir.err = ErrUploadTimeout
+		// close in the background, as some bodies wait for the stalled read before closing
+		go ir.ReadCloser.Close()
+		return 0, ir.err
+	}
 }
 
-// WriteJSON writes a json response to the client with the specified status code and headers if any
-func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) error {
-	out, err := json.Marshal(data)
+// ErrLimitExceeded is returned by CopyN when the source holds more than the maximum number of bytes
+var ErrLimitExceeded = errors.New("size limit exceeded")
 
+// CopyN copies from src to dst until src is exhausted, but no more than max bytes. If src holds more than max
+// bytes, the first max are copied and ErrLimitExceeded is returned. It returns the number of bytes copied
+func (t *Tools) CopyN(dst io.Writer, src io.Reader, max int64) (int64, error) {
+	n, err := io.Copy(dst, io.LimitReader(src, max))
 	if err != nil {
-		return err
+		return n, err
 	}
 
-	if len(headers) > 0 {
-		for k, v := range headers[0] {
-			w.Header()[k] = v
-		}
+	// see whether there was anything left over
+	var probe [1]byte
+	m, err := io.ReadFull(src, probe[:])
+	if m > 0 {
+		return n, ErrLimitExceeded
+	}
+	if err != nil && err != io.EOF {
+		return n, err
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	_, err = w.Write(out)
+	return n, nil
+}
 
-	if err != nil {
-		return err
+// checkRequiredFields returns an error listing any of RequiredFormFields that are missing or empty in form
+func (t *Tools) checkRequiredFields(form *multipart.Form) error {
+	var missing []string
+	for _, field := range t.RequiredFormFields {
+		values := form.Value[field]
+		if len(values) == 0 || strings.TrimSpace(values[0]) == "" {
+			missing = append(missing, field)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("the form is missing required fields: %s", strings.Join(missing, ", "))
 	}
 
 	return nil
 }
 
-// ErrorJSON writes a json response to the client with the specified status code and headers if any and sets the error field to true and message field to the error message
-func (t *Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error {
-
-	statusCode := http.StatusBadRequest
+// checkFileCount returns an error if form has more than MaxFileCount files, when that is set
+func (t *Tools) checkFileCount(form *multipart.Form) error {
+	if t.MaxFileCount <= 0 {
+		return nil
+	}
 
-	if len(status) > 0 {
-		statusCode = status[0]
+	count := 0
+	for _, fHeaders := range form.File {
+		count += len(fHeaders)
 	}
 
-	var payload JSONResponse
-	payload.Error = true
-	payload.Message = err.Error()
+	if count > t.MaxFileCount {
+		return fmt.Errorf("%d files were uploaded, more than the maximum of %d", count, t.MaxFileCount)
+	}
 
-	return t.WriteJSON(w, statusCode, payload)
+	return nil
 }
 
-// PushJSONToRemote pushes a json payload to a remote uri and returns the response and status code and error if any
-func (t *Tools) PushJSONToRemote(uri string, data interface{}, client ...*http.Client) (*http.Response, int, error) {
+// checkFile makes sure an uploaded file is at least MinFileSize, sniffs its content type, makes sure it
+// is permitted, and rewinds the file so it can be read again from the start
+func (t *Tools) checkFile(infile multipart.File, hdr *multipart.FileHeader) (string, error) {
+	filename := hdr.Filename
 
-	// create json
-	jsonData, err := json.Marshal(data)
-	if err != nil {
-		return nil, 0, err
+	if t.MinFileSize > 0 && hdr.Size < int64(t.MinFileSize) {
+		return "", fmt.Errorf("the uploaded file %s is %d bytes, smaller than the minimum of %d bytes", filename, hdr.Size, t.MinFileSize)
 	}
 
-	// check fot custom http client
-	httpClient := &http.Client{}
-	if len(client) > 0 {
-		httpClient = client[0]
+	sniffBytes := 512
+	if t.SniffBytes > 0 {
+		sniffBytes = t.SniffBytes
 	}
 
-	// build request and set headers
-	request, err := http.NewRequest("POST", uri, bytes.NewBuffer(jsonData))
-	if err != nil {
+	buff := make([]byte, sniffBytes)
+	n, err := io.ReadFull(infile, buff)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+
+	// check to see if the file type is permitted
+	fileType := t.detectContentType(buff[:n], filename)
+	if !t.fileTypeAllowed(fileType) {
+		return "", errors.New("the uploaded file type is not permitted")
+	}
+
+	if t.VerifyFileSignature {
+		if err := verifySignature(fileType, filename); err != nil {
+			return "", err
+		}
+	}
+
+	if t.RejectPolyglots && strings.HasPrefix(fileType, "image/") {
+		marker, err := findPolyglotMarker(infile)
+		if err != nil {
+			return "", err
+		}
+		if marker != "" {
+			return "", fmt.Errorf("the uploaded image %s contains suspicious content %q", filename, marker)
+		}
+	}
+
+	// images are decoded to make thumbnails, so make sure they are not too large before anything is written
+	if len(t.ThumbnailSizes) > 0 && (fileType == "image/jpeg" || fileType == "image/png" || fileType == "image/gif") {
+		if err := t.checkImagePixels(infile, filename); err != nil {
+			return "", err
+		}
+	}
+
+	if (t.MinAspectRatio > 0 || t.MaxAspectRatio > 0) && strings.HasPrefix(fileType, "image/") && fileType != "image/svg+xml" {
+		if err := t.checkAspectRatio(infile, filename); err != nil {
+			return "", err
+		}
+	}
+
+	// an svg is only recognised by its root element, which a long prolog can push past the sniffed bytes, so
+	// every file that could be an svg is checked in full. Only files that claim to be svg must also be valid
+	if t.RejectUnsafeSVG {
+		isSVG := fileType == "image/svg+xml" || strings.EqualFold(filepath.Ext(filename), ".svg")
+		if isSVG || strings.HasPrefix(fileType, "text/") || strings.Contains(fileType, "xml") {
+			if _, err := infile.Seek(0, 0); err != nil {
+				return "", err
+			}
+			construct, err := findUnsafeSVG(infile)
+			if err != nil && isSVG {
+				return "", fmt.Errorf("the uploaded svg %s %s", filename, err.Error())
+			}
+			if construct != "" {
+				return "", fmt.Errorf("the uploaded file %s contains %s", filename, construct)
+			}
+		}
+	}
+
+	if t.ValidatePDFUploads && fileType == "application/pdf" {
+		if err := checkPDF(infile); err != nil {
+			return "", fmt.Errorf("the uploaded pdf %s %s", filename, err.Error())
+		}
+	}
+
+	_, err = infile.Seek(0, 0)
+	if err != nil {
+		return "", err
+	}
+
+	return fileType, nil
+}
+
+// fileTypeAllowed reports whether fileType is one of AllowedFileTypes, or true if that is empty
+func (t *Tools) fileTypeAllowed(fileType string) bool {
+	if len(t.AllowedFileTypes) == 0 {
+		return true
+	}
+
+	for _, x := range t.AllowedFileTypes {
+		if strings.EqualFold(fileType, x) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ArchiveEntry describes a file in an archive checked by ValidateArchiveContents
+type ArchiveEntry struct {
+	Name     string
+	Size     int64
+	FileType string
+}
+
+// ValidateArchiveContents checks every file in the zip archive read from r before anything is extracted.
+// Each entry must be a regular file or a directory, so symlinks are rejected, with a relative path that stays
+// inside the archive. Each file must have a sniffed type in AllowedFileTypes and a decompressed size no
+// larger than MaxFileSize, which also limits the archive itself. The archive may hold at most
+// MaxArchiveEntries files (1000 by default) and decompress to at most MaxDecompressedSize bytes in total
+// (MaxFileSize by default), and checking stops as soon as either is exceeded. Sizes are measured by
+// decompressing rather than trusted from the archive. It returns the files in the archive, or an error
+// describing the first one that is not allowed
+func (t *Tools) ValidateArchiveContents(r io.Reader) ([]ArchiveEntry, error) {
+	if t.MaxFileSize == 0 {
+		t.MaxFileSize = 1024 * 1024 * 1024
+	}
+	maxSize := int64(t.MaxFileSize)
+
+	maxTotal := t.MaxDecompressedSize
+	if maxTotal <= 0 {
+		maxTotal = maxSize
+	}
+
+	maxEntries := 1000
+	if t.MaxArchiveEntries > 0 {
+		maxEntries = t.MaxArchiveEntries
+	}
+
+	// a zip's directory is at its end, so the whole archive has to be stored first
+	tmp, err := os.CreateTemp("", "archive-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	archiveSize, err := t.CopyN(tmp, r, maxSize)
+	if errors.Is(err, ErrLimitExceeded) {
+		return nil, fmt.Errorf("the archive is larger than %d bytes", maxSize)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	zr, err := zip.NewReader(tmp, archiveSize)
+	if err != nil {
+		return nil, fmt.Errorf("the archive is not a valid zip file: %w", err)
+	}
+
+	if len(zr.File) > maxEntries {
+		return nil, fmt.Errorf("the archive has %d entries, more than the maximum of %d", len(zr.File), maxEntries)
+	}
+
+	sniffBytes := 512
+	if t.SniffBytes > 0 {
+		sniffBytes = t.SniffBytes
+	}
+
+	var entries []ArchiveEntry
+	var total int64
+	for _, f := range zr.File {
+		// zip paths use forward slashes, and must not be absolute or climb out of the extraction directory
+		cleaned := path.Clean(f.Name)
+		if path.IsAbs(f.Name) || strings.Contains(f.Name, "\\") || strings.Contains(f.Name, ":") ||
+			cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+			return nil, fmt.Errorf("the archive entry %s has an unsafe path", f.Name)
+		}
+
+		if f.Mode().IsDir() {
+			continue
+		}
+
+		// symlinks and other special files could point anywhere once extracted
+		if !f.Mode().IsRegular() {
+			return nil, fmt.Errorf("the archive entry %s is not a regular file", f.Name)
+		}
+
+		entry, err := func() (ArchiveEntry, error) {
+			rc, err := f.Open()
+			if err != nil {
+				return ArchiveEntry{}, err
+			}
+			defer rc.Close()
+
+			head := make([]byte, sniffBytes)
+			n, err := io.ReadFull(rc, head)
+			if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+				return ArchiveEntry{}, err
+			}
+
+			fileType := t.detectContentType(head[:n], f.Name)
+			if !t.fileTypeAllowed(fileType) {
+				return ArchiveEntry{}, fmt.Errorf("the archive entry %s has type %s, which is not permitted", f.Name, fileType)
+			}
+
+			// read no further than either limit allows
+			limit := maxSize
+			if maxTotal-total < limit {
+				limit = maxTotal - total
+			}
+
+			rest, err := io.Copy(io.Discard, io.LimitReader(rc, limit-int64(n)+1))
+			if err != nil {
+				return ArchiveEntry{}, err
+			}
+
+			size := int64(n) + rest
+			if size > maxSize {
+				return ArchiveEntry{}, fmt.Errorf("the archive entry %s is larger than %d bytes", f.Name, maxSize)
+			}
+			if total+size > maxTotal {
+				return ArchiveEntry{}, fmt.Errorf("the archive decompresses to more than %d bytes", maxTotal)
+			}
+
+			return ArchiveEntry{Name: f.Name, Size: size, FileType: fileType}, nil
+		}()
+		if err != nil {
+			return nil, err
+		}
+
+		total += entry.Size
+		entries = append(entries, entry)
+	}
+
+	return entries, nil
+}
+
+// checkImagePixels makes sure the image in infile declares no more than MaxImagePixels pixels (50 million by
+// default), reading only its header, so that decoding it to make thumbnails cannot exhaust memory
+func (t *Tools) checkImagePixels(infile io.ReadSeeker, filename string) error {
+	if _, err := infile.Seek(0, 0); err != nil {
+		return err
+	}
+
+	config, _, err := image.DecodeConfig(infile)
+	if err != nil {
+		return fmt.Errorf("cannot decode uploaded image %s : %w", filename, err)
+	}
+
+	maxPixels := 50 * 1000 * 1000
+	if t.MaxImagePixels > 0 {
+		maxPixels = t.MaxImagePixels
+	}
+	if config.Width <= 0 || config.Height <= 0 || config.Width > maxPixels/config.Height {
+		return fmt.Errorf("the uploaded image %s is %dx%d, more than the maximum of %d pixels", filename, config.Width, config.Height, maxPixels)
+	}
+
+	return nil
+}
+
+// checkAspectRatio makes sure the width divided by the height of the image in infile is within
+// MinAspectRatio and MaxAspectRatio, where set. Images whose dimensions cannot be read are rejected
+func (t *Tools) checkAspectRatio(infile multipart.File, filename string) error {
+	if _, err := infile.Seek(0, 0); err != nil {
+		return err
+	}
+
+	config, _, err := image.DecodeConfig(infile)
+	if err != nil || config.Height == 0 {
+		return fmt.Errorf("the dimensions of the uploaded image %s could not be read", filename)
+	}
+
+	ratio := float64(config.Width) / float64(config.Height)
+	if t.MinAspectRatio > 0 && ratio < t.MinAspectRatio {
+		return fmt.Errorf("the uploaded image %s is %dx%d, an aspect ratio of %.2f, below the minimum of %.2f",
+			filename, config.Width, config.Height, ratio, t.MinAspectRatio)
+	}
+	if t.MaxAspectRatio > 0 && ratio > t.MaxAspectRatio {
+		return fmt.Errorf("the uploaded image %s is %dx%d, an aspect ratio of %.2f, above the maximum of %.2f",
+			filename, config.Width, config.Height, ratio, t.MaxAspectRatio)
+	}
+
+	return nil
+}
+
+// checkPDF does a lightweight structural check of a pdf, making sure it has a pdf header, ends with a
+// cross-reference pointer and end-of-file marker as a complete file does, and has no encryption dictionary
+func checkPDF(infile multipart.File) error {
+	size, err := infile.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+
+	head := make([]byte, 5)
+	if _, err := infile.ReadAt(head, 0); err != nil || string(head) != "%PDF-" {
+		return errors.New("does not have a pdf header")
+	}
+
+	// the trailer is at the end of the file, allowing for trailing whitespace or junk some writers add
+	tailSize := int64(1024)
+	if size < tailSize {
+		tailSize = size
+	}
+	tail := make([]byte, tailSize)
+	if _, err := infile.ReadAt(tail, size-tailSize); err != nil && err != io.EOF {
+		return err
+	}
+	if !bytes.Contains(tail, []byte("%%EOF")) || !bytes.Contains(tail, []byte("startxref")) {
+		return errors.New("is truncated or malformed")
+	}
+
+	// scan in chunks, overlapping them so a marker that straddles two chunks is found
+	marker := []byte("/Encrypt")
+	buf := make([]byte, 32*1024)
+	for offset := int64(0); offset < size; offset += int64(len(buf) - len(marker)) {
+		n, err := infile.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if bytes.Contains(buf[:n], marker) {
+			return errors.New("is encrypted")
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return nil
+}
+
+// IsAnimatedImage reports whether data is an animated GIF, WebP or PNG image. It only walks the structure
+// of the file, without decoding any pixels, and returns false for anything else
+func (t *Tools) IsAnimatedImage(data []byte) bool {
+	return isAnimated(bytes.NewReader(data))
+}
+
+// isAnimated does the work of IsAnimatedImage, reading the image from r a chunk at a time and skipping the
+// image data so that memory use does not grow with the size of the image
+func isAnimated(r io.Reader) bool {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(12)
+
+	// skip discards n bytes, which may be more than fit in an int on some platforms
+	skip := func(n int64) error {
+		_, err := io.CopyN(io.Discard, br, n)
+		return err
+	}
+
+	switch {
+	case bytes.HasPrefix(head, []byte("GIF87a")), bytes.HasPrefix(head, []byte("GIF89a")):
+		return gifFrameCount(br) > 1
+
+	case len(head) >= 12 && string(head[0:4]) == "RIFF" && string(head[8:12]) == "WEBP":
+		// walk the chunks looking for the animation chunk or the animation flag in the extended header
+		if skip(12) != nil {
+			return false
+		}
+		chunk := make([]byte, 8)
+		for {
+			if _, err := io.ReadFull(br, chunk); err != nil {
+				return false
+			}
+			id := string(chunk[0:4])
+			size := int64(binary.LittleEndian.Uint32(chunk[4:8]))
+			if id == "ANIM" || id == "ANMF" {
+				return true
+			}
+			if id == "VP8X" {
+				if flags, err := br.Peek(1); err == nil && flags[0]&0x02 != 0 {
+					return true
+				}
+			}
+			// chunks are padded to an even size
+			if skip(size+size%2) != nil {
+				return false
+			}
+		}
+
+	case bytes.HasPrefix(head, []byte("\x89PNG\r\n\x1a\n")):
+		// an APNG has an animation control chunk before its image data
+		if skip(8) != nil {
+			return false
+		}
+		chunk := make([]byte, 8)
+		for {
+			if _, err := io.ReadFull(br, chunk); err != nil {
+				return false
+			}
+			switch string(chunk[4:8]) {
+			case "acTL":
+				return true
+			case "IDAT":
+				return false
+			}
+			// skip the data and crc
+			if skip(int64(binary.BigEndian.Uint32(chunk[0:4]))+4) != nil {
+				return false
+			}
+		}
+	}
+
+	return false
+}
+
+// gifFrameCount counts the image descriptors in the GIF read from br, stopping once it has found two
+func gifFrameCount(br *bufio.Reader) int {
+	header := make([]byte, 13)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return 0
+	}
+
+	// skip discards n bytes
+	skip := func(n int) error {
+		_, err := br.Discard(n)
+		return err
+	}
+
+	// skip the global color table
+	if header[10]&0x80 != 0 {
+		if skip(3<<(header[10]&0x07+1)) != nil {
+			return 0
+		}
+	}
+
+	// skipSubBlocks discards data sub-blocks up to and including the terminating empty block
+	skipSubBlocks := func() error {
+		for {
+			size, err := br.ReadByte()
+			if err != nil || size == 0 {
+				return err
+			}
+			if err := skip(int(size)); err != nil {
+				return err
+			}
+		}
+	}
+
+	frames := 0
+	for frames < 2 {
+		b, err := br.ReadByte()
+		if err != nil {
+			return frames
+		}
+
+		switch b {
+		case 0x21:
+			// extension: label and sub-blocks
+			if skip(1) != nil || skipSubBlocks() != nil {
+				return frames
+			}
+		case 0x2C:
+			frames++
+			descriptor := make([]byte, 9)
+			if _, err := io.ReadFull(br, descriptor); err != nil {
+				return frames
+			}
+			flags := descriptor[8]
+			if flags&0x80 != 0 {
+				if skip(3<<(flags&0x07+1)) != nil {
+					return frames
+				}
+			}
+			// skip the minimum code size and the image data
+			if skip(1) != nil || skipSubBlocks() != nil {
+				return frames
+			}
+		default:
+			// trailer or corrupt data
+			return frames
+		}
+	}
+
+	return frames
+}
+
+// writeThumbnails writes a copy of the image in infile resized to fit each of ThumbnailSizes alongside the
+// original in uploadDir, and returns their paths. JPEG images are resized to JPEG and PNG and GIF images to
+// PNG; other file types are left alone. The size of the image must already have been checked with
+// checkImagePixels. If any variant cannot be written those already written are removed
+func (t *Tools) writeThumbnails(infile io.ReadSeeker, fileType, uploadDir, fileName string) ([]string, error) {
+	ext := ".png"
+	switch fileType {
+	case "image/jpeg":
+		ext = ".jpg"
+	case "image/png", "image/gif":
+	default:
+		return nil, nil
+	}
+
+	if _, err := infile.Seek(0, 0); err != nil {
+		return nil, err
+	}
+
+	src, _, err := image.Decode(infile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot decode uploaded image : %w", err)
+	}
+
+	base := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+
+	var variants []string
+	for _, size := range t.ThumbnailSizes {
+		path := filepath.Join(uploadDir, fmt.Sprintf("%s_%dx%d%s", base, size.Width, size.Height, ext))
+
+		err := func() error {
+			out, err := os.Create(path)
+			if err != nil {
+				return err
+			}
+			defer out.Close()
+
+			thumb := resizeImage(src, size)
+			if ext == ".jpg" {
+				err = jpeg.Encode(out, thumb, nil)
+			} else {
+				err = png.Encode(out, thumb)
+			}
+			if err != nil {
+				out.Close()
+				os.Remove(path)
+			}
+			return err
+		}()
+		if err != nil {
+			for _, variant := range variants {
+				os.Remove(variant)
+			}
+			return nil, err
+		}
+
+		variants = append(variants, path)
+	}
+
+	return variants, nil
+}
+
+// resizeImage scales src down to fit within size, preserving its aspect ratio, by averaging the source
+// pixels that fall within each destination pixel. Images that already fit are copied unchanged
+func resizeImage(src image.Image, size ImageSize) image.Image {
+	b := src.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+
+	dw, dh := sw, sh
+	if size.Width > 0 && dw > size.Width {
+		dw, dh = size.Width, sh*size.Width/sw
+	}
+	if size.Height > 0 && dh > size.Height {
+		dw, dh = dw*size.Height/dh, size.Height
+	}
+	if dw < 1 {
+		dw = 1
+	}
+	if dh < 1 {
+		dh = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := b.Min.Y+y*sh/dh, b.Min.Y+(y+1)*sh/dh
+		if y1 == y0 {
+			y1++
+		}
+
+		for x := 0; x < dw; x++ {
+			x0, x1 := b.Min.X+x*sw/dw, b.Min.X+(x+1)*sw/dw
+			if x1 == x0 {
+				x1++
+			}
+
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(sx, sy).RGBA()
+					r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+
+			dst.Set(x, y, color.RGBA64{
+				R: uint16(r / n),
+				G: uint16(g / n),
+				B: uint16(bl / n),
+				A: uint16(a / n),
+			})
+		}
+	}
+
+	return dst
+}
+
+// fileChecksum returns the hex encoded SHA-256 checksum of an uploaded file and rewinds it
+func fileChecksum(infile multipart.File) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, infile); err != nil {
+		return "", err
+	}
+
+	if _, err := infile.Seek(0, 0); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VerifyChecksum hashes the file at path with h and reports whether the result matches expectedHex, which
+// may be upper or lower case. If h is nil SHA-256 is used. A checksum is not a secret, but the comparison
+// is constant time anyway since it costs nothing and means VerifyChecksum is also safe to use with a keyed
+// hash such as an HMAC
+func (t *Tools) VerifyChecksum(path, expectedHex string, h hash.Hash) (bool, error) {
+	expected, err := hex.DecodeString(strings.TrimSpace(expectedHex))
+	if err != nil {
+		return false, fmt.Errorf("expected checksum is not valid hex: %w", err)
+	}
+
+	if h == nil {
+		h = sha256.New()
+	}
+	h.Reset()
+
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return false, err
+	}
+
+	return hmac.Equal(h.Sum(nil), expected), nil
+}
+
+// UploadFilesToTar writes every uploaded file in the request into a single tar archive written to out,
+// instead of saving each one to disk. Files are checked against AllowedFileTypes, MaxFileSize and
+// MaxFileCount in the same way as UploadFiles, and are stored in the archive under their original base name
+func (t *Tools) UploadFilesToTar(r *http.Request, out io.Writer) ([]*UploadedFile, error) {
+	var uploadedFiles []*UploadedFile
+
+	if t.MaxFileSize == 0 {
+		t.MaxFileSize = 1024 * 1024 * 1024
+	}
+
+	err := t.parseMultipartForm(r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.checkRequiredFields(r.MultipartForm)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.checkFileCount(r.MultipartForm)
+	if err != nil {
+		return nil, err
+	}
+
+	tw := tar.NewWriter(out)
+
+	for _, fHeaders := range r.MultipartForm.File {
+		for _, hdr := range fHeaders {
+			uploadedFiles, err = func(uploadedFiles []*UploadedFile) ([]*UploadedFile, error) {
+				start := time.Now()
+				infile, err := hdr.Open()
+				if err != nil {
+					return nil, err
+				}
+				defer infile.Close()
+
+				fileType, err := t.checkFile(infile, hdr)
+				if err != nil {
+					return nil, err
+				}
+
+				// the size goes in the tar header, so check it before anything is written
+				if hdr.Size > int64(t.MaxFileSize) {
+					return nil, fmt.Errorf("the uploaded file is larger than %d bytes", t.MaxFileSize)
+				}
+
+				uploadedFile := UploadedFile{
+					NewFileName:      filepath.Base(hdr.Filename),
+					OriginalFileName: hdr.Filename,
+					FileType:         fileType,
+				}
+
+				err = tw.WriteHeader(&tar.Header{
+					Name:    uploadedFile.NewFileName,
+					Mode:    0644,
+					Size:    hdr.Size,
+					ModTime: time.Now(),
+				})
+				if err != nil {
+					return nil, err
+				}
+
+				fileSize, err := t.CopyN(tw, infile, int64(t.MaxFileSize))
+				if errors.Is(err, ErrLimitExceeded) {
+					return nil, fmt.Errorf("the uploaded file is larger than %d bytes", t.MaxFileSize)
+				}
+				if err != nil {
+					return nil, err
+				}
+				uploadedFile.FileSize = fileSize
+				uploadedFile.Duration = time.Since(start)
+
+				return append(uploadedFiles, &uploadedFile), nil
+			}(uploadedFiles)
+			if err != nil {
+				return uploadedFiles, err
+			}
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return uploadedFiles, err
+	}
+
+	return uploadedFiles, nil
+}
+
+// TempFile is an uploaded file saved to a temporary file by UploadToTemp. Close deletes the file
+type TempFile struct {
+	Path             string
+	OriginalFileName string
+	FileSize         int64
+	FileType         string
+}
+
+// Close removes the temporary file. It is safe to call more than once
+func (f *TempFile) Close() error {
+	err := os.Remove(f.Path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// UploadToTemp saves every uploaded file in the request to its own temporary file, for processing that
+// needs a real path but not permanent storage. Files are checked in the same way as UploadFiles. The
+// caller must Close each returned file when done with it; if any file fails, those already written are
+// removed and no files are returned
+func (t *Tools) UploadToTemp(r *http.Request) ([]*TempFile, error) {
+	var tempFiles []*TempFile
+
+	if t.MaxFileSize == 0 {
+		t.MaxFileSize = 1024 * 1024 * 1024
+	}
+
+	err := t.parseMultipartForm(r)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.checkRequiredFields(r.MultipartForm)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.checkFileCount(r.MultipartForm)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fHeaders := range r.MultipartForm.File {
+		for _, hdr := range fHeaders {
+			tempFile, err := func() (*TempFile, error) {
+				infile, err := hdr.Open()
+				if err != nil {
+					return nil, err
+				}
+				defer infile.Close()
+
+				fileType, err := t.checkFile(infile, hdr)
+				if err != nil {
+					return nil, err
+				}
+
+				// keep the extension so tools that look at it still work
+				outfile, err := os.CreateTemp("", "upload-*"+filepath.Ext(hdr.Filename))
+				if err != nil {
+					return nil, err
+				}
+				defer outfile.Close()
+
+				tempFile := &TempFile{
+					Path:             outfile.Name(),
+					OriginalFileName: hdr.Filename,
+					FileType:         fileType,
+				}
+
+				tempFile.FileSize, err = t.CopyN(outfile, infile, int64(t.MaxFileSize))
+				if errors.Is(err, ErrLimitExceeded) {
+					outfile.Close()
+					tempFile.Close()
+					return nil, fmt.Errorf("the uploaded file is larger than %d bytes", t.MaxFileSize)
+				}
+				if err != nil {
+					outfile.Close()
+					tempFile.Close()
+					return nil, err
+				}
+
+				return tempFile, nil
+			}()
+			if err != nil {
+				for _, f := range tempFiles {
+					f.Close()
+				}
+				return nil, err
+			}
+			tempFiles = append(tempFiles, tempFile)
+		}
+	}
+
+	return tempFiles, nil
+}
+
+// detectContentType returns the content type of an uploaded file from its first bytes, using
+// ContentTypeFn if one is set and http.DetectContentType otherwise. When RejectUnsafeSVG is set or
+// image/svg+xml is one of AllowedFileTypes, xml or plain text containing an svg element is reported as
+// image/svg+xml; otherwise it keeps the type it was sniffed as
+func (t *Tools) detectContentType(head []byte, filename string) string {
+	if t.ContentTypeFn != nil {
+		return t.ContentTypeFn(head, filename)
+	}
+
+	// svg is sniffed as xml or plain text, so look for its root element
+	fileType := http.DetectContentType(head)
+	if (strings.HasPrefix(fileType, "text/xml") || strings.HasPrefix(fileType, "text/plain")) &&
+		bytes.Contains(head, []byte("<svg")) && t.detectsSVG() {
+		return "image/svg+xml"
+	}
+
+	return fileType
+}
+
+// detectsSVG reports whether detectContentType should tell svg images apart from other xml and text
+func (t *Tools) detectsSVG() bool {
+	if t.RejectUnsafeSVG {
+		return true
+	}
+
+	for _, x := range t.AllowedFileTypes {
+		if strings.EqualFold(x, "image/svg+xml") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// findUnsafeSVG parses the svg read from r and describes the first construct in it that could run script
+// when the svg is displayed inline: a script or foreignObject element, an on* event handler attribute, or a
+// javascript: link. It returns an empty string if there are none, and an error if the svg is not valid xml
+func findUnsafeSVG(r io.Reader) (string, error) {
+	dec := xml.NewDecoder(r)
+
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", fmt.Errorf("is not a valid svg: %w", err)
+		}
+
+		el, ok := tok.(xml.StartElement)
+		if !ok {
+			continue
+		}
+
+		if name := strings.ToLower(el.Name.Local); name == "script" || name == "foreignobject" {
+			return fmt.Sprintf("a <%s> element", el.Name.Local), nil
+		}
+
+		for _, attr := range el.Attr {
+			name := strings.ToLower(attr.Name.Local)
+			if strings.HasPrefix(name, "on") {
+				return fmt.Sprintf("an %s event handler attribute", attr.Name.Local), nil
+			}
+
+			// browsers ignore white space and control characters within the scheme
+			value := strings.ToLower(strings.Map(func(r rune) rune {
+				if unicode.IsSpace(r) || unicode.IsControl(r) {
+					return -1
+				}
+				return r
+			}, attr.Value))
+			if (name == "href" || name == "src" || name == "from" || name == "to" || name == "values") && strings.HasPrefix(value, "javascript:") {
+				return fmt.Sprintf("a javascript: link in its %s attribute", attr.Name.Local), nil
+			}
+		}
+	}
+}
+
+// polyglotMarkers are fragments of HTML and script that have no business appearing in an image, but let a
+// file double as a page a browser would run if it were served as HTML
+var polyglotMarkers = []string{"<script", "<html", "<body", "<iframe", "<svg", "<?php", "javascript:", "onerror=", "onload="}
+
+// findPolyglotMarker reads the whole of infile and returns the first of polyglotMarkers it contains,
+// compared case-insensitively, or an empty string if there are none. The file is not rewound
+func findPolyglotMarker(infile io.Reader) (string, error) {
+	longest := 0
+	for _, m := range polyglotMarkers {
+		if len(m) > longest {
+			longest = len(m)
+		}
+	}
+
+	// scan in chunks, carrying the end of each chunk over so markers that straddle two chunks are found
+	buf := make([]byte, 32*1024)
+	var carry []byte
+	for {
+		n, err := infile.Read(buf)
+		if n > 0 {
+			window := bytes.ToLower(append(carry, buf[:n]...))
+			for _, m := range polyglotMarkers {
+				if bytes.Contains(window, []byte(m)) {
+					return m, nil
+				}
+			}
+
+			if len(window) > longest-1 {
+				window = window[len(window)-(longest-1):]
+			}
+			carry = append(carry[:0], window...)
+		}
+
+		if err == io.EOF {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+}
+
+// verifySignature checks that the sniffed content type of a file agrees with the type implied by the
+// extension of filename. The sniffer only knows a few types and falls back to a generic one for the rest,
+// so those fallbacks are compatible with the types they cover: text/plain with any text, json or javascript
+// type, text/xml with any xml type, application/zip with zip based formats such as docx and xlsx, and
+// application/octet-stream with any type the sniffer cannot recognise
+func verifySignature(fileType, filename string) error {
+	ext := filepath.Ext(filename)
+	expected := mime.TypeByExtension(ext)
+	if expected == "" {
+		expected = signatureTypes[strings.ToLower(ext)]
+	}
+	if expected == "" {
+		return fmt.Errorf("cannot verify the content of %s : unknown extension %q", filename, ext)
+	}
+
+	sniffed, _, err := mime.ParseMediaType(fileType)
+	if err != nil {
+		return err
+	}
+
+	claimed, _, err := mime.ParseMediaType(expected)
+	if err != nil {
+		return err
+	}
+
+	if !signatureCompatible(strings.ToLower(sniffed), strings.ToLower(claimed)) {
+		return fmt.Errorf("the content of %s is %s but its extension %q implies %s", filename, sniffed, ext, claimed)
+	}
+
+	return nil
+}
+
+// signatureTypes are the types of common upload extensions that the system mime tables may not know
+var signatureTypes = map[string]string{
+	".csv":  "text/csv",
+	".md":   "text/markdown",
+	".txt":  "text/plain",
+	".docx": "application/vnd.openxmlformats-officedocument.wordprocessingml.document",
+	".xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+	".pptx": "application/vnd.openxmlformats-officedocument.presentationml.presentation",
+	".odt":  "application/vnd.oasis.opendocument.text",
+	".ods":  "application/vnd.oasis.opendocument.spreadsheet",
+	".epub": "application/epub+zip",
+}
+
+// signatureCompatible reports whether content sniffed as sniffed may be a file of the claimed type
+func signatureCompatible(sniffed, claimed string) bool {
+	switch sniffed {
+	case claimed:
+		return true
+	case "text/plain":
+		return strings.HasPrefix(claimed, "text/") || claimed == "application/json" || strings.HasSuffix(claimed, "+json") ||
+			strings.HasSuffix(claimed, "javascript") || strings.HasSuffix(claimed, "xml")
+	case "text/xml":
+		return strings.HasSuffix(claimed, "/xml") || strings.HasSuffix(claimed, "+xml")
+	case "application/zip":
+		return strings.HasSuffix(claimed, "+zip") || claimed == "application/java-archive" ||
+			strings.HasPrefix(claimed, "application/vnd.openxmlformats-officedocument.") ||
+			strings.HasPrefix(claimed, "application/vnd.oasis.opendocument.")
+	case "application/octet-stream":
+		// anything the sniffer would have recognised is not compatible with its fallback
+		for _, prefix := range []string{"text/", "image/", "audio/", "video/", "font/"} {
+			if strings.HasPrefix(claimed, prefix) {
+				return false
+			}
+		}
+		switch claimed {
+		case "application/pdf", "application/zip", "application/x-gzip", "application/gzip", "application/json",
+			"application/wasm", "application/ogg", "application/x-rar-compressed", "application/vnd.ms-fontobject":
+			return false
+		}
+		return !strings.HasSuffix(claimed, "+zip") && !strings.HasSuffix(claimed, "xml")
+	}
+
+	return false
+}
+
+// resumableUpload is the state of a resumable upload, kept in a sidecar file next to its data
+type resumableUpload struct {
+	Length int64 `json:"length"`
+}
+
+// resumableIDPattern matches the ids generated for resumable uploads, so an id from a request can never
+// point outside the storage directory
+var resumableIDPattern = regexp.MustCompile(`^[0-9A-Za-z]+$`)
+
+// ResumableUpload handles uploads that can be resumed after a dropped connection, using a minimal version
+// of the tus protocol. A POST with an Upload-Length header creates an upload and responds with its id and
+// offset. A PATCH with the id query parameter and an Upload-Offset header matching the current offset
+// appends the request body to the upload, and a HEAD with the id reports the current Upload-Offset and
+// Upload-Length. The data is stored in storageDir under the upload's id, with its state kept in a sidecar
+// .info file. Uploads are limited to MaxFileSize, and chunks for the same upload must not be sent concurrently
+func (t *Tools) ResumableUpload(w http.ResponseWriter, r *http.Request, storageDir string) {
+	if t.MaxFileSize == 0 {
+		t.MaxFileSize = 1024 * 1024 * 1024
+	}
+
+	switch r.Method {
+	case http.MethodPost:
+		length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length < 0 {
+			_ = t.ErrorJSON(w, errors.New("a valid Upload-Length header is required"))
+			return
+		}
+		if length > int64(t.MaxFileSize) {
+			_ = t.ErrorJSON(w, errors.New("the uploaded file is too big"), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		if err := t.CreateDirIfNotExist(storageDir); err != nil {
+			_ = t.ErrorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		id := t.SortableID()
+		info, _ := json.Marshal(resumableUpload{Length: length})
+		if err := os.WriteFile(filepath.Join(storageDir, id+".info"), info, 0644); err != nil {
+			_ = t.ErrorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+		if err := os.WriteFile(filepath.Join(storageDir, id), nil, 0644); err != nil {
+			_ = t.ErrorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Upload-Offset", "0")
+		_ = t.WriteJSON(w, http.StatusCreated, JSONResponse{
+			Message: "upload created",
+			Data:    map[string]interface{}{"id": id, "offset": 0},
+		})
+
+	case http.MethodHead, http.MethodPatch:
+		id := r.URL.Query().Get("id")
+		if !resumableIDPattern.MatchString(id) {
+			_ = t.ErrorJSON(w, errors.New("a valid upload id is required"))
+			return
+		}
+
+		dataPath := filepath.Join(storageDir, id)
+		info, err := os.ReadFile(dataPath + ".info")
+		if err != nil {
+			_ = t.ErrorJSON(w, errors.New("upload not found"), http.StatusNotFound)
+			return
+		}
+
+		var upload resumableUpload
+		if err := json.Unmarshal(info, &upload); err != nil {
+			_ = t.ErrorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		stat, err := os.Stat(dataPath)
+		if err != nil {
+			_ = t.ErrorJSON(w, errors.New("upload not found"), http.StatusNotFound)
+			return
+		}
+		offset := stat.Size()
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+
+		if r.Method == http.MethodHead {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+
+		requested, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil {
+			_ = t.ErrorJSON(w, errors.New("a valid Upload-Offset header is required"))
+			return
+		}
+		if requested != offset {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			_ = t.ErrorJSON(w, fmt.Errorf("upload offset is %d, not %d", offset, requested), http.StatusConflict)
+			return
+		}
+
+		out, err := os.OpenFile(dataPath, os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			_ = t.ErrorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+		defer out.Close()
+
+		// read one byte more than remains so a chunk that is too long can be detected
+		remaining := upload.Length - offset
+		n, err := io.Copy(out, io.LimitReader(r.Body, remaining+1))
+		if n > remaining {
+			_ = out.Truncate(upload.Length)
+			w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Length, 10))
+			_ = t.ErrorJSON(w, errors.New("chunk extends beyond the upload length"), http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		// keep whatever arrived before a dropped connection, so the client can resume from there
+		w.Header().Set("Upload-Offset", strconv.FormatInt(offset+n, 10))
+		if err != nil {
+			_ = t.ErrorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "POST, HEAD, PATCH")
+		_ = t.ErrorJSON(w, fmt.Errorf("method %s is not allowed", r.Method), http.StatusMethodNotAllowed)
+	}
+}
+
+// CreateDirIfNotExist creates a directory if it does not exist
+func (t *Tools) CreateDirIfNotExist(path string) error {
+	const mode = 0755
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err := os.MkdirAll(path, mode)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Slugify returns a slugified version of a string (e.g. "Hello World" becomes "hello-world")
+func (t *Tools) Slugify(s string) (string, error) {
+	if s == "" {
+		return "", errors.New("string is empty")
+	}
+
+	var re = regexp.MustCompile(`[^a-z\d]+`)
+	slug := strings.Trim(re.ReplaceAllString(strings.ToLower(s), "-"), "-")
+	if len(slug) == 0 {
+		return "", errors.New("slug is empty")
+	}
+	return slug, nil
+}
+
+// defaultStopWords are the English words SlugifySEO removes when no stop words are given
+var defaultStopWords = []string{
+	"a", "an", "and", "are", "as", "at", "be", "by", "for", "from", "in", "is", "it", "of", "on", "or", "the",
+	"to", "with",
+}
+
+// SlugifySEO returns a slug of s like Slugify with stopWords removed, so "The History of the World" becomes
+// "history-world". If stopWords is nil a default English list is used. Stop words are matched without
+// regard to case, and if every word of s is a stop word the plain slug is returned instead
+func (t *Tools) SlugifySEO(s string, stopWords []string) (string, error) {
+	if stopWords == nil {
+		stopWords = defaultStopWords
+	}
+
+	stop := make(map[string]bool, len(stopWords))
+	for _, w := range stopWords {
+		stop[strings.ToLower(w)] = true
+	}
+
+	var re = regexp.MustCompile(`[^a-z\d]+`)
+	var kept []string
+	for _, word := range re.Split(strings.ToLower(s), -1) {
+		if word != "" && !stop[word] {
+			kept = append(kept, word)
+		}
+	}
+
+	if len(kept) == 0 {
+		return t.Slugify(s)
+	}
+
+	return t.Slugify(strings.Join(kept, " "))
+}
+
+// SlugifyBatchUnique slugifies each of items, in order, making every slug unique within the batch by adding
+// "-2", "-3" and so on to a slug that has already been used, so "C++" and "C#" become "c" and "c-2". An
+// error is returned if any item cannot be slugified
+func (t *Tools) SlugifyBatchUnique(items []string) ([]string, error) {
+	slugs := make([]string, len(items))
+	used := make(map[string]bool, len(items))
+
+	for i, item := range items {
+		slug, err := t.Slugify(item)
+		if err != nil {
+			return nil, fmt.Errorf("item %d (%q): %w", i, item, err)
+		}
+
+		unique := slug
+		for n := 2; used[unique]; n++ {
+			unique = fmt.Sprintf("%s-%d", slug, n)
+		}
+
+		used[unique] = true
+		slugs[i] = unique
+	}
+
+	return slugs, nil
+}
+
+// IsCanonicalSlug reports whether s is already in the form Slugify would produce, so that a request for a
+// non-canonical slug can be redirected to the canonical one
+func (t *Tools) IsCanonicalSlug(s string) bool {
+	slug, err := t.Slugify(s)
+	return err == nil && slug == s
+}
+
+// UsernameOptions are the rules NormalizeUsername applies. MinLength and MaxLength default to 3 and 32.
+// ASCII letters and digits are always allowed, along with any characters in AllowedSymbols (e.g. "_-.").
+// Reserved names are matched without regard to case
+type UsernameOptions struct {
+	Lowercase      bool
+	MinLength      int
+	MaxLength      int
+	AllowedSymbols string
+	Reserved       []string
+}
+
+// NormalizeUsername trims s, lowercases it if opts.Lowercase is set, and strips any characters that are not
+// ASCII letters, digits or one of opts.AllowedSymbols, along with symbols at either end. Non-ASCII letters,
+// digits and combining marks are rejected rather than stripped, so homoglyphs such as a Cyrillic "а" cannot
+// slip past the reserved names and differently normalized spellings cannot become distinct usernames. It
+// returns an error if the result is too short, too long or a reserved name
+func (t *Tools) NormalizeUsername(s string, opts UsernameOptions) (string, error) {
+	minLength, maxLength := 3, 32
+	if opts.MinLength > 0 {
+		minLength = opts.MinLength
+	}
+	if opts.MaxLength > 0 {
+		maxLength = opts.MaxLength
+	}
+
+	s = strings.TrimSpace(s)
+	if opts.Lowercase {
+		s = strings.ToLower(s)
+	}
+
+	var b strings.Builder
+	for _, r := range s {
+		switch {
+		case strings.ContainsRune(opts.AllowedSymbols, r):
+			b.WriteRune(r)
+		case r > unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r)):
+			return "", errors.New("username may only contain ascii letters and digits")
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			b.WriteRune(r)
+		}
+	}
+	username := strings.Trim(b.String(), opts.AllowedSymbols)
+
+	length := utf8.RuneCountInString(username)
+	if length < minLength {
+		return "", fmt.Errorf("username must be at least %d characters", minLength)
+	}
+	if length > maxLength {
+		return "", fmt.Errorf("username must be no more than %d characters", maxLength)
+	}
+
+	for _, reserved := range opts.Reserved {
+		if strings.EqualFold(username, reserved) {
+			return "", fmt.Errorf("username %q is reserved", username)
+		}
+	}
+
+	return username, nil
+}
+
+// SlugifyWithDate returns a slug of s prefixed with tm formatted using layout, which follows Go's reference
+// time format (e.g. "2006/01" gives "2024/03/my-post")
+func (t *Tools) SlugifyWithDate(s string, tm time.Time, layout string) (string, error) {
+	slug, err := t.Slugify(s)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s/%s", tm.Format(layout), slug), nil
+}
+
+// Truncate shortens s to at most maxRunes runes without splitting a multibyte character. If ellipsis is
+// true and s was shortened, the last rune is replaced with "…" so the result still fits in maxRunes. A
+// string that is already within the limit is returned unchanged
+func (t *Tools) Truncate(s string, maxRunes int, ellipsis bool) string {
+	if maxRunes <= 0 {
+		return ""
+	}
+
+	if utf8.RuneCountInString(s) <= maxRunes {
+		return s
+	}
+
+	keep := maxRunes
+	if ellipsis {
+		keep--
+	}
+
+	// find the byte offset of the rune boundary after keep runes
+	end, count := 0, 0
+	for i := range s {
+		if count == keep {
+			end = i
+			break
+		}
+		count++
+	}
+
+	if ellipsis {
+		return s[:end] + "…"
+	}
+
+	return s[:end]
+}
+
+// DetectCharset returns a best guess at the character encoding of sample: "utf-8", "utf-16le", "utf-16be"
+// or "iso-8859-1". A byte order mark settles it; otherwise valid UTF-8 is taken as UTF-8, a pattern of zero
+// bytes in alternate positions as UTF-16, and anything else as Latin-1. Other zero bytes mean the sample is
+// not text and return an error. A sample cut from a longer text should end on a whole character
+func (t *Tools) DetectCharset(sample []byte) (string, error) {
+	if len(sample) == 0 {
+		return "", errors.New("sample is empty")
+	}
+
+	switch {
+	case bytes.HasPrefix(sample, []byte{0xEF, 0xBB, 0xBF}):
+		return "utf-8", nil
+	case bytes.HasPrefix(sample, []byte{0xFF, 0xFE}):
+		return "utf-16le", nil
+	case bytes.HasPrefix(sample, []byte{0xFE, 0xFF}):
+		return "utf-16be", nil
+	}
+
+	// text in UTF-16 without a byte order mark is mostly ascii, which has a zero high byte
+	var evenZeros, oddZeros int
+	for i, c := range sample {
+		if c == 0 {
+			if i%2 == 0 {
+				evenZeros++
+			} else {
+				oddZeros++
+			}
+		}
+	}
+	if pairs := len(sample) / 2; pairs > 0 {
+		switch {
+		case oddZeros > pairs/2 && evenZeros == 0:
+			return "utf-16le", nil
+		case evenZeros > pairs/2 && oddZeros == 0:
+			return "utf-16be", nil
+		}
+	}
+	if evenZeros+oddZeros > 0 {
+		return "", errors.New("sample does not look like text")
+	}
+
+	if utf8.Valid(sample) {
+		return "utf-8", nil
+	}
+
+	return "iso-8859-1", nil
+}
+
+// TranscodeToUTF8 converts data from charset, as returned by DetectCharset, to UTF-8, dropping any byte
+// order mark. An unsupported charset returns an error
+func (t *Tools) TranscodeToUTF8(data []byte, charset string) ([]byte, error) {
+	switch strings.ToLower(charset) {
+	case "utf-8", "utf8", "us-ascii":
+		return bytes.TrimPrefix(data, []byte{0xEF, 0xBB, 0xBF}), nil
+
+	case "utf-16le", "utf-16be":
+		var order binary.ByteOrder = binary.LittleEndian
+		bom := []byte{0xFF, 0xFE}
+		if strings.ToLower(charset) == "utf-16be" {
+			order, bom = binary.BigEndian, []byte{0xFE, 0xFF}
+		}
+		data = bytes.TrimPrefix(data, bom)
+		if len(data)%2 != 0 {
+			return nil, errors.New("utf-16 data has an odd number of bytes")
+		}
+
+		units := make([]uint16, len(data)/2)
+		for i := range units {
+			units[i] = order.Uint16(data[2*i:])
+		}
+		return []byte(string(utf16.Decode(units))), nil
+
+	case "iso-8859-1", "latin-1", "latin1":
+		// every Latin-1 byte is the code point of the same value
+		runes := make([]rune, len(data))
+		for i, c := range data {
+			runes[i] = rune(c)
+		}
+		return []byte(string(runes)), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+}
+
+// languageWords holds the most frequent short words of the latin script languages DetectTextLanguage
+// can tell apart
+var languageWords = map[string][]string{
+	"en": {"the", "and", "of", "to", "is", "in", "that", "it", "was", "for", "with", "you", "this", "are"},
+	"es": {"el", "la", "de", "que", "y", "en", "los", "del", "las", "por", "una", "es", "con", "para"},
+	"fr": {"le", "la", "de", "et", "les", "des", "est", "un", "une", "du", "que", "pour", "dans", "pas"},
+	"de": {"der", "die", "und", "das", "ist", "nicht", "ein", "eine", "zu", "mit", "den", "von", "sich", "auf"},
+	"it": {"il", "di", "che", "la", "e", "per", "un", "non", "sono", "della", "del", "gli", "una", "con"},
+	"pt": {"o", "de", "que", "e", "do", "da", "em", "um", "para", "com", "não", "uma", "os", "se"},
+	"nl": {"de", "het", "een", "en", "van", "is", "dat", "op", "te", "niet", "zijn", "met", "voor", "ik"},
+}
+
+// DetectTextLanguage returns a best guess ISO 639-1 code for the language of sample, or "und" if it cannot
+// tell. Text in a non latin script is identified by its script, while latin text is scored against lists of
+// common words, so the result is only a rough guess and works best on a few sentences or more
+func (t *Tools) DetectTextLanguage(sample []byte) string {
+	scripts := []struct {
+		code  string
+		table *unicode.RangeTable
+	}{
+		{"ja", unicode.Hiragana},
+		{"ja", unicode.Katakana},
+		{"ko", unicode.Hangul},
+		{"zh", unicode.Han},
+		{"ru", unicode.Cyrillic},
+		{"el", unicode.Greek},
+		{"ar", unicode.Arabic},
+		{"he", unicode.Hebrew},
+		{"hi", unicode.Devanagari},
+		{"th", unicode.Thai},
+	}
+
+	text := string(sample)
+
+	counts := make(map[string]int)
+	letters := 0
+	for _, c := range text {
+		if !unicode.IsLetter(c) {
+			continue
+		}
+		letters++
+		for _, sc := range scripts {
+			if unicode.Is(sc.table, c) {
+				counts[sc.code]++
+				break
+			}
+		}
+	}
+
+	if letters == 0 {
+		return "und"
+	}
+
+	// kana is only used in Japanese, so any amount of it outweighs the Han characters Japanese shares with Chinese
+	if counts["ja"] > 0 {
+		return "ja"
+	}
+
+	best, bestCount := "", 0
+	for code, n := range counts {
+		if n > bestCount {
+			best, bestCount = code, n
+		}
+	}
+	if bestCount*2 > letters {
+		return best
+	}
+
+	words := strings.FieldsFunc(strings.ToLower(text), func(c rune) bool {
+		return !unicode.IsLetter(c)
+	})
+
+	best, bestCount = "und", 0
+	for code, common := range languageWords {
+		n := 0
+		for _, w := range words {
+			for _, c := range common {
+				if w == c {
+					n++
+					break
+				}
+			}
+		}
+		// break ties by code so the result does not depend on map order
+		if n > bestCount || (n == bestCount && n > 0 && code < best) {
+			best, bestCount = code, n
+		}
+	}
+
+	return best
+}
+
+// ValidateCSVHeaders reads the header row of the CSV data in r and returns an error naming any expected
+// columns that are missing and any columns that were not expected. Column names are trimmed of whitespace
+// (and a leading byte order mark) before comparing, and the order of the columns does not matter
+func (t *Tools) ValidateCSVHeaders(r io.Reader, expected []string) error {
+	headers, err := csv.NewReader(r).Read()
+	if err == io.EOF {
+		return errors.New("csv data is empty")
+	}
+	if err != nil {
+		return err
+	}
+
+	headers[0] = strings.TrimPrefix(headers[0], "\ufeff")
+
+	found := make(map[string]bool, len(headers))
+	for i, h := range headers {
+		headers[i] = strings.TrimSpace(h)
+		found[headers[i]] = true
+	}
+
+	want := make(map[string]bool, len(expected))
+	var missing, unexpected []string
+	for _, e := range expected {
+		want[e] = true
+		if !found[e] {
+			missing = append(missing, e)
+		}
+	}
+
+	for _, h := range headers {
+		if !want[h] {
+			unexpected = append(unexpected, h)
+		}
+	}
+
+	var problems []string
+	if len(missing) > 0 {
+		problems = append(problems, fmt.Sprintf("missing columns: %s", strings.Join(missing, ", ")))
+	}
+	if len(unexpected) > 0 {
+		problems = append(problems, fmt.Sprintf("unexpected columns: %s", strings.Join(unexpected, ", ")))
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("csv headers do not match : %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// WriteCSV writes rows to the client as a CSV attachment named filename
+func (t *Tools) WriteCSV(w http.ResponseWriter, filename string, rows [][]string) error {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", filename))
+
+	cw := csv.NewWriter(w)
+	if err := cw.WriteAll(rows); err != nil {
+		return err
+	}
+
+	return cw.Error()
+}
+
+// WriteCSVStructs writes records, which must be a slice of structs or of pointers to structs, to the client as
+// a CSV attachment named filename. There is a column for each exported field, named by its csv tag or else the
+// field name, and a tag of "-" leaves the field out. The fields of nested structs become columns named
+// parent.child, while those of embedded structs are included as if they were declared directly. A struct field
+// whose type is already being expanded, such as a Parent *Category inside Category, is left out. Values that
+// implement encoding.TextMarshaler or fmt.Stringer are written using them, and nil pointers as empty cells
+func (t *Tools) WriteCSVStructs(w http.ResponseWriter, filename string, records interface{}) error {
+	rv := reflect.ValueOf(records)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return errors.New("csv records must be a slice of structs")
+	}
+
+	et := rv.Type().Elem()
+	for et.Kind() == reflect.Ptr {
+		et = et.Elem()
+	}
+	if et.Kind() != reflect.Struct {
+		return errors.New("csv records must be a slice of structs")
+	}
+
+	columns := csvColumns(et, "", nil, make(map[reflect.Type]bool))
+	if len(columns) == 0 {
+		return errors.New("csv records have no exported fields")
+	}
+
+	rows := make([][]string, 0, rv.Len()+1)
+	header := make([]string, len(columns))
+	for i, c := range columns {
+		header[i] = c.name
+	}
+	rows = append(rows, header)
+
+	for i := 0; i < rv.Len(); i++ {
+		record := rv.Index(i)
+		for record.Kind() == reflect.Ptr && !record.IsNil() {
+			record = record.Elem()
+		}
+
+		row := make([]string, len(columns))
+		if record.Kind() == reflect.Struct {
+			for j, c := range columns {
+				row[j] = csvValue(record, c.index)
+			}
+		}
+		rows = append(rows, row)
+	}
+
+	return t.WriteCSV(w, filename, rows)
+}
+
+// csvColumn is a column written by WriteCSVStructs, along with the index path of the field it comes from
+type csvColumn struct {
+	name  string
+	index []int
+}
+
+// csvColumns returns the columns for the fields of rt, with the names of nested fields prefixed by prefix.
+// expanding holds the struct types enclosing rt, so that a type which refers to itself is not expanded again
+func csvColumns(rt reflect.Type, prefix string, index []int, expanding map[reflect.Type]bool) []csvColumn {
+	var columns []csvColumn
+
+	expanding[rt] = true
+	defer delete(expanding, rt)
+
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+
+		name := strings.Split(f.Tag.Get("csv"), ",")[0]
+		if name == "-" {
+			continue
+		}
+
+		fieldIndex := append(append([]int{}, index...), i)
+
+		ft := f.Type
+		for ft.Kind() == reflect.Ptr {
+			ft = ft.Elem()
+		}
+
+		if ft.Kind() == reflect.Struct && !csvFormats(ft) {
+			switch {
+			case expanding[ft]:
+			case f.Anonymous && name == "":
+				columns = append(columns, csvColumns(ft, prefix, fieldIndex, expanding)...)
+			case f.PkgPath == "":
+				if name == "" {
+					name = f.Name
+				}
+				columns = append(columns, csvColumns(ft, prefix+name+".", fieldIndex, expanding)...)
+			}
+			continue
+		}
+
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		columns = append(columns, csvColumn{name: prefix + name, index: fieldIndex})
+	}
+
+	return columns
+}
+
+// csvFormats reports whether values of type rt format themselves, so should not be split into columns
+func csvFormats(rt reflect.Type) bool {
+	pt := reflect.PtrTo(rt)
+	return rt.Implements(textMarshalerType) || pt.Implements(textMarshalerType) ||
+		rt.Implements(stringerType) || pt.Implements(stringerType)
+}
+
+var (
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+	stringerType      = reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+)
+
+// csvValue formats the field of v at index, returning an empty string if a nil pointer is in the way
+func csvValue(v reflect.Value, index []int) string {
+	for _, i := range index {
+		for v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				return ""
+			}
+			v = v.Elem()
+		}
+		v = v.Field(i)
+	}
+
+	if v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return ""
+		}
+	}
+
+	if v.CanInterface() {
+		switch x := v.Interface().(type) {
+		case encoding.TextMarshaler:
+			b, err := x.MarshalText()
+			if err != nil {
+				return ""
+			}
+			return string(b)
+		case fmt.Stringer:
+			return x.String()
+		}
+	}
+
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, v.Type().Bits())
+	}
+
+	if !v.IsValid() || !v.CanInterface() {
+		return ""
+	}
+
+	return fmt.Sprint(v.Interface())
+}
+
+// DownLoadStaticFile downloads a static file and does not display it in the browser by setting the Content-Disposition
+func (t *Tools) DownloadStaticFile(w http.ResponseWriter, r *http.Request, pathName, displayName string) {
+	// fp := path.Join(p, file)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", displayName))
+
+	http.ServeFile(w, r, pathName)
+
+}
+
+// DownloadDirAsZip streams the contents of dirPath to the client as a zip attachment named archiveName,
+// storing each file under its path relative to dirPath. Symlinks are skipped so the archive cannot include
+// anything from outside the directory. An error is returned without writing a response if dirPath is not a
+// directory; errors after that point can only be returned, as the response has already started
+func (t *Tools) DownloadDirAsZip(w http.ResponseWriter, r *http.Request, dirPath, archiveName string) error {
+	info, err := os.Stat(dirPath)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("%s is not a directory", dirPath)
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"%s\"", archiveName))
+
+	zw := zip.NewWriter(w)
+
+	err = filepath.WalkDir(dirPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		// only regular files are archived, which leaves out directories, symlinks and devices
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dirPath, path)
+		if err != nil {
+			return err
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		hdr, err := zip.FileInfoHeader(info)
+		if err != nil {
+			return err
+		}
+		hdr.Name = filepath.ToSlash(rel)
+		hdr.Method = zip.Deflate
+
+		out, err := zw.CreateHeader(hdr)
+		if err != nil {
+			return err
+		}
+
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+
+		_, err = io.Copy(out, in)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// SignURL returns baseURL with an expires query parameter set to the given time and a signature parameter
+// holding an HMAC-SHA256 of the path and query keyed with secret, so that VerifySignedURL can later check it
+// has not been tampered with or expired. The scheme and host are not signed, as a server does not see them
+// in the request URL. An empty string is returned if baseURL cannot be parsed
+func (t *Tools) SignURL(baseURL string, expires time.Time, secret string) string {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return ""
+	}
+
+	q := u.Query()
+	q.Del("signature")
+	q.Set("expires", strconv.FormatInt(expires.Unix(), 10))
+	u.RawQuery = q.Encode()
+
+	q.Set("signature", urlSignature(u, secret))
+	u.RawQuery = q.Encode()
+
+	return u.String()
+}
+
+// VerifySignedURL checks that fullURL was signed by SignURL with secret and has not expired. fullURL may be
+// absolute or just a path and query, such as r.URL.String() in a handler. It returns false with an error
+// describing the problem if the signature is missing, does not match or has expired
+func (t *Tools) VerifySignedURL(fullURL, secret string) (bool, error) {
+	u, err := url.Parse(fullURL)
+	if err != nil {
+		return false, err
+	}
+
+	q := u.Query()
+	signature := q.Get("signature")
+	if signature == "" {
+		return false, errors.New("url is not signed")
+	}
+
+	q.Del("signature")
+	u.RawQuery = q.Encode()
+
+	if !hmac.Equal([]byte(signature), []byte(urlSignature(u, secret))) {
+		return false, errors.New("url signature is invalid")
+	}
+
+	expires, err := strconv.ParseInt(q.Get("expires"), 10, 64)
+	if err != nil {
+		return false, errors.New("url expiry is invalid")
+	}
+
+	if time.Now().Unix() > expires {
+		return false, errors.New("url has expired")
+	}
+
+	return true, nil
+}
+
+// urlSignature returns the hex encoded HMAC-SHA256 of the path and query of u keyed with secret
+func urlSignature(u *url.URL, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(u.RequestURI()))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifySignedRequest checks that the URL of r was signed by SignURL with secret and has not expired, as
+// VerifySignedURL does
+func (t *Tools) VerifySignedRequest(r *http.Request, secret string) (bool, error) {
+	return t.VerifySignedURL(r.URL.RequestURI(), secret)
+}
+
+// EncodeCursor returns an opaque pagination cursor holding v, such as the last id seen, as base64 encoded
+// json signed with CursorSecret so that DecodeCursor can detect a cursor that has been tampered with
+func (t *Tools) EncodeCursor(v interface{}) (string, error) {
+	if t.CursorSecret == "" {
+		return "", errors.New("CursorSecret must be set to encode cursors")
+	}
+
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return encoded + "." + cursorSignature(encoded, t.CursorSecret), nil
+}
+
+// DecodeCursor verifies a cursor made by EncodeCursor and unmarshals the value it holds into dst. An error
+// is returned if the cursor is malformed or its signature does not match
+func (t *Tools) DecodeCursor(cursor string, dst interface{}) error {
+	if t.CursorSecret == "" {
+		return errors.New("CursorSecret must be set to decode cursors")
+	}
+
+	encoded, signature, ok := strings.Cut(cursor, ".")
+	if !ok {
+		return errors.New("cursor is malformed")
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(cursorSignature(encoded, t.CursorSecret))) {
+		return errors.New("cursor signature is invalid")
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return errors.New("cursor is malformed")
+	}
+
+	return json.Unmarshal(payload, dst)
+}
+
+// cursorSignature returns the base64 encoded HMAC-SHA256 of an encoded cursor keyed with secret
+func cursorSignature(encoded, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(encoded))
+
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// errors returned by ParseHMACJWT, so callers can tell a bad token from one that is out of date
+var (
+	ErrInvalidJWT          = errors.New("token is malformed")
+	ErrInvalidJWTSignature = errors.New("token signature is invalid")
+	ErrJWTExpired          = errors.New("token has expired")
+	ErrJWTNotYetValid      = errors.New("token is not valid yet")
+)
+
+// ParseHMACJWT verifies the HS256 signature of a JSON web token with secret, checks its exp and nbf claims
+// against the current time, and returns its claims. The signature is compared in constant time. It returns
+// ErrInvalidJWT, ErrInvalidJWTSignature, ErrJWTExpired or ErrJWTNotYetValid (possibly wrapped) when the
+// token is rejected. Tokens signed with any other algorithm, including "none", are rejected
+func (t *Tools) ParseHMACJWT(token, secret string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidJWT
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("%w: header is not valid base64", ErrInvalidJWT)
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+	}
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, fmt.Errorf("%w: header is not valid json", ErrInvalidJWT)
+	}
+	if header.Alg != "HS256" {
+		return nil, fmt.Errorf("%w: unsupported algorithm %q", ErrInvalidJWT, header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("%w: signature is not valid base64", ErrInvalidJWT)
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return nil, ErrInvalidJWTSignature
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("%w: claims are not valid base64", ErrInvalidJWT)
+	}
+
+	var claims map[string]interface{}
+	if err := json.Unmarshal(claimsJSON, &claims); err != nil {
+		return nil, fmt.Errorf("%w: claims are not valid json", ErrInvalidJWT)
+	}
+
+	now := time.Now().Unix()
+
+	if exp, ok := claims["exp"]; ok {
+		e, ok := exp.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%w: exp is not a number", ErrInvalidJWT)
+		}
+		if now >= int64(e) {
+			return nil, ErrJWTExpired
+		}
+	}
+
+	if nbf, ok := claims["nbf"]; ok {
+		n, ok := nbf.(float64)
+		if !ok {
+			return nil, fmt.Errorf("%w: nbf is not a number", ErrInvalidJWT)
+		}
+		if now < int64(n) {
+			return nil, ErrJWTNotYetValid
+		}
+	}
+
+	return claims, nil
+}
+
+// FileInfo describes an entry in a directory listing
+type FileInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	IsDir     bool      `json:"is_dir"`
+	IsSymlink bool      `json:"is_symlink"`
+	ModTime   time.Time `json:"mod_time"`
+}
+
+// ListDir returns the entries of the directory at path, sorted by name. Symlinks are marked with IsSymlink
+// and described by the link itself rather than followed, so a link to a directory has IsDir false and the
+// listing never reveals anything outside the directory, including the link's target
+func (t *Tools) ListDir(path string) ([]FileInfo, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]FileInfo, 0, len(entries))
+	for _, e := range entries {
+		info, err := e.Info()
+		if err != nil {
+			return nil, err
+		}
+
+		files = append(files, FileInfo{
+			Name:      e.Name(),
+			Size:      info.Size(),
+			IsDir:     e.IsDir(),
+			IsSymlink: e.Type()&os.ModeSymlink != 0,
+			ModTime:   info.ModTime(),
+		})
+	}
+
+	return files, nil
+}
+
+// ListDirHandler returns a handler that writes the listing of the directory at path as the data of a
+// JSONResponse, or a 404 JSON error if it cannot be read
+func (t *Tools) ListDirHandler(path string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		files, err := t.ListDir(path)
+		if err != nil {
+			_ = t.ErrorJSON(w, errors.New("directory not found"), http.StatusNotFound)
+			return
+		}
+
+		_ = t.WriteJSON(w, http.StatusOK, JSONResponse{Message: "ok", Data: files})
+	}
+}
+
+// StaticAsset returns a handler that serves content, such as an embedded favicon.ico or robots.txt, with
+// a long lived immutable Cache-Control header and an ETag of its checksum, answering a matching
+// If-None-Match with a 304. If contentType is empty it is worked out from the extension of name, then from
+// the content itself
+func (t *Tools) StaticAsset(name string, content []byte, contentType string) http.Handler {
+	if contentType == "" {
+		contentType = mime.TypeByExtension(filepath.Ext(name))
+	}
+	if contentType == "" {
+		contentType = http.DetectContentType(content)
+	}
+
+	sum := sha256.Sum256(content)
+	etag := fmt.Sprintf(`"%s"`, hex.EncodeToString(sum[:8]))
+	modTime := time.Now()
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", contentType)
+
+		for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+			match = strings.TrimSpace(match)
+			if match == etag || match == "W/"+etag || match == "*" {
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+		}
+
+		http.ServeContent(w, r, name, modTime, bytes.NewReader(content))
+	})
+}
+
+// SPAHandler returns a handler that serves a single page app from staticDir. Requests for files that exist
+// are served as they are, while any other path without a file extension gets indexFile (e.g. "index.html")
+// with a 200 so that client-side routing can handle it. Missing paths with an extension, such as a stale
+// asset, get a 404. Paths are cleaned before use and symlinks are resolved, so nothing outside staticDir
+// is served, and any path with a segment starting with "." (such as .env or .git) gets a 404
+func (t *Tools) SPAHandler(staticDir, indexFile string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// cleaning the path as an absolute path removes any ".." that would climb out of staticDir
+		urlPath := path.Clean("/" + r.URL.Path)
+		if hasDotSegment(urlPath) {
+			http.NotFound(w, r)
+			return
+		}
+
+		name := filepath.Join(staticDir, filepath.FromSlash(urlPath))
+
+		if info, err := os.Stat(name); err == nil && !info.IsDir() {
+			resolved, ok := resolveInDir(staticDir, name)
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			serveSPAFile(w, r, resolved)
+			return
+		}
+
+		if path.Ext(urlPath) != "" {
+			http.NotFound(w, r)
+			return
+		}
+
+		// the index must not be cached, so new deployments are picked up
+		w.Header().Set("Cache-Control", "no-cache")
+		serveSPAFile(w, r, filepath.Join(staticDir, indexFile))
+	})
+}
+
+// hasDotSegment reports whether any segment of the slash separated path p starts with "."
+func hasDotSegment(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if strings.HasPrefix(segment, ".") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolveInDir resolves any symlinks in name and returns the result, which is only ok if it is still inside
+// dir and none of its path below dir starts with "."
+func resolveInDir(dir, name string) (string, bool) {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return "", false
+	}
+
+	resolved, err := filepath.EvalSymlinks(name)
+	if err != nil {
+		return "", false
+	}
+
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", false
+	}
+	if hasDotSegment(filepath.ToSlash(rel)) {
+		return "", false
+	}
+
+	return resolved, true
+}
+
+// serveSPAFile serves the file name, without the redirects http.ServeFile makes for index.html
+func serveSPAFile(w http.ResponseWriter, r *http.Request, name string) {
+	f, err := os.Open(name)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// ServeCachedFile serves the file at path with a Cache-Control header allowing it to be cached for maxAge
+// and an ETag derived from the file's modification time and size. A request whose If-None-Match header
+// matches the ETag receives a 304 Not Modified with no body
+func (t *Tools) ServeCachedFile(w http.ResponseWriter, r *http.Request, path string, maxAge time.Duration) {
+	f, err := os.Open(path)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	etag := fmt.Sprintf(`"%x-%x"`, info.ModTime().UnixNano(), info.Size())
+
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+	w.Header().Set("ETag", etag)
+
+	for _, match := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		match = strings.TrimSpace(match)
+		if match == etag || match == "W/"+etag || match == "*" {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// ServeContentRange serves size bytes of content from readerAt, which may be any source such as object
+// storage or an in-memory buffer, honoring Range and conditional request headers. Malformed or
+// unsatisfiable ranges receive a 416 Range Not Satisfiable
+func (t *Tools) ServeContentRange(w http.ResponseWriter, r *http.Request, modTime time.Time, size int64, readerAt io.ReaderAt, contentType string) {
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+
+	http.ServeContent(w, r, "", modTime, io.NewSectionReader(readerAt, 0, size))
+}
+
+// ReadJSONFile reads a json file and unmarshals it into the interface v
+type JSONResponse struct {
+	Error    bool        `json:"error"`
+	Message  string      `json:"message"`
+	Data     interface{} `json:"data,omitempty"`
+	Trace    string      `json:"trace,omitempty"`
+	Warnings []string    `json:"warnings,omitempty"`
+}
+
+// ReadJSONFile reads a json file and unmarshals it into the interface v and returns a JSONResponse struct with the data field set to v and error set to false
+func (t *Tools) ReadJSONFile(w http.ResponseWriter, r *http.Request, data interface{}) error {
+	if t.Metrics == nil {
+		return t.readJSONFile(w, r, data)
+	}
+
+	start := time.Now()
+	body := &countingReader{ReadCloser: r.Body}
+	r.Body = body
+
+	err := t.readJSONFile(w, r, data)
+	t.Metrics.ObserveJSONRead(body.n, time.Since(start), err)
+
+	return err
+}
+
+// readJSONFile does the work of ReadJSONFile
+func (t *Tools) readJSONFile(w http.ResponseWriter, r *http.Request, data interface{}) error {
+	if t.RequireJSONContentType {
+		mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		if err != nil || mediaType != "application/json" {
+			return errors.New("the Content-Type header must be application/json")
+		}
+	}
+
+	maxBytes := 1024 * 1024
+	if t.MaxJSONSize != 0 {
+		maxBytes = t.MaxJSONSize
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+	var src io.Reader = r.Body
+	if t.MaxJSONDepth > 0 || t.MaxJSONArrayElements > 0 || t.RejectDuplicateJSONKeys || t.JSONRewriteFn != nil {
+		// the shape of the document has to be checked, or the document rewritten, before decoding, so read
+		// the whole body up front
+		var buf bytes.Buffer
+		if _, err := t.CopyN(&buf, r.Body, int64(maxBytes)); err != nil {
+			if errors.Is(err, ErrLimitExceeded) || err.Error() == "http: request body too large" {
+				return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+			}
+			return err
+		}
+		raw := buf.Bytes()
+
+		if t.MaxJSONDepth > 0 {
+			if err := checkJSONDepth(raw, t.MaxJSONDepth); err != nil {
+				return err
+			}
+		}
+
+		if t.MaxJSONArrayElements > 0 {
+			if err := checkJSONArrayLength(raw, t.MaxJSONArrayElements); err != nil {
+				return err
+			}
+		}
+
+		if t.RejectDuplicateJSONKeys {
+			if err := checkJSONDuplicateKeys(raw); err != nil {
+				return err
+			}
+		}
+
+		// rewrite after the checks above, which protect whatever parsing the rewrite does
+		if t.JSONRewriteFn != nil {
+			rewritten, err := t.JSONRewriteFn(raw)
+			if err != nil {
+				return err
+			}
+			raw = rewritten
+		}
+		src = bytes.NewReader(raw)
+	}
+
+	// keep a copy of what the decoder reads so it can be checked again for strict field case
+	var body bytes.Buffer
+	if t.StrictFieldCase {
+		src = io.TeeReader(src, &body)
+	}
+	dec := json.NewDecoder(src)
+
+	if !t.AllowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+
+	if t.UseJSONNumber {
+		dec.UseNumber()
+	}
+
+	err := dec.Decode(data)
+	if err != nil {
+		var syntaxError *json.SyntaxError
+		var unmarshalTypeError *json.UnmarshalTypeError
+		var invalidUnmarshalError *json.InvalidUnmarshalError
+
+		switch {
+		case errors.As(err, &syntaxError):
+			return fmt.Errorf("body contains badly-formed JSON (at position %d)", syntaxError.Offset)
+
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			return errors.New("body contains badly-formed JSON")
+
+		case errors.As(err, &unmarshalTypeError):
+			if unmarshalTypeError.Field != "" {
+				return fmt.Errorf("body contains incorrect JSON type for field %q", unmarshalTypeError.Field)
+			}
+			return fmt.Errorf("body contains incorrect JSON type (at position %d)", unmarshalTypeError.Offset)
+
+		case errors.Is(err, io.EOF):
+			return errors.New("body must not be empty")
+
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
+			return fmt.Errorf("body contains unknown key %s", fieldName)
+
+		case err.Error() == "http: request body too large":
+			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+
+		case errors.As(err, &invalidUnmarshalError):
+			return fmt.Errorf("error unmarshalling JSON: %s", err.Error())
+
+		default:
+			return err
+		}
+	}
+
+	err = dec.Decode(&struct{}{})
+	if err != io.EOF {
+		return errors.New("body must only contain a single JSON value")
+	}
+
+	if t.StrictFieldCase {
+		var raw interface{}
+		if err := json.NewDecoder(&body).Decode(&raw); err != nil {
+			return err
+		}
+
+		if err := checkFieldCase(raw, reflect.TypeOf(data)); err != nil {
+			return err
+		}
+	}
+
+	if t.TrimStringFields {
+		trimStrings(reflect.ValueOf(data))
+	}
+
+	return nil
+}
+
+// trimStrings trims leading and trailing white space from every string reachable from v, through pointers,
+// interfaces, struct fields, slices, arrays and maps, so the strings in a JSONMap are trimmed too. Struct
+// fields tagged trim:"-" are left alone
+func trimStrings(v reflect.Value) {
+	switch v.Kind() {
+	case reflect.Ptr:
+		if !v.IsNil() {
+			trimStrings(v.Elem())
+		}
+
+	case reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		// the value held by an interface can't be changed in place, so a trimmed copy replaces it
+		if v.CanSet() {
+			c := reflect.New(v.Elem().Type()).Elem()
+			c.Set(v.Elem())
+			trimStrings(c)
+			v.Set(c)
+			return
+		}
+		trimStrings(v.Elem())
+
+	case reflect.String:
+		if v.CanSet() {
+			v.SetString(strings.TrimSpace(v.String()))
+		}
+
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			f := v.Type().Field(i)
+			if f.PkgPath != "" || f.Tag.Get("trim") == "-" {
+				continue
+			}
+			trimStrings(v.Field(i))
+		}
+
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			trimStrings(v.Index(i))
+		}
+
+	case reflect.Map:
+		// map values are not addressable, so each is trimmed as a copy and stored back in the map
+		for _, k := range v.MapKeys() {
+			c := reflect.New(v.Type().Elem()).Elem()
+			c.Set(v.MapIndex(k))
+			trimStrings(c)
+			v.SetMapIndex(k, c)
+		}
+	}
+}
+
+// JSONMap is a decoded JSON object of unknown shape with typed accessors for its values
+type JSONMap map[string]interface{}
+
+// ReadJSONMap reads a JSON object from the request body into a JSONMap, applying the same limits and checks
+// as ReadJSONFile
+func (t *Tools) ReadJSONMap(w http.ResponseWriter, r *http.Request) (JSONMap, error) {
+	var m JSONMap
+	if err := t.ReadJSONFile(w, r, &m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// String returns the value of key as a string, or an error if it is missing or not a string
+func (m JSONMap) String(key string) (string, error) {
+	v, ok := m[key]
+	if !ok {
+		return "", fmt.Errorf("key %q not found", key)
+	}
+
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("key %q is not a string", key)
+	}
+
+	return s, nil
+}
+
+// Int returns the value of key as an int, or an error if it is missing or not a whole number
+func (m JSONMap) Int(key string) (int, error) {
+	v, ok := m[key]
+	if !ok {
+		return 0, fmt.Errorf("key %q not found", key)
+	}
+
+	switch n := v.(type) {
+	case float64:
+		if n == float64(int(n)) {
+			return int(n), nil
+		}
+	case json.Number:
+		if i, err := strconv.Atoi(n.String()); err == nil {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("key %q is not an integer", key)
+}
+
+// Float returns the value of key as a float64, or an error if it is missing or not a number
+func (m JSONMap) Float(key string) (float64, error) {
+	v, ok := m[key]
+	if !ok {
+		return 0, fmt.Errorf("key %q not found", key)
+	}
+
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case json.Number:
+		if f, err := n.Float64(); err == nil {
+			return f, nil
+		}
+	}
+
+	return 0, fmt.Errorf("key %q is not a number", key)
+}
+
+// Bool returns the value of key as a bool, or an error if it is missing or not a boolean
+func (m JSONMap) Bool(key string) (bool, error) {
+	v, ok := m[key]
+	if !ok {
+		return false, fmt.Errorf("key %q not found", key)
+	}
+
+	b, ok := v.(bool)
+	if !ok {
+		return false, fmt.Errorf("key %q is not a boolean", key)
+	}
+
+	return b, nil
+}
+
+// Validate checks the fields of the struct v against their validate tags, e.g. `validate:"required,min=3"`,
+// and returns a message for each field that fails keyed by its JSON name. The supported rules are
+// required (not the zero value), email, and min=n / max=n, which limit the length of strings, slices and
+// maps and the value of numbers. Nested structs are validated too, with their keys joined by dots. If any
+// field fails, the returned error is non-nil
+func (t *Tools) Validate(v interface{}) (map[string]string, error) {
+	rv := reflect.ValueOf(v)
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return nil, errors.New("cannot validate a nil value")
+		}
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("cannot validate a %s, only structs", rv.Kind())
+	}
+
+	failures := make(map[string]string)
+	if err := validateStruct(rv, "", failures); err != nil {
+		return nil, err
+	}
+
+	if len(failures) > 0 {
+		return failures, errors.New("validation failed")
+	}
+
+	return nil, nil
+}
+
+// ReadJSONSlice reads a request body holding a JSON array into a []T, applying the settings of t as
+// ReadJSONFile does, including MaxJSONSize and MaxJSONArrayElements. It is a function rather than a method
+// because methods cannot have type parameters
+func ReadJSONSlice[T any](t *Tools, w http.ResponseWriter, r *http.Request) ([]T, error) {
+	var items []T
+	if err := t.ReadJSONFile(w, r, &items); err != nil {
+		return nil, err
+	}
+
+	return items, nil
+}
+
+// ReadAndValidateJSON reads the request body into data like ReadJSONFile and then validates it with Validate.
+// Field failures are only returned when the body was read successfully
+func (t *Tools) ReadAndValidateJSON(w http.ResponseWriter, r *http.Request, data interface{}) (map[string]string, error) {
+	if err := t.ReadJSONFile(w, r, data); err != nil {
+		return nil, err
+	}
+
+	return t.Validate(data)
+}
+
+// ReadJSONThen reads the request body into data like ReadJSONFile and then calls after with data, returning
+// its error, so that normalisation or validation can be attached where the body is read. after is only
+// called when the body was read successfully
+func (t *Tools) ReadJSONThen(w http.ResponseWriter, r *http.Request, data interface{}, after func(data interface{}) error) error {
+	if err := t.ReadJSONFile(w, r, data); err != nil {
+		return err
+	}
+
+	if after == nil {
+		return nil
+	}
+
+	return after(data)
+}
+
+// ErrUnsupportedMediaType is returned by ReadBody when the request has a Content-Type it cannot read, and
+// should be reported to the client with http.StatusUnsupportedMediaType
+var ErrUnsupportedMediaType = errors.New("unsupported media type")
+
+// ReadBody reads the request body into dst according to its Content-Type. JSON bodies are read with
+// ReadJSONFile, while url encoded and multipart forms are decoded into the fields of the struct dst points
+// to, matching each field by its form tag, then its json tag, then its name. Uploaded files in a multipart
+// form are left in r.MultipartForm. Any other Content-Type returns ErrUnsupportedMediaType
+func (t *Tools) ReadBody(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return fmt.Errorf("%w: missing or invalid Content-Type", ErrUnsupportedMediaType)
+	}
+
+	switch mediaType {
+	case "application/json":
+		return t.ReadJSONFile(w, r, dst)
+
+	case "application/x-www-form-urlencoded":
+		maxBytes := 1024 * 1024
+		if t.MaxJSONSize != 0 {
+			maxBytes = t.MaxJSONSize
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
+
+		if err := r.ParseForm(); err != nil {
+			return err
+		}
+		return decodeForm(r.PostForm, dst)
+
+	case "multipart/form-data":
+		if t.MaxFileSize == 0 {
+			t.MaxFileSize = 1024 * 1024 * 1024
+		}
+		if err := t.parseMultipartForm(r); err != nil {
+			return err
+		}
+		return decodeForm(r.MultipartForm.Value, dst)
+
+	default:
+		return fmt.Errorf("%w: %s", ErrUnsupportedMediaType, mediaType)
+	}
+}
+
+// decodeForm sets the fields of the struct dst points to from values. Fields may be strings, bools, numbers
+// or slices of them, and a field whose value is missing is left alone
+func decodeForm(values url.Values, dst interface{}) error {
+	rv := reflect.ValueOf(dst)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("form can only be decoded into a pointer to a struct")
+	}
+	rv = rv.Elem()
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := f.Tag.Get("form")
+		if name == "" {
+			name = strings.Split(f.Tag.Get("json"), ",")[0]
+		}
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		vals := values[name]
+		if len(vals) == 0 {
+			continue
+		}
+
+		fv := rv.Field(i)
+		if fv.Kind() == reflect.Slice {
+			slice := reflect.MakeSlice(fv.Type(), len(vals), len(vals))
+			for j, v := range vals {
+				if err := setFormValue(slice.Index(j), v); err != nil {
+					return fmt.Errorf("form field %s: %w", name, err)
+				}
+			}
+			fv.Set(slice)
+			continue
+		}
+
+		if err := setFormValue(fv, vals[0]); err != nil {
+			return fmt.Errorf("form field %s: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+// setFormValue parses s into v according to its kind
+func setFormValue(v reflect.Value, s string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(s, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(n)
+	default:
+		return fmt.Errorf("cannot decode a form value into a %s", v.Kind())
+	}
+
+	return nil
+}
+
+// validateStruct applies the validate tags of the fields of rv, adding failures under prefix
+func validateStruct(rv reflect.Value, prefix string, failures map[string]string) error {
+	rt := rv.Type()
+
+	for i := 0; i < rt.NumField(); i++ {
+		f := rt.Field(i)
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		name = prefix + name
+
+		fv := rv.Field(i)
+
+		if tag := f.Tag.Get("validate"); tag != "" {
+			msg, err := validateField(fv, tag)
+			if err != nil {
+				return fmt.Errorf("field %s : %w", name, err)
+			}
+			if msg != "" {
+				failures[name] = msg
+				continue
+			}
+		}
+
+		for fv.Kind() == reflect.Ptr && !fv.IsNil() {
+			fv = fv.Elem()
+		}
+		if fv.Kind() == reflect.Struct {
+			if err := validateStruct(fv, name+".", failures); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// validateField checks fv against the comma separated rules in tag and returns a message describing the
+// first rule that fails, or an error if the tag itself is invalid
+func validateField(fv reflect.Value, tag string) (string, error) {
+	for fv.Kind() == reflect.Ptr {
+		if fv.IsNil() {
+			if strings.Contains(","+tag+",", ",required,") {
+				return "is required", nil
+			}
+			return "", nil
+		}
+		fv = fv.Elem()
+	}
+
+	for _, rule := range strings.Split(tag, ",") {
+		rule = strings.TrimSpace(rule)
+		name, arg, _ := strings.Cut(rule, "=")
+
+		switch name {
+		case "required":
+			if fv.IsZero() {
+				return "is required", nil
+			}
+
+		case "email":
+			if fv.Kind() != reflect.String {
+				return "", errors.New("email rule only applies to strings")
+			}
+			s := fv.String()
+			if s == "" {
+				continue
+			}
+			if addr, err := mail.ParseAddress(s); err != nil || addr.Address != s {
+				return "must be a valid email address", nil
+			}
+
+		case "min", "max":
+			limit, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return "", fmt.Errorf("invalid %s rule %q", name, rule)
+			}
+
+			var n float64
+			what := ""
+			switch fv.Kind() {
+			case reflect.String:
+				n, what = float64(utf8.RuneCountInString(fv.String())), "characters"
+			case reflect.Slice, reflect.Array, reflect.Map:
+				n, what = float64(fv.Len()), "items"
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+				n = float64(fv.Int())
+			case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+				n = float64(fv.Uint())
+			case reflect.Float32, reflect.Float64:
+				n = fv.Float()
+			default:
+				return "", fmt.Errorf("%s rule does not apply to %s", name, fv.Kind())
+			}
+
+			if name == "min" && n < limit {
+				if what != "" {
+					return fmt.Sprintf("must have at least %s %s", arg, what), nil
+				}
+				return fmt.Sprintf("must be at least %s", arg), nil
+			}
+			if name == "max" && n > limit {
+				if what != "" {
+					return fmt.Sprintf("must have at most %s %s", arg, what), nil
+				}
+				return fmt.Sprintf("must be at most %s", arg), nil
+			}
+
+		case "":
+
+		default:
+			return "", fmt.Errorf("unknown validation rule %q", name)
+		}
+	}
+
+	return "", nil
+}
+
+// checkJSONDepth returns an error if the objects and arrays in data are nested deeper than maxDepth. It
+// only tracks brackets outside of strings, leaving any syntax errors for the decoder to report
+func checkJSONDepth(data []byte, maxDepth int) error {
+	depth := 0
+	inString, escaped := false, false
+
+	for _, c := range data {
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+			if depth > maxDepth {
+				return fmt.Errorf("body must not be nested more than %d levels deep", maxDepth)
+			}
+		case '}', ']':
+			depth--
+		}
+	}
+
+	return nil
+}
+
+// checkJSONArrayLength returns an error if any array in data, at any depth, has more than maxElements
+// elements. Invalid JSON is not reported here, leaving the decoder to describe the problem
+func checkJSONArrayLength(data []byte, maxElements int) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	// element counts of the open containers, with -1 marking an object
+	var counts []int
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+
+		delim, isDelim := tok.(json.Delim)
+		if isDelim && (delim == ']' || delim == '}') {
+			if len(counts) > 0 {
+				counts = counts[:len(counts)-1]
+			}
+			continue
+		}
+
+		// every other token starts a value, which counts as an element of an enclosing array
+		if n := len(counts); n > 0 && counts[n-1] >= 0 {
+			counts[n-1]++
+			if counts[n-1] > maxElements {
+				return fmt.Errorf("body must not contain arrays with more than %d elements", maxElements)
+			}
+		}
+
+		if isDelim {
+			if delim == '[' {
+				counts = append(counts, 0)
+			} else {
+				counts = append(counts, -1)
+			}
+		}
+	}
+}
+
+// checkJSONDuplicateKeys returns an error naming the first key that appears more than once in the same
+// object, at any depth, in data. Invalid JSON is not reported here, leaving the decoder to describe the problem
+func checkJSONDuplicateKeys(data []byte) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+
+	// the open containers, with keys set to the keys seen so far for an object and nil for an array
+	type container struct {
+		keys      map[string]bool
+		expectKey bool
+	}
+	var stack []*container
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil
+		}
+
+		var top *container
+		if len(stack) > 0 {
+			top = stack[len(stack)-1]
+		}
+
+		if delim, ok := tok.(json.Delim); ok && (delim == '}' || delim == ']') {
+			stack = stack[:len(stack)-1]
+			// the closed container was a value, so an enclosing object expects a key next
+			if len(stack) > 0 && stack[len(stack)-1].keys != nil {
+				stack[len(stack)-1].expectKey = true
+			}
+			continue
+		}
+
+		if top != nil && top.keys != nil && top.expectKey {
+			key, _ := tok.(string)
+			if top.keys[key] {
+				return fmt.Errorf("body contains duplicate key %q", key)
+			}
+			top.keys[key] = true
+			top.expectKey = false
+			continue
+		}
+
+		switch tok {
+		case json.Delim('{'):
+			stack = append(stack, &container{keys: make(map[string]bool), expectKey: true})
+		case json.Delim('['):
+			stack = append(stack, &container{})
+		default:
+			if top != nil && top.keys != nil {
+				top.expectKey = true
+			}
+		}
+	}
+}
+
+// checkFieldCase walks the decoded JSON value raw alongside the type t and returns an error if any
+// JSON key matches a struct field name only when compared case-insensitively
+func checkFieldCase(raw interface{}, t reflect.Type) error {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil {
+		return nil
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		fields := jsonFields(t)
+		for key, value := range obj {
+			if field, ok := fields[key]; ok {
+				if err := checkFieldCase(value, field); err != nil {
+					return err
+				}
+				continue
+			}
+
+			for name := range fields {
+				if strings.EqualFold(name, key) {
+					return fmt.Errorf("body contains key %q which does not match the case of field %q", key, name)
+				}
+			}
+		}
+
+	case reflect.Slice, reflect.Array:
+		arr, ok := raw.([]interface{})
+		if !ok {
+			return nil
+		}
+
+		for _, value := range arr {
+			if err := checkFieldCase(value, t.Elem()); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		obj, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+
+		for _, value := range obj {
+			if err := checkFieldCase(value, t.Elem()); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// jsonFields returns the JSON key names of the struct type t mapped to their field types, following
+// the encoding/json rules for tags, unexported fields and embedded structs
+func jsonFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+
+		ft := f.Type
+		if f.Anonymous && name == "" {
+			for ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct {
+				for k, v := range jsonFields(ft) {
+					if _, ok := fields[k]; !ok {
+						fields[k] = v
+					}
+				}
+				continue
+			}
+		}
+
+		if f.PkgPath != "" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		fields[name] = ft
+	}
+
+	return fields
+}
+
+// ReadPagination reads the page and per_page query parameters from the request. Missing or invalid
+// values fall back to page 1 and defaultPerPage, per_page is clamped to maxPerPage, and neither value
+// is ever returned less than 1
+func (t *Tools) ReadPagination(r *http.Request, defaultPerPage, maxPerPage int) (page, perPage int) {
+	if defaultPerPage < 1 {
+		defaultPerPage = 1
+	}
+	if maxPerPage > 0 && defaultPerPage > maxPerPage {
+		defaultPerPage = maxPerPage
+	}
+
+	page = 1
+	if p, err := strconv.Atoi(r.URL.Query().Get("page")); err == nil && p > 0 {
+		page = p
+	}
+
+	perPage = defaultPerPage
+	if pp, err := strconv.Atoi(r.URL.Query().Get("per_page")); err == nil && pp > 0 {
+		perPage = pp
+	}
+	if maxPerPage > 0 && perPage > maxPerPage {
+		perPage = maxPerPage
+	}
+
+	return page, perPage
+}
+
+// ReadDateRange reads the from and to query parameters, parsed with layout (e.g. "2006-01-02"), and checks
+// that from is not after to. When DefaultDateRange is set a missing to defaults to now and a missing from to
+// DefaultDateRange before to; otherwise both are required
+func (t *Tools) ReadDateRange(r *http.Request, layout string) (from, to time.Time, err error) {
+	q := r.URL.Query()
+	fromParam, toParam := strings.TrimSpace(q.Get("from")), strings.TrimSpace(q.Get("to"))
+
+	if t.DefaultDateRange <= 0 && (fromParam == "" || toParam == "") {
+		return time.Time{}, time.Time{}, errors.New("the from and to query parameters are required")
+	}
+
+	to = time.Now()
+	if toParam != "" {
+		if to, err = time.Parse(layout, toParam); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid to date %q, expected the format %s", toParam, layout)
+		}
+	}
+
+	from = to.Add(-t.DefaultDateRange)
+	if fromParam != "" {
+		if from, err = time.Parse(layout, fromParam); err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("invalid from date %q, expected the format %s", fromParam, layout)
+		}
+	}
+
+	if from.After(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("from date %s is after to date %s", from.Format(layout), to.Format(layout))
+	}
+
+	return from, to, nil
+}
+
+// PaginationMeta describes the page of results in a paginated response
+type PaginationMeta struct {
+	Page       int `json:"page"`
+	PerPage    int `json:"per_page"`
+	TotalItems int `json:"total_items"`
+	TotalPages int `json:"total_pages"`
+}
+
+// NewPaginationMeta returns the PaginationMeta for page of totalItems results shown perPage at a time
+func (t *Tools) NewPaginationMeta(page, perPage, totalItems int) PaginationMeta {
+	if perPage < 1 {
+		perPage = 1
+	}
+
+	return PaginationMeta{
+		Page:       page,
+		PerPage:    perPage,
+		TotalItems: totalItems,
+		TotalPages: (totalItems + perPage - 1) / perPage,
+	}
+}
+
+// SetPaginationLinks sets a Link header (RFC 8288) with first, prev, next and last links built from the
+// request URL with its page and per_page query parameters replaced. There is no prev link on the first page
+// and no next link on the last
+func (t *Tools) SetPaginationLinks(w http.ResponseWriter, r *http.Request, meta PaginationMeta) {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	lastPage := meta.TotalPages
+	if lastPage < 1 {
+		lastPage = 1
+	}
+
+	link := func(page int, rel string) string {
+		q := r.URL.Query()
+		q.Set("page", strconv.Itoa(page))
+		q.Set("per_page", strconv.Itoa(meta.PerPage))
+
+		u := url.URL{Scheme: scheme, Host: r.Host, Path: r.URL.Path, RawQuery: q.Encode()}
+
+		return fmt.Sprintf(`<%s>; rel="%s"`, u.String(), rel)
+	}
+
+	links := []string{link(1, "first")}
+	if meta.Page > 1 {
+		links = append(links, link(meta.Page-1, "prev"))
+	}
+	if meta.Page < lastPage {
+		links = append(links, link(meta.Page+1, "next"))
+	}
+	links = append(links, link(lastPage, "last"))
+
+	w.Header().Set("Link", strings.Join(links, ", "))
+}
+
+// SortField is a field to sort by, parsed from a sort query parameter
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+// ParseSort parses the sort query parameter, a comma separated list of field:direction expressions such as
+// "name:asc,created_at:desc", where the direction is optional and defaults to ascending. Every field must
+// be in allowed, so the result is safe to use when building a query. A missing parameter returns no fields
+func (t *Tools) ParseSort(r *http.Request, allowed map[string]bool) ([]SortField, error) {
+	param := strings.TrimSpace(r.URL.Query().Get("sort"))
+	if param == "" {
+		return nil, nil
+	}
+
+	var fields []SortField
+	for _, expr := range strings.Split(param, ",") {
+		field, dir, _ := strings.Cut(strings.TrimSpace(expr), ":")
+
+		if !allowed[field] {
+			return nil, fmt.Errorf("cannot sort by %q", field)
+		}
+
+		sf := SortField{Field: field}
+		switch strings.ToLower(dir) {
+		case "", "asc":
+		case "desc":
+			sf.Descending = true
+		default:
+			return nil, fmt.Errorf("invalid sort direction %q for %s", dir, field)
+		}
+
+		fields = append(fields, sf)
+	}
+
+	return fields, nil
+}
+
+// QueryBool returns the query parameter key as a bool. It accepts true/false, 1/0, yes/no, on/off and
+// t/f in any case, and returns def when the parameter is absent or not recognised
+func (t *Tools) QueryBool(r *http.Request, key string, def bool) bool {
+	switch strings.ToLower(strings.TrimSpace(r.URL.Query().Get(key))) {
+	case "true", "t", "1", "yes", "on":
+		return true
+	case "false", "f", "0", "no", "off":
+		return false
+	default:
+		return def
+	}
+}
+
+// QueryInt returns the query parameter key as an int, or def when it is absent or not a valid integer
+func (t *Tools) QueryInt(r *http.Request, key string, def int) int {
+	i, err := strconv.Atoi(strings.TrimSpace(r.URL.Query().Get(key)))
+	if err != nil {
+		return def
+	}
+
+	return i
+}
+
+// QueryString returns the query parameter key, or def when it is absent or empty
+func (t *Tools) QueryString(r *http.Request, key string, def string) string {
+	s := r.URL.Query().Get(key)
+	if s == "" {
+		return def
+	}
+
+	return s
+}
+
+// QueryList returns the query parameter key split on commas, so "?tags=a, b,,c" gives a, b and c. White
+// space around each value is trimmed and empty values are dropped. Repeated parameters are combined
+func (t *Tools) QueryList(r *http.Request, key string) []string {
+	var list []string
+	for _, param := range r.URL.Query()[key] {
+		for _, v := range strings.Split(param, ",") {
+			if v = strings.TrimSpace(v); v != "" {
+				list = append(list, v)
+			}
+		}
+	}
+
+	return list
+}
+
+// QueryListValidated returns the query parameter key split like QueryList, with an error naming any values
+// that are not in allowed
+func (t *Tools) QueryListValidated(r *http.Request, key string, allowed []string) ([]string, error) {
+	list := t.QueryList(r, key)
+
+	var unknown []string
+	for _, v := range list {
+		ok := false
+		for _, a := range allowed {
+			if v == a {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			unknown = append(unknown, v)
+		}
+	}
+
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("invalid value for %s: %s", key, strings.Join(unknown, ", "))
+	}
+
+	return list, nil
+}
+
+// RedactJSON replaces the value of every key in body named in fields, at any nesting level, with "***"
+// so the payload can be logged safely. Keys are matched case-insensitively. Input that is not valid JSON
+// returns an error rather than the raw body
+func (t *Tools) RedactJSON(body []byte, fields []string) ([]byte, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, fmt.Errorf("cannot redact body : %w", err)
+	}
+
+	return json.Marshal(redact(v, fields))
+}
+
+// redact walks v and masks the values of any object keys named in fields
+func redact(v interface{}, fields []string) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, child := range value {
+			masked := false
+			for _, f := range fields {
+				if strings.EqualFold(k, f) {
+					masked = true
+					break
+				}
+			}
+
+			if masked {
+				value[k] = "***"
+			} else {
+				value[k] = redact(child, fields)
+			}
+		}
+
+	case []interface{}:
+		for i, child := range value {
+			value[i] = redact(child, fields)
+		}
+	}
+
+	return v
+}
+
+// BearerToken returns the token from a "Bearer <token>" Authorization header. The scheme is matched
+// case-insensitively, and an error is returned if the header is missing or malformed
+func (t *Tools) BearerToken(r *http.Request) (string, error) {
+	header := strings.TrimSpace(r.Header.Get("Authorization"))
+	if header == "" {
+		return "", errors.New("authorization header is missing")
+	}
+
+	parts := strings.Fields(header)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+		return "", errors.New("authorization header is not a bearer token")
+	}
+
+	return parts[1], nil
+}
+
+// FlattenJSON flattens the JSON object in body into a single level map whose keys are the dotted paths to
+// each value, with array elements indexed in brackets (e.g. "user.address.city" or "tags[0]"). Empty
+// objects and arrays are kept as values. An error is returned if body is not a JSON object
+func (t *Tools) FlattenJSON(body []byte) (map[string]interface{}, error) {
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+
+	obj, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("body must be a JSON object")
+	}
+
+	flat := make(map[string]interface{})
+	flatten("", obj, flat)
+
+	return flat, nil
+}
+
+// flatten adds v to flat under prefix, recursing into non-empty objects and arrays
+func flatten(prefix string, v interface{}, flat map[string]interface{}) {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		if len(value) == 0 && prefix != "" {
+			flat[prefix] = value
+		}
+		for k, child := range value {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+			flatten(key, child, flat)
+		}
+
+	case []interface{}:
+		if len(value) == 0 {
+			flat[prefix] = value
+		}
+		for i, child := range value {
+			flatten(fmt.Sprintf("%s[%d]", prefix, i), child, flat)
+		}
+
+	default:
+		flat[prefix] = value
+	}
+}
+
+// JSONDiff compares two JSON documents and returns the differences under three keys, each a map keyed by
+// the path of a value in the style of FlattenJSON ("user.address.city", "tags[0]"):
+//
+//	"added":   values only in after
+//	"removed": values only in before
+//	"changed": {"from": old, "to": new} for values in both that differ
+//
+// Objects are compared key by key and arrays element by element, so an added or removed object or array is
+// reported once at its own path rather than for each of its values
+func (t *Tools) JSONDiff(before, after []byte) (map[string]interface{}, error) {
+	var a, b interface{}
+	if err := json.Unmarshal(before, &a); err != nil {
+		return nil, fmt.Errorf("error unmarshalling before document: %w", err)
+	}
+	if err := json.Unmarshal(after, &b); err != nil {
+		return nil, fmt.Errorf("error unmarshalling after document: %w", err)
+	}
+
+	added := make(map[string]interface{})
+	removed := make(map[string]interface{})
+	changed := make(map[string]interface{})
+	diffJSON("", a, b, added, removed, changed)
+
+	return map[string]interface{}{
+		"added":   added,
+		"removed": removed,
+		"changed": changed,
+	}, nil
+}
+
+// diffJSON records the differences between the decoded JSON values a and b found at path
+func diffJSON(path string, a, b interface{}, added, removed, changed map[string]interface{}) {
+	join := func(key string) string {
+		if path == "" {
+			return key
+		}
+		return path + "." + key
+	}
+
+	switch av := a.(type) {
+	case map[string]interface{}:
+		if bv, ok := b.(map[string]interface{}); ok {
+			for k, child := range av {
+				if other, ok := bv[k]; ok {
+					diffJSON(join(k), child, other, added, removed, changed)
+				} else {
+					removed[join(k)] = child
+				}
+			}
+			for k, child := range bv {
+				if _, ok := av[k]; !ok {
+					added[join(k)] = child
+				}
+			}
+			return
+		}
+
+	case []interface{}:
+		if bv, ok := b.([]interface{}); ok {
+			for i := 0; i < len(av) || i < len(bv); i++ {
+				key := fmt.Sprintf("%s[%d]", path, i)
+				switch {
+				case i >= len(bv):
+					removed[key] = av[i]
+				case i >= len(av):
+					added[key] = bv[i]
+				default:
+					diffJSON(key, av[i], bv[i], added, removed, changed)
+				}
+			}
+			return
+		}
+	}
+
+	if !reflect.DeepEqual(a, b) {
+		changed[path] = map[string]interface{}{"from": a, "to": b}
+	}
+}
+
+// DecodeJSONArray reads a JSON array from r one element at a time, calling fn once per element with a
+// decode function that unmarshals the current element into its argument. Only one element is held in memory
+// at a time, so large arrays can be processed as they stream in. An error from fn stops the iteration and is
+// returned, as is any malformed JSON found along the way. An element that fails to decode stops the iteration
+// even if fn ignores the error, as the rest of the array cannot be read reliably after it
+func (t *Tools) DecodeJSONArray(r io.Reader, fn func(decode func(v interface{}) error) error) error {
+	dec := json.NewDecoder(r)
+
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("error reading JSON array : %w", err)
+	}
+	if delim, ok := tok.(json.Delim); !ok || delim != '[' {
+		return errors.New("JSON value is not an array")
+	}
+
+	for i := 0; dec.More(); i++ {
+		decoded := false
+		var decodeErr error
+		decode := func(v interface{}) error {
+			if decoded {
+				return errors.New("array element has already been decoded")
+			}
+			decoded = true
+			if err := dec.Decode(v); err != nil {
+				decodeErr = fmt.Errorf("error decoding array element %d : %w", i, err)
+				return decodeErr
+			}
+			return nil
+		}
+
+		err := fn(decode)
+		// the decoder may not have moved past an element it failed on, so carrying on could loop forever
+		if decodeErr != nil {
+			return decodeErr
+		}
+		if err != nil {
+			return err
+		}
+
+		// skip the element if the callback did not want it
+		if !decoded {
+			if err := decode(&json.RawMessage{}); err != nil {
+				return err
+			}
+		}
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return fmt.Errorf("error reading end of JSON array : %w", err)
+	}
+
+	return nil
+}
+
+// ProcessJSONArray reads a JSON array from r and calls fn for each element on a pool of workers goroutines.
+// Elements are handed to the workers as they are decoded, and decoding waits while every worker is busy, so
+// only a few elements are held in memory at once. The first error from fn stops the decoding, lets the
+// remaining in-flight elements finish without calling fn, and is returned. The array may be no larger than
+// MaxJSONSize (1MB by default)
+func (t *Tools) ProcessJSONArray(r io.Reader, workers int, fn func(raw json.RawMessage) error) error {
+	if workers < 1 {
+		workers = 1
+	}
+
+	maxBytes := 1024 * 1024
+	if t.MaxJSONSize != 0 {
+		maxBytes = t.MaxJSONSize
+	}
+	limited := &io.LimitedReader{R: r, N: int64(maxBytes) + 1}
+
+	jobs := make(chan json.RawMessage)
+	done := make(chan struct{})
+
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			close(done)
+		})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for raw := range jobs {
+				select {
+				case <-done:
+					continue
+				default:
+				}
+				if err := fn(raw); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	err := t.DecodeJSONArray(limited, func(decode func(v interface{}) error) error {
+		var raw json.RawMessage
+		if err := decode(&raw); err != nil {
+			return err
+		}
+
+		select {
+		case jobs <- raw:
+			return nil
+		case <-done:
+			return firstErr
+		}
+	})
+
+	close(jobs)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if limited.N <= 0 {
+		return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+	}
+
+	return err
+}
+
+// TransformJSONKeys returns body with every object key, at any depth and including objects inside arrays,
+// renamed by transform. SnakeToCamel and CamelToSnake can be used as the transform to convert between the
+// naming conventions of different APIs
+func (t *Tools) TransformJSONKeys(body []byte, transform func(key string) string) ([]byte, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(transformKeys(v, transform))
+}
+
+// transformKeys returns v with the keys of all objects within it renamed by transform
+func transformKeys(v interface{}, transform func(key string) string) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(value))
+		for k, child := range value {
+			out[transform(k)] = transformKeys(child, transform)
+		}
+		return out
+
+	case []interface{}:
+		for i, child := range value {
+			value[i] = transformKeys(child, transform)
+		}
+	}
+
+	return v
+}
+
+// SnakeToCamel converts a snake_case name to camelCase (e.g. "user_id" becomes "userId")
+func (t *Tools) SnakeToCamel(key string) string {
+	parts := strings.Split(key, "_")
+
+	var b strings.Builder
+	for _, p := range parts {
+		if p == "" {
+			continue
+		}
+		if b.Len() == 0 {
+			b.WriteString(strings.ToLower(p))
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(p)
+		b.WriteRune(unicode.ToUpper(r))
+		b.WriteString(strings.ToLower(p[size:]))
+	}
+
+	return b.String()
+}
+
+// CamelToSnake converts a camelCase or PascalCase name to snake_case, keeping runs of capitals together
+// (e.g. "userID" becomes "user_id" and "HTTPServer" becomes "http_server")
+func (t *Tools) CamelToSnake(key string) string {
+	runes := []rune(key)
+
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteByte('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+
+	return b.String()
+}
+
+// JSONSize returns the size in bytes of data marshalled to json as WriteJSON would write it, for checking a
+// response against a size budget or recording it. The marshalled json is returned too, so it can be written
+// without marshalling it a second time
+func (t *Tools) JSONSize(data interface{}) (int, []byte, error) {
+	out, err := json.Marshal(data)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return len(out), out, nil
+}
+
+// WriteJSON writes a json response to the client with the specified status code and headers if any
+func (t *Tools) WriteJSON(w http.ResponseWriter, status int, data interface{}, headers ...http.Header) error {
+	out, err := json.Marshal(data)
+
+	if err != nil {
+		return err
+	}
+
+	if len(headers) > 0 {
+		for k, v := range headers[0] {
+			w.Header()[k] = v
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(out)
+
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// WriteJSONWithWarnings writes a JSONResponse with data as its data field and warnings describing any
+// non-fatal problems, such as use of a deprecated field or a partial result, without marking it as an error
+func (t *Tools) WriteJSONWithWarnings(w http.ResponseWriter, status int, data interface{}, warnings []string, headers ...http.Header) error {
+	payload := JSONResponse{
+		Data:     data,
+		Warnings: warnings,
+	}
+
+	return t.WriteJSON(w, status, payload, headers...)
+}
+
+// WriteJSONWithLastModified writes a json response like WriteJSON with a Last-Modified header set to modTime.
+// If the request is a GET or HEAD with an If-Modified-Since header no earlier than modTime, it writes a
+// 304 Not Modified with no body instead
+func (t *Tools) WriteJSONWithLastModified(w http.ResponseWriter, r *http.Request, status int, data interface{}, modTime time.Time, headers ...http.Header) error {
+	// http dates only have second precision
+	modTime = modTime.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", modTime.Format(http.TimeFormat))
+
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !modTime.After(since) {
+			w.WriteHeader(http.StatusNotModified)
+			return nil
+		}
+	}
+
+	return t.WriteJSON(w, status, data, headers...)
+}
+
+// WriteRedirect redirects the client to url with status, which must be a 3xx redirect status. The url may be
+// relative to the request path. An error is returned, and nothing is written, if status is not a redirect
+func (t *Tools) WriteRedirect(w http.ResponseWriter, r *http.Request, url string, status int) error {
+	if status < 300 || status > 399 {
+		return fmt.Errorf("status %d is not a redirect status", status)
+	}
+
+	if url == "" {
+		return errors.New("redirect url is empty")
+	}
+
+	http.Redirect(w, r, url, status)
+
+	return nil
+}
+
+// ErrorJSON writes a json response to the client with the specified status code and headers if any and sets the error field to true and message field to the error message
+// If DebugErrors is set, the stack trace of the caller is included in the trace field
+func (t *Tools) ErrorJSON(w http.ResponseWriter, err error, status ...int) error {
+
+	statusCode := http.StatusBadRequest
+
+	if len(status) > 0 {
+		statusCode = status[0]
+	}
+
+	var payload JSONResponse
+	payload.Error = true
+	payload.Message = err.Error()
+
+	// only include the stack trace in development, as it exposes internals
+	if t.DebugErrors {
+		payload.Trace = string(debug.Stack())
+	}
+
+	return t.WriteJSON(w, statusCode, payload)
+}
+
+// ErrorHTML writes a minimal html error page with status and its standard status text, for routes that serve
+// html rather than json. The error itself is only shown when DebugErrors is set, and everything written to
+// the page is html escaped
+func (t *Tools) ErrorHTML(w http.ResponseWriter, err error, status int) error {
+	title := html.EscapeString(fmt.Sprintf("%d %s", status, http.StatusText(status)))
+
+	var detail string
+	if t.DebugErrors && err != nil {
+		detail = fmt.Sprintf("<pre>%s</pre>\n", html.EscapeString(err.Error()))
+	}
+
+	page := fmt.Sprintf("<!DOCTYPE html>\n<html>\n<head>\n<meta charset=\"utf-8\">\n<title>%s</title>\n</head>\n"+
+		"<body>\n<h1>%s</h1>\n<p>Sorry, something went wrong with your request.</p>\n%s</body>\n</html>\n", title, title, detail)
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_, err = io.WriteString(w, page)
+
+	return err
+}
+
+// Chunk splits items into consecutive chunks of at most size elements, e.g. for sending records to a remote
+// service in batches. The chunks share the backing array of items. If size is zero or negative, all of items
+// is returned as a single chunk, and an empty slice returns no chunks
+func Chunk[T any](items []T, size int) [][]T {
+	if len(items) == 0 {
+		return nil
+	}
+
+	if size <= 0 {
+		return [][]T{items}
+	}
+
+	chunks := make([][]T, 0, (len(items)+size-1)/size)
+	for size < len(items) {
+		items, chunks = items[size:], append(chunks, items[:size:size])
+	}
+
+	return append(chunks, items)
+}
+
+// Unique returns the distinct elements of items in the order they first appear. items is not modified, and
+// an empty slice returns nil
+func Unique[T comparable](items []T) []T {
+	if len(items) == 0 {
+		return nil
+	}
+
+	seen := make(map[T]struct{}, len(items))
+	unique := make([]T, 0, len(items))
+	for _, item := range items {
+		if _, ok := seen[item]; ok {
+			continue
+		}
+		seen[item] = struct{}{}
+		unique = append(unique, item)
+	}
+
+	return unique
+}
+
+// PushJSONToRemote pushes a json payload to a remote uri and returns the response and status code and error if any
+func (t *Tools) PushJSONToRemote(uri string, data interface{}, client ...*http.Client) (*http.Response, int, error) {
+	return t.PushJSONToRemoteContext(context.Background(), uri, data, client...)
+}
+
+// PushJSONToRemoteContext is PushJSONToRemote with a context, which cancels the request and any wait
+// between retries
+func (t *Tools) PushJSONToRemoteContext(ctx context.Context, uri string, data interface{}, client ...*http.Client) (*http.Response, int, error) {
+	response, status, err := t.observePush(ctx, uri, data, client...)
+	if err != nil {
+		return nil, status, err
+	}
+	response.Body.Close()
+
+	return response, status, nil
+}
+
+// PushResult is the outcome of pushing to one url with PushJSONToMany
+type PushResult struct {
+	URL        string
+	StatusCode int
+	Err        error
+}
+
+// PushJSONToMany pushes the same json payload to every url with PushJSONToRemote, running at most
+// concurrency pushes at once (1 if concurrency is less than 1). It returns one PushResult per url, in the
+// same order as urls
+func (t *Tools) PushJSONToMany(urls []string, data interface{}, concurrency int, client ...*http.Client) []PushResult {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	results := make([]PushResult, len(urls))
+	jobs := make(chan int)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency && i < len(urls); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range jobs {
+				_, status, err := t.PushJSONToRemote(urls[j], data, client...)
+				results[j] = PushResult{URL: urls[j], StatusCode: status, Err: err}
+			}
+		}()
+	}
+
+	for i := range urls {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
+	return results
+}
+
+// PushJSONToRemoteInto pushes a json payload to a remote uri and decodes the json response into into,
+// returning the status code and error if any. Compressed responses are handled by ReadJSONResponse
+func (t *Tools) PushJSONToRemoteInto(uri string, data interface{}, into interface{}, client ...*http.Client) (int, error) {
+	response, status, err := t.observePush(context.Background(), uri, data, client...)
+	if err != nil {
+		return status, err
+	}
+	defer response.Body.Close()
+
+	if err := t.ReadJSONResponse(response, into); err != nil {
+		return status, err
+	}
+
+	return status, nil
+}
+
+// observePush calls pushJSONToRemote, recording the push with Metrics when set. The response body is left open
+func (t *Tools) observePush(ctx context.Context, uri string, data interface{}, client ...*http.Client) (*http.Response, int, error) {
+	if t.Metrics == nil {
+		return t.pushJSONToRemote(ctx, uri, data, client...)
+	}
+
+	start := time.Now()
+	response, status, err := t.pushJSONToRemote(ctx, uri, data, client...)
+	t.Metrics.ObservePush(status, time.Since(start), err)
+
+	return response, status, err
+}
+
+// ReadJSONResponse decodes the json body of a response into data. A gzip or deflate Content-Encoding is
+// decompressed first, and the decompressed body may be no larger than MaxJSONSize (1MB by default).
+// Any other encoding is an error. The caller is responsible for closing the response body
+func (t *Tools) ReadJSONResponse(response *http.Response, data interface{}) error {
+	maxBytes := 1024 * 1024
+	if t.MaxJSONSize != 0 {
+		maxBytes = t.MaxJSONSize
+	}
+
+	var body io.Reader = response.Body
+	encoding := strings.ToLower(strings.TrimSpace(response.Header.Get("Content-Encoding")))
+	switch encoding {
+	case "", "identity":
+	case "gzip", "x-gzip":
+		gz, err := gzip.NewReader(response.Body)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		body = gz
+	case "deflate":
+		// deflate should be zlib wrapped, but some servers send a raw deflate stream
+		br := bufio.NewReader(response.Body)
+		head, _ := br.Peek(2)
+		if len(head) == 2 && head[0]&0x0f == 8 && (uint16(head[0])<<8|uint16(head[1]))%31 == 0 {
+			zr, err := zlib.NewReader(br)
+			if err != nil {
+				return err
+			}
+			defer zr.Close()
+			body = zr
+		} else {
+			fr := flate.NewReader(br)
+			defer fr.Close()
+			body = fr
+		}
+	default:
+		return fmt.Errorf("unsupported content encoding %q", encoding)
+	}
+
+	var content bytes.Buffer
+	if _, err := t.CopyN(&content, body, int64(maxBytes)); err != nil {
+		if errors.Is(err, ErrLimitExceeded) {
+			return fmt.Errorf("decompressed response body must not be larger than %d bytes", maxBytes)
+		}
+		return err
+	}
+
+	return json.Unmarshal(content.Bytes(), data)
+}
+
+// pushJSONToRemote does the work of PushJSONToRemote. Retries wait for the server's Retry-After, or back off
+// exponentially from one second, but never longer than MaxRetryWait (30 seconds by default)
+func (t *Tools) pushJSONToRemote(ctx context.Context, uri string, data interface{}, client ...*http.Client) (*http.Response, int, error) {
+
+	// create json
+	jsonData, err := json.Marshal(data)
+	if err != nil {
 		return nil, 0, err
 	}
-	request.Header.Set("Content-Type", "application/json")
 
-	// call the remote uri
-	response, err := httpClient.Do(request)
+	if t.SafeOutboundOnly {
+		if _, err := t.IsSafeOutboundURL(uri); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	// check fot custom http client
+	httpClient := &http.Client{}
+	if len(client) > 0 {
+		httpClient = client[0]
+	}
+	if t.SafeOutboundOnly {
+		httpClient = t.safeOutboundClient(httpClient)
+	}
+
+	var response *http.Response
+	for attempt := 0; ; attempt++ {
+		// build request and set headers
+		request, err := http.NewRequestWithContext(ctx, "POST", uri, bytes.NewBuffer(jsonData))
+		if err != nil {
+			return nil, 0, err
+		}
+		request.Header.Set("Content-Type", "application/json")
+
+		// call the remote uri
+		response, err = httpClient.Do(request)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		retryable := response.StatusCode == http.StatusTooManyRequests || response.StatusCode == http.StatusServiceUnavailable
+		if !retryable || attempt >= t.MaxPushRetries {
+			break
+		}
+
+		maxWait := 30 * time.Second
+		if t.MaxRetryWait > 0 {
+			maxWait = t.MaxRetryWait
+		}
+
+		// back off exponentially unless the server tells us how long to wait
+		wait, ok := t.ParseRetryAfter(response.Header)
+		if !ok {
+			shift := attempt
+			if shift > 16 {
+				shift = 16
+			}
+			wait = time.Second << shift
+		}
+		if wait > maxWait {
+			wait = maxWait
+		}
+		response.Body.Close()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-request.Context().Done():
+			timer.Stop()
+			return nil, 0, request.Context().Err()
+		case <-timer.C:
+		}
+	}
+
+	// return response
+	return response, response.StatusCode, nil
+}
+
+// BuildMultipartRequest builds a multipart/form-data POST request to uri for uploading files to a remote
+// service. Each entry in fields becomes a form field, and each entry in files becomes a file part whose
+// field name and filename are the map key and whose content type is detected from its content
+func (t *Tools) BuildMultipartRequest(uri string, fields map[string]string, files map[string]io.Reader) (*http.Request, error) {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+
+	// write the parts in a stable order
+	fieldNames := make([]string, 0, len(fields))
+	for name := range fields {
+		fieldNames = append(fieldNames, name)
+	}
+	sort.Strings(fieldNames)
+
+	for _, name := range fieldNames {
+		if err := writer.WriteField(name, fields[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	fileNames := make([]string, 0, len(files))
+	for name := range files {
+		fileNames = append(fileNames, name)
+	}
+	sort.Strings(fileNames)
+
+	for _, name := range fileNames {
+		head := make([]byte, 512)
+		n, err := io.ReadFull(files[name], head)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		head = head[:n]
+
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`, escapeQuotes(name), escapeQuotes(filepath.Base(name))))
+		h.Set("Content-Type", http.DetectContentType(head))
+
+		part, err := writer.CreatePart(h)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := part.Write(head); err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(part, files[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+
+	request, err := http.NewRequest("POST", uri, body)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return request, nil
+}
+
+// escapeQuotes escapes backslashes and double quotes for use in a quoted header parameter
+func escapeQuotes(s string) string {
+	return strings.NewReplacer("\\", "\\\\", `"`, "\\\"").Replace(s)
+}
+
+// defaultTrackingParams are the query parameters CanonicalURL strips when no list is given
+var defaultTrackingParams = []string{
+	"utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content", "fbclid", "gclid", "msclkid",
+}
+
+// CanonicalURL returns the canonical form of the request URL, for canonical link tags and deduplication.
+// The scheme is https if the request came over TLS and http otherwise, the host is lowercased and loses
+// a default port, and the query parameters are sorted with those named in stripParams removed. If
+// stripParams is nil common tracking parameters such as utm_source and fbclid are removed
+func (t *Tools) CanonicalURL(r *http.Request, stripParams []string) string {
+	if stripParams == nil {
+		stripParams = defaultTrackingParams
+	}
+
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	host := strings.ToLower(r.Host)
+	if host == "" {
+		host = strings.ToLower(r.URL.Host)
+	}
+	if (scheme == "http" && strings.HasSuffix(host, ":80")) || (scheme == "https" && strings.HasSuffix(host, ":443")) {
+		host = host[:strings.LastIndex(host, ":")]
+	}
+
+	query := r.URL.Query()
+	for name := range query {
+		for _, strip := range stripParams {
+			if strings.EqualFold(name, strip) {
+				query.Del(name)
+			}
+		}
+	}
+
+	u := url.URL{
+		Scheme:   scheme,
+		Host:     host,
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: query.Encode(),
+	}
+	if u.Path == "" {
+		u.Path = "/"
+	}
+
+	return u.String()
+}
+
+// IsSafeRedirect reports whether target, taken from a client, is safe to redirect to, guarding against open
+// redirects. A relative path starting with a single "/" is always safe. An absolute URL must be http or
+// https and its host must be one of allowedHosts, where an entry such as "*.example.com" allows any
+// subdomain. Protocol relative URLs ("//evil.com"), backslashes, control characters and other schemes such
+// as javascript: are rejected
+func (t *Tools) IsSafeRedirect(target string, allowedHosts []string) bool {
+	if target == "" || strings.ContainsRune(target, '\\') {
+		return false
+	}
+	for _, r := range target {
+		if unicode.IsControl(r) || unicode.IsSpace(r) {
+			return false
+		}
+	}
+
+	if strings.HasPrefix(target, "/") {
+		return !strings.HasPrefix(target, "//")
+	}
+
+	u, err := url.Parse(target)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User != nil {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	if host == "" {
+		return false
+	}
+
+	for _, allowed := range allowedHosts {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsSafeOutboundURL reports whether uri is safe to send a request to on behalf of a user, guarding against
+// server side request forgery. The scheme must be http or https, and every address the host resolves to
+// must be a public unicast address, so loopback, link-local, private, carrier-grade NAT and unspecified
+// addresses are rejected. When it is not safe, the error explains why
+func (t *Tools) IsSafeOutboundURL(uri string) (bool, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return false, err
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return false, fmt.Errorf("scheme %q is not allowed for outbound requests", u.Scheme)
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return false, errors.New("outbound url has no host")
+	}
+
+	ips, err := net.LookupIP(host)
 	if err != nil {
-		return nil, 0, err
+		return false, err
 	}
 
-	defer response.Body.Close()
+	for _, ip := range ips {
+		if isDisallowedIP(ip) {
+			return false, fmt.Errorf("host %s resolves to disallowed address %s", host, ip)
+		}
+	}
 
-	// return response
-	return response, response.StatusCode, nil
+	return true, nil
+}
+
+// disallowedNetworks are ranges that are not public but are not classed as private by net.IP: "this
+// network" (RFC 791), carrier grade NAT's shared address space (RFC 6598), benchmarking (RFC 2544) and the
+// reserved class E block (RFC 1112), which includes the broadcast address
+var disallowedNetworks = []*net.IPNet{
+	{IP: net.IPv4(0, 0, 0, 0), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)},
+	{IP: net.IPv4(198, 18, 0, 0), Mask: net.CIDRMask(15, 32)},
+	{IP: net.IPv4(240, 0, 0, 0), Mask: net.CIDRMask(4, 32)},
+}
+
+// nat64Prefix is the well known NAT64 prefix of RFC 6052, whose addresses embed an IPv4 address in their
+// last four bytes
+var nat64Prefix = &net.IPNet{IP: net.ParseIP("64:ff9b::"), Mask: net.CIDRMask(96, 128)}
+
+// isDisallowedIP reports whether ip is an address outbound requests must not be sent to
+func isDisallowedIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() ||
+		ip.IsUnspecified() || ip.IsMulticast() {
+		return true
+	}
+
+	for _, n := range disallowedNetworks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	// a NAT64 gateway would translate the address to the IPv4 one it embeds, so that is what is checked
+	if ip.To4() == nil && nat64Prefix.Contains(ip) {
+		return isDisallowedIP(net.IP(ip[12:16]))
+	}
+
+	return false
+}
+
+// safeDialControl is a net.Dialer Control function that refuses to connect to a disallowed address. It
+// sees the address actually being dialled, after DNS resolution, so a host that resolves to a public
+// address when it is checked and a private one when it is connected to is still refused
+func safeDialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || isDisallowedIP(ip) {
+		return fmt.Errorf("connecting to disallowed address %s", host)
+	}
+
+	return nil
+}
+
+// safeOutboundClient returns a copy of client for SafeOutboundOnly, which checks every redirect with
+// IsSafeOutboundURL and, when its transport is an *http.Transport (or the default), refuses to dial a
+// disallowed address. A client with some other transport is responsible for its own connections
+func (t *Tools) safeOutboundClient(client *http.Client) *http.Client {
+	safe := *client
+
+	dialer := &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		Control:   safeDialControl,
+	}
+
+	var transport *http.Transport
+	switch tr := client.Transport.(type) {
+	case nil:
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		transport = tr.Clone()
+	}
+	if transport != nil {
+		transport.DialContext = dialer.DialContext
+		safe.Transport = transport
+	}
+
+	checkRedirect := client.CheckRedirect
+	safe.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if _, err := t.IsSafeOutboundURL(req.URL.String()); err != nil {
+			return err
+		}
+		if checkRedirect != nil {
+			return checkRedirect(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+
+	return &safe
+}
+
+// ParseRetryAfter parses the Retry-After header, which may be either a number of seconds or an
+// HTTP date, and returns how long to wait. The boolean is false if the header is missing or invalid
+func (t *Tools) ParseRetryAfter(h http.Header) (time.Duration, bool) {
+	value := strings.TrimSpace(h.Get("Retry-After"))
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+
+	wait := time.Until(date)
+	if wait < 0 {
+		wait = 0
+	}
+
+	return wait, true
+}
+
+// HealthCheckHandler returns a handler that runs each of the named checks concurrently and writes a
+// JSONResponse with the status of every check as its data. It responds with 200 when all checks pass and
+// 503 when any fails. A check that takes longer than HealthCheckTimeout (5 seconds by default) is
+// reported as failed
+func (t *Tools) HealthCheckHandler(checks map[string]func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		timeout := 5 * time.Second
+		if t.HealthCheckTimeout > 0 {
+			timeout = t.HealthCheckTimeout
+		}
+
+		type result struct {
+			name string
+			err  error
+		}
+
+		// buffered so that checks which time out can still finish without blocking
+		results := make(chan result, len(checks))
+		for name, check := range checks {
+			go func(name string, check func() error) {
+				results <- result{name: name, err: check()}
+			}(name, check)
+		}
+
+		status := make(map[string]string, len(checks))
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+
+	collect:
+		for range checks {
+			select {
+			case res := <-results:
+				status[res.name] = "ok"
+				if res.err != nil {
+					status[res.name] = res.err.Error()
+				}
+			case <-timer.C:
+				break collect
+			}
+		}
+
+		healthy := true
+		for name := range checks {
+			if _, ok := status[name]; !ok {
+				status[name] = "timed out"
+			}
+			if status[name] != "ok" {
+				healthy = false
+			}
+		}
+
+		payload := JSONResponse{
+			Error:   !healthy,
+			Message: "ok",
+			Data:    status,
+		}
+
+		if !healthy {
+			payload.Message = "one or more checks failed"
+			_ = t.WriteJSON(w, http.StatusServiceUnavailable, payload)
+			return
+		}
+
+		_ = t.WriteJSON(w, http.StatusOK, payload)
+	}
+}
+
+// UploadQuota returns middleware that limits each client to uploading maxBytes of request body within a
+// sliding window. Clients are identified by UploadQuotaKeyFn, such as a function returning the client IP
+// from a trusted proxy's forwarding headers or an authenticated user id, and by the connection's remote
+// address when it is nil or returns an empty key. A client that has used
+// its quota, or whose request declares a Content-Length larger than what remains, receives a 429 JSON error.
+// Each request reserves its Content-Length, or the whole of the remaining quota when the length is unknown,
+// before it is handled and its body is limited to that, so neither a body without a Content-Length nor
+// concurrent requests can go over the quota. Clients that have not uploaded within the window are forgotten
+func (t *Tools) UploadQuota(maxBytes int64, window time.Duration) func(http.Handler) http.Handler {
+	type usage struct {
+		at    time.Time
+		bytes int64
+	}
+
+	var mu sync.Mutex
+	clients := make(map[string][]*usage)
+	lastSweep := time.Now()
+
+	// used returns the bytes uploaded by key within the window, dropping older entries; mu must be held
+	used := func(key string, now time.Time) int64 {
+		var total int64
+		recent := clients[key][:0]
+		for _, u := range clients[key] {
+			if now.Sub(u.at) < window {
+				recent = append(recent, u)
+				total += u.bytes
+			}
+		}
+
+		if len(recent) == 0 {
+			delete(clients, key)
+		} else {
+			clients[key] = recent
+		}
+
+		return total
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := ""
+			if t.UploadQuotaKeyFn != nil {
+				key = t.UploadQuotaKeyFn(r)
+			}
+			if key == "" {
+				key = clientIP(r)
+			}
+			now := time.Now()
+
+			mu.Lock()
+			// forget clients that have not come back within the window
+			if now.Sub(lastSweep) >= window {
+				for other := range clients {
+					used(other, now)
+				}
+				lastSweep = now
+			}
+
+			remaining := maxBytes - used(key, now)
+			if remaining <= 0 || r.ContentLength > remaining {
+				mu.Unlock()
+				_ = t.ErrorJSON(w, errors.New("upload quota exceeded"), http.StatusTooManyRequests)
+				return
+			}
+
+			reserved := &usage{at: now, bytes: remaining}
+			if r.ContentLength >= 0 {
+				reserved.bytes = r.ContentLength
+			}
+			clients[key] = append(clients[key], reserved)
+			mu.Unlock()
+
+			body := &countingReader{ReadCloser: http.MaxBytesReader(w, r.Body, reserved.bytes)}
+			r.Body = body
+
+			next.ServeHTTP(w, r)
+
+			// give back whatever was reserved but not read
+			mu.Lock()
+			reserved.bytes = body.n
+			mu.Unlock()
+		})
+	}
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// clientIP returns the IP address of the client that made the request, without the port
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return host
+}
+
+// contextKey is the type of the keys the toolkit stores values in a request context under
+type contextKey string
+
+const requestIDKey contextKey = "requestID"
+
+// requestIDPattern matches the incoming request ids RequestID accepts, which keeps anything that could
+// forge a log line or header out of them
+var requestIDPattern = regexp.MustCompile(`^[A-Za-z0-9._:+/=-]{1,128}$`)
+
+// RequestID is middleware that makes sure every request has an id for correlating logs and downstream
+// calls. An X-Request-ID header from the client is used if it is reasonable, otherwise a random id is
+// generated. The id is stored in the request context, where RequestIDFromContext finds it, and is sent back
+// in the X-Request-ID response header
+func (t *Tools) RequestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !requestIDPattern.MatchString(id) {
+			id = t.RandomString(24)
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDKey, id)))
+	})
+}
+
+// RequestIDFromContext returns the request id stored by RequestID, or an empty string if there is none
+func (t *Tools) RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// GenerateCSRFToken returns a new random token for CSRFMiddleware
+func (t *Tools) GenerateCSRFToken() string {
+	return t.RandomString(32)
+}
+
+// CSRFMiddleware protects next against cross-site request forgery with the double submit cookie pattern.
+// A request without a csrf_token cookie is given one with a new token, which is also added to the request so
+// the handler can read it with r.Cookie to embed in a form. GET, HEAD, OPTIONS and TRACE requests are let
+// through; any other request must send the cookie's token back in an X-CSRF-Token header, or a csrf_token
+// field of a url encoded form, or it receives a 403 JSON error. Multipart requests must use the header, so
+// that the upload is left for the handler to parse within its own limits. The cookie is not HttpOnly so
+// that scripts can read it
+func (t *Tools) CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var token string
+		if cookie, err := r.Cookie("csrf_token"); err == nil && cookie.Value != "" {
+			token = cookie.Value
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			if token == "" {
+				token = t.GenerateCSRFToken()
+				cookie := &http.Cookie{
+					Name:     "csrf_token",
+					Value:    token,
+					Path:     "/",
+					Secure:   r.TLS != nil,
+					SameSite: http.SameSiteLaxMode,
+				}
+				http.SetCookie(w, cookie)
+				r.AddCookie(cookie)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		submitted := r.Header.Get("X-CSRF-Token")
+		if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); submitted == "" && mediaType == "application/x-www-form-urlencoded" {
+			if err := r.ParseForm(); err == nil {
+				submitted = r.PostForm.Get("csrf_token")
+			}
+		}
+
+		if token == "" || !hmac.Equal([]byte(submitted), []byte(token)) {
+			_ = t.ErrorJSON(w, errors.New("invalid or missing CSRF token"), http.StatusForbidden)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RequireTLSVersion returns middleware that rejects requests made over a TLS version older than min, such
+// as tls.VersionTLS12, with a 426 JSON error. Requests that did not use TLS at all are rejected the same way
+// unless AllowNonTLSRequests is set, e.g. when TLS is terminated by a proxy in front of the server
+func (t *Tools) RequireTLSVersion(min uint16) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.TLS == nil {
+				if t.AllowNonTLSRequests {
+					next.ServeHTTP(w, r)
+					return
+				}
+				w.Header().Set("Upgrade", fmt.Sprintf("TLS/%s, HTTP/1.1", tlsVersionName(min)))
+				w.Header().Set("Connection", "Upgrade")
+				_ = t.ErrorJSON(w, errors.New("this resource must be requested over TLS"), http.StatusUpgradeRequired)
+				return
+			}
+
+			if r.TLS.Version < min {
+				_ = t.ErrorJSON(w, fmt.Errorf("TLS %s is not supported, TLS %s or later is required",
+					tlsVersionName(r.TLS.Version), tlsVersionName(min)), http.StatusUpgradeRequired)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// tlsVersionName returns the number of a TLS version, e.g. "1.2"
+func tlsVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "1.0"
+	case tls.VersionTLS11:
+		return "1.1"
+	case tls.VersionTLS12:
+		return "1.2"
+	case tls.VersionTLS13:
+		return "1.3"
+	}
+
+	return fmt.Sprintf("0x%04X", version)
+}
+
+// AllowMethods returns middleware that only lets requests using one of methods through to the handler.
+// Other requests receive a 405 JSON error with an Allow header listing the permitted methods, except
+// OPTIONS requests, which are answered with a 204 and the Allow header unless OPTIONS is itself permitted
+func (t *Tools) AllowMethods(methods ...string) func(http.Handler) http.Handler {
+	allow := strings.Join(methods, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, m := range methods {
+				if strings.EqualFold(r.Method, m) {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+
+			w.Header().Set("Allow", allow)
+
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+
+			_ = t.ErrorJSON(w, fmt.Errorf("method %s is not allowed", r.Method), http.StatusMethodNotAllowed)
+		})
+	}
+}
+
+// TimeoutHandler returns a handler that runs next with a request context that is cancelled after d. If next
+// has not finished by then, the client receives a 503 JSON error and anything next writes afterwards is
+// discarded, with its writes returning http.ErrHandlerTimeout. Like http.TimeoutHandler, the response of next
+// is buffered until it finishes so that only one response is ever written
+func (t *Tools) TimeoutHandler(next http.Handler, d time.Duration) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), d)
+		defer cancel()
+
+		tw := &timeoutWriter{header: make(http.Header), ctx: ctx}
+		done := make(chan struct{})
+		panicked := make(chan interface{}, 1)
+
+		go func() {
+			defer func() {
+				if p := recover(); p != nil {
+					panicked <- p
+				}
+			}()
+			next.ServeHTTP(tw, r.WithContext(ctx))
+			close(done)
+		}()
+
+		select {
+		case p := <-panicked:
+			panic(p)
+
+		case <-done:
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			// next may only have finished because the deadline passed, in which case its writes failed
+			if tw.expired() {
+				tw.timedOut = true
+				_ = t.ErrorJSON(w, errors.New("the request timed out"), http.StatusServiceUnavailable)
+				return
+			}
+
+			for k, v := range tw.header {
+				w.Header()[k] = v
+			}
+			if tw.status == 0 {
+				tw.status = http.StatusOK
+			}
+			w.WriteHeader(tw.status)
+			_, _ = w.Write(tw.body.Bytes())
+
+		case <-ctx.Done():
+			tw.mu.Lock()
+			defer tw.mu.Unlock()
+
+			tw.timedOut = true
+			_ = t.ErrorJSON(w, errors.New("the request timed out"), http.StatusServiceUnavailable)
+		}
+	})
+}
+
+// timeoutWriter buffers the response of a handler run by TimeoutHandler
+type timeoutWriter struct {
+	mu       sync.Mutex
+	ctx      context.Context
+	header   http.Header
+	body     bytes.Buffer
+	status   int
+	timedOut bool
+}
+
+// expired reports whether the deadline has passed, which next can see before TimeoutHandler does; mu must be held
+func (tw *timeoutWriter) expired() bool {
+	return tw.timedOut || errors.Is(tw.ctx.Err(), context.DeadlineExceeded)
+}
+
+func (tw *timeoutWriter) Header() http.Header {
+	return tw.header
+}
+
+func (tw *timeoutWriter) Write(p []byte) (int, error) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.expired() {
+		return 0, http.ErrHandlerTimeout
+	}
+	if tw.status == 0 {
+		tw.status = http.StatusOK
+	}
+
+	return tw.body.Write(p)
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	tw.mu.Lock()
+	defer tw.mu.Unlock()
+
+	if tw.expired() || tw.status != 0 {
+		return
+	}
+	tw.status = status
+}
+
+// ResponseRecorder wraps an http.ResponseWriter, passing everything through while recording the status code
+// and number of body bytes written, for use by logging and metrics middleware
+type ResponseRecorder struct {
+	http.ResponseWriter
+	StatusCode   int
+	BytesWritten int64
+}
+
+// NewResponseRecorder returns a ResponseRecorder for w. StatusCode is 200 until the handler writes a header
+func (t *Tools) NewResponseRecorder(w http.ResponseWriter) *ResponseRecorder {
+	return &ResponseRecorder{ResponseWriter: w, StatusCode: http.StatusOK}
+}
+
+// WriteHeader records status and passes it on
+func (rec *ResponseRecorder) WriteHeader(status int) {
+	rec.StatusCode = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+// Write passes p on and records the number of bytes written
+func (rec *ResponseRecorder) Write(p []byte) (int, error) {
+	n, err := rec.ResponseWriter.Write(p)
+	rec.BytesWritten += int64(n)
+
+	return n, err
+}
+
+// Flush flushes the underlying ResponseWriter if it supports http.Flusher
+func (rec *ResponseRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the underlying ResponseWriter, so that http.ResponseController can reach it
+func (rec *ResponseRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// BufferedResponseWriter collects a response so that it can be built in full before any of it is sent, for
+// large bodies such as reports. Up to a threshold the body is kept in memory, and beyond it the body is
+// written to a temporary file instead. Close sends the response and Discard drops it; either one removes the
+// temporary file, so one of them must always be called
+type BufferedResponseWriter struct {
+	w         http.ResponseWriter
+	threshold int
+	buf       bytes.Buffer
+	file      *os.File
+	size      int64
+	status    int
+	done      bool
+}
+
+// NewBufferedResponseWriter returns a BufferedResponseWriter for w that spills to a temporary file once the
+// body is larger than threshold bytes (1MB if threshold is zero or negative)
+func (t *Tools) NewBufferedResponseWriter(w http.ResponseWriter, threshold int) *BufferedResponseWriter {
+	if threshold <= 0 {
+		threshold = 1024 * 1024
+	}
+
+	return &BufferedResponseWriter{w: w, threshold: threshold}
+}
+
+// Header returns the header map of the underlying ResponseWriter
+func (b *BufferedResponseWriter) Header() http.Header {
+	return b.w.Header()
+}
+
+// WriteHeader records the status to send when the response is closed
+func (b *BufferedResponseWriter) WriteHeader(status int) {
+	if b.status == 0 {
+		b.status = status
+	}
+}
+
+// Write adds p to the body, moving the body to a temporary file once it grows beyond the threshold
+func (b *BufferedResponseWriter) Write(p []byte) (int, error) {
+	if b.done {
+		return 0, errors.New("response has already been closed")
+	}
+
+	if b.file == nil && b.buf.Len()+len(p) > b.threshold {
+		f, err := os.CreateTemp("", "response-*")
+		if err != nil {
+			return 0, err
+		}
+		b.file = f
+
+		if _, err := b.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+
+	var n int
+	var err error
+	if b.file != nil {
+		n, err = b.file.Write(p)
+	} else {
+		n, err = b.buf.Write(p)
+	}
+	b.size += int64(n)
+
+	return n, err
+}
+
+// Close sends the status, a Content-Length header and the body to the underlying ResponseWriter and
+// removes the temporary file, if there is one. Calling Close or Discard again does nothing
+func (b *BufferedResponseWriter) Close() error {
+	if b.done {
+		return nil
+	}
+	defer b.Discard()
+
+	status := b.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	b.w.Header().Set("Content-Length", strconv.FormatInt(b.size, 10))
+	b.w.WriteHeader(status)
+
+	if b.file == nil {
+		_, err := b.buf.WriteTo(b.w)
+		return err
+	}
+
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := io.Copy(b.w, b.file)
+
+	return err
+}
+
+// Discard drops the response without sending it and removes the temporary file, if there is one, e.g.
+// when building the response failed and an error should be sent instead
+func (b *BufferedResponseWriter) Discard() error {
+	if b.done {
+		return nil
+	}
+	b.done = true
+	b.buf.Reset()
+
+	if b.file == nil {
+		return nil
+	}
+
+	b.file.Close()
+
+	return os.Remove(b.file.Name())
+}
+
+// ServeGraceful starts srv and blocks until it receives SIGINT or SIGTERM, then shuts the server down,
+// giving in-flight requests up to timeout to complete. If the server fails to start, the error is
+// returned immediately
+func (t *Tools) ServeGraceful(srv *http.Server, timeout time.Duration) error {
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(quit)
+
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- srv.ListenAndServe()
+	}()
+
+	select {
+	case err := <-serveErr:
+		if errors.Is(err, http.ErrServerClosed) {
+			return nil
+		}
+		return err
+
+	case <-quit:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	return srv.Shutdown(ctx)
 }
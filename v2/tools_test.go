@@ -1,20 +1,39 @@
 package toolkit
 
 import (
+	"archive/tar"
+	"archive/zip"
 	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"image"
+	"image/color"
+	"image/gif"
 	"image/png"
 	"io"
 	"io/ioutil"
 	"mime/multipart"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
 	"testing"
+	"time"
 )
 
 type RoundTripFunc func(req *http.Request) *http.Response
@@ -175,6 +194,14 @@ func TestTools_UploadOneFile(t *testing.T) {
 		t.Errorf("expected file to exist: %s", err.Error())
 	}
 
+	if uploadedFile.FileType != "image/png" {
+		t.Errorf("wrong file type : expected image/png got %s", uploadedFile.FileType)
+	}
+
+	if uploadedFile.Duration <= 0 {
+		t.Error("expected upload duration to be recorded")
+	}
+
 	_ = os.Remove(fmt.Sprintf("./testdata/uploads/%s", uploadedFile.NewFileName))
 
 }
@@ -349,3 +376,5055 @@ func TestTools_Error(t *testing.T) {
 	}
 
 }
+
+var strictCaseTests = []struct {
+	name          string
+	json          string
+	strict        bool
+	errorExpected bool
+}{
+	{name: "exact case", json: `{"foo":"bar","inner":{"baz":"qux"}}`, strict: true, errorExpected: false},
+	{name: "wrong case not strict", json: `{"Foo":"bar"}`, strict: false, errorExpected: false},
+	{name: "wrong case strict", json: `{"Foo":"bar"}`, strict: true, errorExpected: true},
+	{name: "wrong nested case strict", json: `{"foo":"bar","inner":{"BAZ":"qux"}}`, strict: true, errorExpected: true},
+	{name: "wrong case in slice strict", json: `{"items":[{"baz":"a"},{"Baz":"b"}]}`, strict: true, errorExpected: true},
+}
+
+func TestTools_ReadJSONFileStrictFieldCase(t *testing.T) {
+	for _, e := range strictCaseTests {
+		var testTool Tools
+		testTool.StrictFieldCase = e.strict
+
+		var decodedJSON struct {
+			Foo   string `json:"foo"`
+			Inner struct {
+				Baz string `json:"baz"`
+			} `json:"inner"`
+			Items []struct {
+				Baz string `json:"baz"`
+			} `json:"items"`
+		}
+
+		req, err := http.NewRequest("POST", "/", bytes.NewReader([]byte(e.json)))
+		if err != nil {
+			t.Log("Error : ", err)
+		}
+
+		rr := httptest.NewRecorder()
+
+		err = testTool.ReadJSONFile(rr, req, &decodedJSON)
+
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error received but not expected : %s", e.name, err.Error())
+		}
+	}
+}
+
+func TestTools_HashStruct(t *testing.T) {
+	var testTools Tools
+
+	type a struct {
+		Name string         `json:"name"`
+		Tags map[string]int `json:"tags"`
+	}
+	type b struct {
+		Tags map[string]int `json:"tags"`
+		Name string         `json:"name"`
+	}
+
+	first, err := testTools.HashStruct(a{Name: "foo", Tags: map[string]int{"x": 1, "y": 2, "z": 3}})
+	if err != nil {
+		t.Error(err)
+	}
+
+	second, err := testTools.HashStruct(b{Name: "foo", Tags: map[string]int{"z": 3, "y": 2, "x": 1}})
+	if err != nil {
+		t.Error(err)
+	}
+
+	if first != second {
+		t.Errorf("expected equal hashes : got %s and %s", first, second)
+	}
+
+	if len(first) != 64 {
+		t.Errorf("wrong hash length : expected 64 got %d", len(first))
+	}
+
+	third, _ := testTools.HashStruct(a{Name: "bar"})
+	if first == third {
+		t.Error("expected different values to produce different hashes")
+	}
+
+	_, err = testTools.HashStruct(make(chan int))
+	if err == nil {
+		t.Error("expected error hashing a value that cannot be encoded")
+	}
+}
+
+var truncateTests = []struct {
+	name     string
+	s        string
+	max      int
+	ellipsis bool
+	expected string
+}{
+	{name: "shorter than limit", s: "hello", max: 10, ellipsis: true, expected: "hello"},
+	{name: "equal to limit", s: "hello", max: 5, ellipsis: true, expected: "hello"},
+	{name: "ascii no ellipsis", s: "hello world", max: 5, ellipsis: false, expected: "hello"},
+	{name: "ascii with ellipsis", s: "hello world", max: 6, ellipsis: true, expected: "hello…"},
+	{name: "multibyte no ellipsis", s: "ハローワールド", max: 3, ellipsis: false, expected: "ハロー"},
+	{name: "multibyte with ellipsis", s: "ハローワールド", max: 4, ellipsis: true, expected: "ハロー…"},
+	{name: "zero limit", s: "hello", max: 0, ellipsis: true, expected: ""},
+}
+
+func TestTools_Truncate(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range truncateTests {
+		result := testTools.Truncate(e.s, e.max, e.ellipsis)
+		if result != e.expected {
+			t.Errorf("%s : expected %q got %q", e.name, e.expected, result)
+		}
+	}
+}
+
+func TestTools_UploadFilesContentTypeFn(t *testing.T) {
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+
+	go func() {
+		defer writer.Close()
+
+		part, err := writer.CreateFormFile("file", "data.custom")
+		if err != nil {
+			t.Error(err)
+		}
+
+		_, err = part.Write(bytes.Repeat([]byte("x"), 2048))
+		if err != nil {
+			t.Error(err)
+		}
+	}()
+
+	request := httptest.NewRequest("POST", "/", pr)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+
+	var headSize int
+	var headName string
+
+	var testTools Tools
+	testTools.AllowedFileTypes = []string{"application/x-custom"}
+	testTools.SniffBytes = 1024
+	testTools.ContentTypeFn = func(head []byte, filename string) string {
+		headSize, headName = len(head), filename
+		return "application/x-custom"
+	}
+
+	uploadedFiles, err := testTools.UploadFiles(request, "./testdata/uploads/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if headSize != 1024 {
+		t.Errorf("wrong sniff size : expected 1024 got %d", headSize)
+	}
+
+	if headName != "data.custom" {
+		t.Errorf("wrong filename passed to ContentTypeFn : %s", headName)
+	}
+
+	_ = os.Remove(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].NewFileName))
+}
+
+var paginationTests = []struct {
+	name            string
+	query           string
+	expectedPage    int
+	expectedPerPage int
+}{
+	{name: "defaults", query: "", expectedPage: 1, expectedPerPage: 20},
+	{name: "valid values", query: "?page=3&per_page=50", expectedPage: 3, expectedPerPage: 50},
+	{name: "per page above max", query: "?page=2&per_page=500", expectedPage: 2, expectedPerPage: 100},
+	{name: "invalid values", query: "?page=abc&per_page=xyz", expectedPage: 1, expectedPerPage: 20},
+	{name: "negative values", query: "?page=-4&per_page=-10", expectedPage: 1, expectedPerPage: 20},
+	{name: "zero values", query: "?page=0&per_page=0", expectedPage: 1, expectedPerPage: 20},
+}
+
+func TestTools_ReadPagination(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range paginationTests {
+		req := httptest.NewRequest("GET", "/"+e.query, nil)
+
+		page, perPage := testTools.ReadPagination(req, 20, 100)
+		if page != e.expectedPage {
+			t.Errorf("%s : wrong page : expected %d got %d", e.name, e.expectedPage, page)
+		}
+		if perPage != e.expectedPerPage {
+			t.Errorf("%s : wrong per page : expected %d got %d", e.name, e.expectedPerPage, perPage)
+		}
+	}
+}
+
+func TestTools_ServeGraceful(t *testing.T) {
+	var testTools Tools
+
+	// a server that cannot listen should return straight away
+	err := testTools.ServeGraceful(&http.Server{Addr: "invalid-address"}, time.Second)
+	if err == nil {
+		t.Error("expected error starting server with an invalid address")
+	}
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		p, _ := os.FindProcess(os.Getpid())
+		_ = p.Signal(syscall.SIGTERM)
+	}()
+
+	err = testTools.ServeGraceful(&http.Server{Addr: "127.0.0.1:0"}, time.Second)
+	if err != nil {
+		t.Errorf("expected clean shutdown : %s", err.Error())
+	}
+}
+
+func TestTools_ParseRetryAfter(t *testing.T) {
+	var testTools Tools
+
+	h := make(http.Header)
+	if _, ok := testTools.ParseRetryAfter(h); ok {
+		t.Error("expected missing header to be reported")
+	}
+
+	h.Set("Retry-After", "120")
+	wait, ok := testTools.ParseRetryAfter(h)
+	if !ok || wait != 120*time.Second {
+		t.Errorf("wrong wait for seconds form : got %v", wait)
+	}
+
+	h.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	wait, ok = testTools.ParseRetryAfter(h)
+	if !ok || wait < 59*time.Minute || wait > time.Hour {
+		t.Errorf("wrong wait for date form : got %v", wait)
+	}
+
+	h.Set("Retry-After", "soon")
+	if _, ok := testTools.ParseRetryAfter(h); ok {
+		t.Error("expected invalid header to be reported")
+	}
+}
+
+func TestTools_PushJSONToRemoteRetry(t *testing.T) {
+	calls := 0
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		calls++
+		if calls == 1 {
+			header := make(http.Header)
+			header.Set("Retry-After", "0")
+			return &http.Response{
+				StatusCode: http.StatusTooManyRequests,
+				Body:       ioutil.NopCloser(bytes.NewBufferString("slow down")),
+				Header:     header,
+			}
+		}
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("OK")),
+			Header:     make(http.Header),
+		}
+	})
+
+	var testTools Tools
+	testTools.MaxPushRetries = 2
+
+	_, status, err := testTools.PushJSONToRemote("http://example.com", map[string]string{"foo": "bar"}, client)
+	if err != nil {
+		t.Error("failed to call remote uri", err)
+	}
+
+	if status != http.StatusOK {
+		t.Errorf("wrong status code : expected %d got %d", http.StatusOK, status)
+	}
+
+	if calls != 2 {
+		t.Errorf("wrong number of calls : expected 2 got %d", calls)
+	}
+}
+
+// testFile is a file part used to build multipart upload requests in tests
+type testFile struct {
+	name    string
+	content []byte
+}
+
+// newUploadRequest builds a multipart POST request containing the given files
+func newUploadRequest(t *testing.T, files ...testFile) *http.Request {
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+
+	for _, f := range files {
+		part, err := writer.CreateFormFile("file", f.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := part.Write(f.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	request := httptest.NewRequest("POST", "/", body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+
+	return request
+}
+
+var signatureTests = []struct {
+	name          string
+	filename      string
+	errorExpected bool
+}{
+	{name: "matching extension", filename: "img.png", errorExpected: false},
+	{name: "mismatched extension", filename: "img.jpg", errorExpected: true},
+	{name: "unknown extension", filename: "img.unknownext", errorExpected: true},
+}
+
+func TestTools_UploadFilesVerifySignature(t *testing.T) {
+	content, err := os.ReadFile("./testdata/img.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range signatureTests {
+		var testTools Tools
+		testTools.VerifyFileSignature = true
+
+		uploadedFiles, err := testTools.UploadFiles(newUploadRequest(t, testFile{e.filename, content}), "./testdata/uploads/", true)
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error received but not expected : %s", e.name, err.Error())
+		}
+
+		for _, f := range uploadedFiles {
+			_ = os.Remove(fmt.Sprintf("./testdata/uploads/%s", f.NewFileName))
+		}
+	}
+}
+
+func TestTools_SlugifyWithDate(t *testing.T) {
+	var testTools Tools
+
+	date := time.Date(2024, time.March, 5, 0, 0, 0, 0, time.UTC)
+
+	slug, err := testTools.SlugifyWithDate("My Post", date, "2006/01")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if slug != "2024/03/my-post" {
+		t.Errorf("expected 2024/03/my-post got %s", slug)
+	}
+
+	_, err = testTools.SlugifyWithDate("ハローワールド", date, "2006/01")
+	if err == nil {
+		t.Error("expected error for empty slug")
+	}
+}
+
+func TestTools_UploadFilesToTar(t *testing.T) {
+	content, err := os.ReadFile("./testdata/img.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testTools Tools
+	testTools.AllowedFileTypes = []string{"image/png"}
+
+	var archive bytes.Buffer
+	uploadedFiles, err := testTools.UploadFilesToTar(newUploadRequest(t, testFile{"img.png", content}), &archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uploadedFiles) != 1 || uploadedFiles[0].FileSize != int64(len(content)) {
+		t.Fatalf("wrong uploaded file metadata : %+v", uploadedFiles)
+	}
+
+	tr := tar.NewReader(&archive)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hdr.Name != "img.png" || hdr.Size != int64(len(content)) {
+		t.Errorf("wrong tar header : %s %d", hdr.Name, hdr.Size)
+	}
+
+	testTools.AllowedFileTypes = []string{"image/jpeg"}
+	_, err = testTools.UploadFilesToTar(newUploadRequest(t, testFile{"img.png", content}), io.Discard)
+	if err == nil {
+		t.Error("expected error for a file type that is not permitted")
+	}
+}
+
+func TestTools_UploadFilesDeduplicate(t *testing.T) {
+	content, err := os.ReadFile("./testdata/img.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testTools Tools
+	testTools.DeduplicateUploads = true
+
+	request := newUploadRequest(t, testFile{"first.png", content}, testFile{"second.png", content})
+
+	uploadedFiles, err := testTools.UploadFiles(request, "./testdata/uploads/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(uploadedFiles) != 2 {
+		t.Fatalf("expected 2 uploaded files got %d", len(uploadedFiles))
+	}
+
+	if uploadedFiles[0].Duplicate || !uploadedFiles[1].Duplicate {
+		t.Error("expected only the second file to be marked as a duplicate")
+	}
+
+	if uploadedFiles[1].NewFileName != uploadedFiles[0].NewFileName {
+		t.Errorf("expected duplicate to point to %s got %s", uploadedFiles[0].NewFileName, uploadedFiles[1].NewFileName)
+	}
+
+	if uploadedFiles[0].Checksum == "" || uploadedFiles[0].Checksum != uploadedFiles[1].Checksum {
+		t.Error("expected matching checksums")
+	}
+
+	_ = os.Remove(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].NewFileName))
+}
+
+func TestTools_ServeCachedFile(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+
+	testTools.ServeCachedFile(rr, req, "./testdata/img.png", time.Hour)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("wrong status code : expected %d got %d", http.StatusOK, rr.Code)
+	}
+
+	if rr.Header().Get("Cache-Control") != "public, max-age=3600" {
+		t.Errorf("wrong cache control header : %s", rr.Header().Get("Cache-Control"))
+	}
+
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an etag")
+	}
+
+	rr = httptest.NewRecorder()
+	req = httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("If-None-Match", etag)
+
+	testTools.ServeCachedFile(rr, req, "./testdata/img.png", time.Hour)
+
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("wrong status code : expected %d got %d", http.StatusNotModified, rr.Code)
+	}
+
+	if rr.Body.Len() != 0 {
+		t.Error("expected empty body for not modified response")
+	}
+
+	rr = httptest.NewRecorder()
+	testTools.ServeCachedFile(rr, httptest.NewRequest("GET", "/", nil), "./testdata/missing.png", time.Hour)
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("wrong status code : expected %d got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+var queryBoolTests = []struct {
+	name     string
+	query    string
+	def      bool
+	expected bool
+}{
+	{name: "absent uses default", query: "", def: true, expected: true},
+	{name: "true", query: "?active=true", def: false, expected: true},
+	{name: "one", query: "?active=1", def: false, expected: true},
+	{name: "yes mixed case", query: "?active=YeS", def: false, expected: true},
+	{name: "on", query: "?active=on", def: false, expected: true},
+	{name: "false", query: "?active=false", def: true, expected: false},
+	{name: "zero", query: "?active=0", def: true, expected: false},
+	{name: "off", query: "?active=off", def: true, expected: false},
+	{name: "t", query: "?active=T", def: false, expected: true},
+	{name: "f", query: "?active=f", def: true, expected: false},
+	{name: "no", query: "?active=no", def: true, expected: false},
+	{name: "y uses default", query: "?active=y", def: false, expected: false},
+	{name: "n uses default", query: "?active=n", def: true, expected: true},
+	{name: "unparseable uses default", query: "?active=maybe", def: true, expected: true},
+}
+
+func TestTools_QueryBool(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range queryBoolTests {
+		req := httptest.NewRequest("GET", "/"+e.query, nil)
+		if result := testTools.QueryBool(req, "active", e.def); result != e.expected {
+			t.Errorf("%s : expected %t got %t", e.name, e.expected, result)
+		}
+	}
+}
+
+func TestTools_QueryIntAndString(t *testing.T) {
+	var testTools Tools
+
+	req := httptest.NewRequest("GET", "/?limit=25&bad=abc&name=foo", nil)
+
+	if i := testTools.QueryInt(req, "limit", 10); i != 25 {
+		t.Errorf("expected 25 got %d", i)
+	}
+
+	if i := testTools.QueryInt(req, "bad", 10); i != 10 {
+		t.Errorf("expected default 10 got %d", i)
+	}
+
+	if s := testTools.QueryString(req, "name", "bar"); s != "foo" {
+		t.Errorf("expected foo got %s", s)
+	}
+
+	if s := testTools.QueryString(req, "missing", "bar"); s != "bar" {
+		t.Errorf("expected default bar got %s", s)
+	}
+}
+
+var jsonDepthTests = []struct {
+	name          string
+	json          string
+	maxDepth      int
+	errorExpected bool
+}{
+	{name: "unlimited", json: `{"foo":"bar","nested":[[[[{"a":1}]]]]}`, maxDepth: 0, errorExpected: false},
+	{name: "within limit", json: `{"foo":"bar","nested":[{"a":1}]}`, maxDepth: 3, errorExpected: false},
+	{name: "too deep", json: `{"foo":"bar","nested":[[[[{"a":1}]]]]}`, maxDepth: 3, errorExpected: true},
+	{name: "brackets in strings ignored", json: `{"foo":"[[[[{{{{\"]]"}`, maxDepth: 1, errorExpected: false},
+}
+
+func TestTools_ReadJSONFileMaxDepth(t *testing.T) {
+	for _, e := range jsonDepthTests {
+		var testTool Tools
+		testTool.MaxJSONDepth = e.maxDepth
+		testTool.AllowUnknownFields = true
+
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(e.json)))
+		rr := httptest.NewRecorder()
+
+		err := testTool.ReadJSONFile(rr, req, &decodedJSON)
+
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error received but not expected : %s", e.name, err.Error())
+		}
+	}
+}
+
+func TestTools_HealthCheckHandler(t *testing.T) {
+	var testTools Tools
+	testTools.HealthCheckTimeout = 50 * time.Millisecond
+
+	passing := map[string]func() error{
+		"db":    func() error { return nil },
+		"cache": func() error { return nil },
+	}
+
+	rr := httptest.NewRecorder()
+	testTools.HealthCheckHandler(passing)(rr, httptest.NewRequest("GET", "/healthz", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("wrong status code : expected %d got %d", http.StatusOK, rr.Code)
+	}
+
+	failing := map[string]func() error{
+		"db":    func() error { return nil },
+		"cache": func() error { return errors.New("connection refused") },
+		"queue": func() error { time.Sleep(time.Second); return nil },
+	}
+
+	rr = httptest.NewRecorder()
+	testTools.HealthCheckHandler(failing)(rr, httptest.NewRequest("GET", "/healthz", nil))
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("wrong status code : expected %d got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+
+	var payload struct {
+		Error bool              `json:"error"`
+		Data  map[string]string `json:"data"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if !payload.Error {
+		t.Error("payload error should be true")
+	}
+
+	if payload.Data["db"] != "ok" || payload.Data["cache"] != "connection refused" || payload.Data["queue"] != "timed out" {
+		t.Errorf("wrong check statuses : %v", payload.Data)
+	}
+}
+
+func TestTools_SortableID(t *testing.T) {
+	var testTools Tools
+
+	first := testTools.SortableID()
+	time.Sleep(2 * time.Millisecond)
+	second := testTools.SortableID()
+
+	if len(first) != 30 || len(second) != 30 {
+		t.Errorf("wrong id length : %d and %d", len(first), len(second))
+	}
+
+	if first >= second {
+		t.Errorf("expected %s to sort before %s", first, second)
+	}
+}
+
+func TestTools_RedactJSON(t *testing.T) {
+	var testTools Tools
+
+	body := []byte(`{"user":"bob","password":"secret","profile":{"SSN":"123-45-6789","age":42},"cards":[{"number":"4111","name":"bob"}]}`)
+
+	out, err := testTools.RedactJSON(body, []string{"password", "ssn", "number"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"cards":[{"name":"bob","number":"***"}],"password":"***","profile":{"SSN":"***","age":42},"user":"bob"}`
+	if string(out) != expected {
+		t.Errorf("expected %s got %s", expected, string(out))
+	}
+
+	out, err = testTools.RedactJSON([]byte(`password=secret`), []string{"password"})
+	if err == nil {
+		t.Error("expected error for non json input")
+	}
+
+	if out != nil {
+		t.Error("expected no output for non json input")
+	}
+}
+
+var extensionTests = []struct {
+	name      string
+	filename  string
+	lowercase bool
+	expected  string
+}{
+	{name: "mixed case preserved", filename: "img.PnG", lowercase: false, expected: ".PnG"},
+	{name: "mixed case lowercased", filename: "img.PnG", lowercase: true, expected: ".png"},
+	{name: "lowercase unchanged", filename: "img.png", lowercase: true, expected: ".png"},
+}
+
+func TestTools_UploadFilesLowercaseExtensions(t *testing.T) {
+	content, err := os.ReadFile("./testdata/img.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range extensionTests {
+		var testTools Tools
+		testTools.LowercaseExtensions = e.lowercase
+
+		uploadedFiles, err := testTools.UploadFiles(newUploadRequest(t, testFile{e.filename, content}), "./testdata/uploads/", true)
+		if err != nil {
+			t.Fatalf("%s : %s", e.name, err.Error())
+		}
+
+		if ext := filepath.Ext(uploadedFiles[0].NewFileName); ext != e.expected {
+			t.Errorf("%s : expected extension %s got %s", e.name, e.expected, ext)
+		}
+
+		_ = os.Remove(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].NewFileName))
+	}
+}
+
+func TestTools_WriteJSONWithLastModified(t *testing.T) {
+	var testTools Tools
+
+	modTime := time.Date(2024, time.March, 5, 10, 30, 0, 0, time.UTC)
+	payload := JSONResponse{Message: "foo"}
+
+	rr := httptest.NewRecorder()
+	err := testTools.WriteJSONWithLastModified(rr, httptest.NewRequest("GET", "/", nil), http.StatusOK, payload, modTime)
+	if err != nil {
+		t.Error(err)
+	}
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("wrong status code : expected %d got %d", http.StatusOK, rr.Code)
+	}
+
+	if rr.Header().Get("Last-Modified") != "Tue, 05 Mar 2024 10:30:00 GMT" {
+		t.Errorf("wrong last modified header : %s", rr.Header().Get("Last-Modified"))
+	}
+
+	var conditionalTests = []struct {
+		name     string
+		since    time.Time
+		expected int
+	}{
+		{name: "same time", since: modTime, expected: http.StatusNotModified},
+		{name: "later time", since: modTime.Add(time.Hour), expected: http.StatusNotModified},
+		{name: "earlier time", since: modTime.Add(-time.Hour), expected: http.StatusOK},
+	}
+
+	for _, e := range conditionalTests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("If-Modified-Since", e.since.Format(http.TimeFormat))
+
+		rr := httptest.NewRecorder()
+		err := testTools.WriteJSONWithLastModified(rr, req, http.StatusOK, payload, modTime)
+		if err != nil {
+			t.Error(err)
+		}
+
+		if rr.Code != e.expected {
+			t.Errorf("%s : wrong status code : expected %d got %d", e.name, e.expected, rr.Code)
+		}
+	}
+}
+
+var bearerTests = []struct {
+	name          string
+	header        string
+	expected      string
+	errorExpected bool
+}{
+	{name: "valid", header: "Bearer abc.def", expected: "abc.def", errorExpected: false},
+	{name: "lowercase scheme", header: "bearer abc.def", expected: "abc.def", errorExpected: false},
+	{name: "missing", header: "", expected: "", errorExpected: true},
+	{name: "wrong scheme", header: "Basic dXNlcjpwYXNz", expected: "", errorExpected: true},
+	{name: "no token", header: "Bearer", expected: "", errorExpected: true},
+	{name: "extra parts", header: "Bearer abc def", expected: "", errorExpected: true},
+}
+
+func TestTools_BearerToken(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range bearerTests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if e.header != "" {
+			req.Header.Set("Authorization", e.header)
+		}
+
+		token, err := testTools.BearerToken(req)
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error received but not expected : %s", e.name, err.Error())
+		}
+
+		if token != e.expected {
+			t.Errorf("%s : expected %q got %q", e.name, e.expected, token)
+		}
+	}
+}
+
+func TestTools_ReadJSONFileUseJSONNumber(t *testing.T) {
+	var testTool Tools
+	testTool.UseJSONNumber = true
+
+	var decodedJSON map[string]interface{}
+
+	req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(`{"id": 9007199254740993}`)))
+	rr := httptest.NewRecorder()
+
+	err := testTool.ReadJSONFile(rr, req, &decodedJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, ok := decodedJSON["id"].(json.Number)
+	if !ok {
+		t.Fatalf("expected json.Number got %T", decodedJSON["id"])
+	}
+
+	if n.String() != "9007199254740993" {
+		t.Errorf("precision lost : got %s", n.String())
+	}
+}
+
+func TestTools_UploadFilesRequiredFormFields(t *testing.T) {
+	content, err := os.ReadFile("./testdata/img.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testTools Tools
+	testTools.RequiredFormFields = []string{"title", "owner"}
+
+	request := newUploadRequest(t, testFile{"img.png", content})
+
+	uploadedFiles, err := testTools.UploadFiles(request, "./testdata/uploads/", true)
+	if err == nil {
+		t.Error("expected error for missing form fields")
+	} else if err.Error() != "the form is missing required fields: title, owner" {
+		t.Errorf("wrong error message : %s", err.Error())
+	}
+
+	if len(uploadedFiles) != 0 {
+		t.Error("expected no files to be written")
+	}
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("title", "holiday")
+	_ = writer.WriteField("owner", "bob")
+	part, _ := writer.CreateFormFile("file", "img.png")
+	_, _ = part.Write(content)
+	_ = writer.Close()
+
+	request = httptest.NewRequest("POST", "/", body)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+
+	uploadedFiles, err = testTools.UploadFiles(request, "./testdata/uploads/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = os.Remove(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].NewFileName))
+}
+
+var languageTests = []struct {
+	name     string
+	sample   string
+	expected string
+}{
+	{name: "english", sample: "The quick brown fox jumps over the lazy dog and this is the end of it.", expected: "en"},
+	{name: "spanish", sample: "El perro de la casa es muy bueno y los niños juegan con él en el parque.", expected: "es"},
+	{name: "french", sample: "Le chat est sur la table et les enfants ne sont pas dans la maison.", expected: "fr"},
+	{name: "german", sample: "Der Hund und die Katze sind nicht in dem Haus, das ist ein Problem.", expected: "de"},
+	{name: "russian", sample: "Быстрая коричневая лиса прыгает через ленивую собаку.", expected: "ru"},
+	{name: "japanese", sample: "ハローワールド、こんにちは世界", expected: "ja"},
+	{name: "chinese", sample: "你好世界，今天天气很好。", expected: "zh"},
+	{name: "no letters", sample: "12345 !!!", expected: "und"},
+}
+
+func TestTools_DetectTextLanguage(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range languageTests {
+		if lang := testTools.DetectTextLanguage([]byte(e.sample)); lang != e.expected {
+			t.Errorf("%s : expected %s got %s", e.name, e.expected, lang)
+		}
+	}
+}
+
+func TestChunk(t *testing.T) {
+	items := []int{1, 2, 3, 4, 5, 6, 7}
+
+	chunks := Chunk(items, 3)
+	if len(chunks) != 3 {
+		t.Fatalf("expected 3 chunks got %d", len(chunks))
+	}
+
+	if len(chunks[0]) != 3 || len(chunks[1]) != 3 || len(chunks[2]) != 1 || chunks[2][0] != 7 {
+		t.Errorf("wrong chunks : %v", chunks)
+	}
+
+	if chunks := Chunk(items, 0); len(chunks) != 1 || len(chunks[0]) != 7 {
+		t.Errorf("expected a single chunk for invalid size : %v", chunks)
+	}
+
+	if chunks := Chunk([]string{}, 3); chunks != nil {
+		t.Errorf("expected no chunks for empty slice : %v", chunks)
+	}
+}
+
+func TestTools_FlattenJSON(t *testing.T) {
+	var testTools Tools
+
+	body := []byte(`{"user":{"name":"bob","address":{"city":"Paris"}},"tags":["a",{"b":true}],"empty":[]}`)
+
+	flat, err := testTools.FlattenJSON(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]interface{}{
+		"user.name":         "bob",
+		"user.address.city": "Paris",
+		"tags[0]":           "a",
+		"tags[1].b":         true,
+	}
+
+	for k, v := range expected {
+		if flat[k] != v {
+			t.Errorf("wrong value for %s : expected %v got %v", k, v, flat[k])
+		}
+	}
+
+	if len(flat) != len(expected)+1 {
+		t.Errorf("wrong number of keys : %v", flat)
+	}
+
+	if _, err := testTools.FlattenJSON([]byte(`[1, 2, 3]`)); err == nil {
+		t.Error("expected error for top level array")
+	}
+}
+
+func TestTools_DownloadDirAsZip(t *testing.T) {
+	var testTools Tools
+
+	dir := t.TempDir()
+	_ = os.MkdirAll(filepath.Join(dir, "sub"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("alpha"), 0644)
+	_ = os.WriteFile(filepath.Join(dir, "sub", "b.txt"), []byte("beta"), 0644)
+	_ = os.Symlink("/etc/passwd", filepath.Join(dir, "link"))
+
+	rr := httptest.NewRecorder()
+	err := testTools.DownloadDirAsZip(rr, httptest.NewRequest("GET", "/", nil), dir, "data.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Header().Get("Content-Disposition") != "attachment; filename=\"data.zip\"" {
+		t.Error("wrong content disposition")
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]bool)
+	for _, f := range zr.File {
+		names[f.Name] = true
+	}
+
+	if len(names) != 2 || !names["a.txt"] || !names["sub/b.txt"] {
+		t.Errorf("wrong archive contents : %v", names)
+	}
+
+	err = testTools.DownloadDirAsZip(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil), "./testdata/img.png", "data.zip")
+	if err == nil {
+		t.Error("expected error for a path that is not a directory")
+	}
+}
+
+func TestTools_SetAllowedFileTypes(t *testing.T) {
+	var testTools Tools
+
+	testTools.SetAllowedFileTypes("Image/PNG", "image/png", " image/jpeg ", "", "IMAGE/JPEG")
+
+	expected := []string{"image/png", "image/jpeg"}
+	if len(testTools.AllowedFileTypes) != len(expected) {
+		t.Fatalf("expected %v got %v", expected, testTools.AllowedFileTypes)
+	}
+
+	for i, ft := range expected {
+		if testTools.AllowedFileTypes[i] != ft {
+			t.Errorf("expected %s got %s", ft, testTools.AllowedFileTypes[i])
+		}
+	}
+}
+
+func TestTools_UploadFilesCollectErrors(t *testing.T) {
+	content, err := os.ReadFile("./testdata/img.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testTools Tools
+	testTools.AllowedFileTypes = []string{"image/png"}
+
+	request := newUploadRequest(t, testFile{"img.png", content}, testFile{"notes.txt", []byte("plain text")}, testFile{"other.png", content})
+
+	uploadedFiles, fileErrors, err := testTools.UploadFilesCollect(request, "./testdata/uploads/", true)
+	for _, f := range uploadedFiles {
+		_ = os.Remove(fmt.Sprintf("./testdata/uploads/%s", f.NewFileName))
+	}
+
+	if err != nil {
+		t.Errorf("expected rejected files not to be an error but got %v", err)
+	}
+
+	if len(fileErrors) != 1 || fileErrors[0].FileName != "notes.txt" {
+		t.Errorf("wrong upload errors : %v", fileErrors)
+	}
+
+	if len(uploadedFiles) != 2 {
+		t.Errorf("expected 2 uploaded files got %d", len(uploadedFiles))
+	}
+}
+
+var outboundURLTests = []struct {
+	name     string
+	uri      string
+	expected bool
+}{
+	{name: "public address", uri: "https://8.8.8.8/hook", expected: true},
+	{name: "wrong scheme", uri: "ftp://8.8.8.8/file", expected: false},
+	{name: "loopback", uri: "http://127.0.0.1:8080/admin", expected: false},
+	{name: "ipv6 loopback", uri: "http://[::1]/admin", expected: false},
+	{name: "private", uri: "http://10.0.0.5/internal", expected: false},
+	{name: "link local metadata", uri: "http://169.254.169.254/latest/meta-data", expected: false},
+	{name: "unspecified", uri: "http://0.0.0.0/", expected: false},
+	{name: "carrier grade nat", uri: "http://100.64.1.1/", expected: false},
+	{name: "this network", uri: "http://0.1.2.3/", expected: false},
+	{name: "benchmarking", uri: "http://198.18.0.1/", expected: false},
+	{name: "reserved", uri: "http://240.0.0.1/", expected: false},
+	{name: "broadcast", uri: "http://255.255.255.255/", expected: false},
+	{name: "nat64 metadata", uri: "http://[64:ff9b::a9fe:a9fe]/latest/meta-data", expected: false},
+	{name: "nat64 loopback", uri: "http://[64:ff9b::7f00:1]/", expected: false},
+	{name: "nat64 public", uri: "http://[64:ff9b::808:808]/hook", expected: true},
+	{name: "ipv4 mapped private", uri: "http://[::ffff:10.0.0.5]/", expected: false},
+	{name: "no host", uri: "http:///path", expected: false},
+}
+
+func TestTools_IsSafeOutboundURL(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range outboundURLTests {
+		safe, err := testTools.IsSafeOutboundURL(e.uri)
+		if safe != e.expected {
+			t.Errorf("%s : expected %t got %t", e.name, e.expected, safe)
+		}
+
+		if !safe && err == nil {
+			t.Errorf("%s : expected an error explaining why the url is unsafe", e.name)
+		}
+	}
+}
+
+func TestTools_PushJSONToRemoteSafeOutboundOnly(t *testing.T) {
+	called := false
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		called = true
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("OK")),
+			Header:     make(http.Header),
+		}
+	})
+
+	var testTools Tools
+	testTools.SafeOutboundOnly = true
+
+	_, _, err := testTools.PushJSONToRemote("http://169.254.169.254/latest", map[string]string{"foo": "bar"}, client)
+	if err == nil {
+		t.Error("expected error pushing to an unsafe url")
+	}
+
+	if called {
+		t.Error("expected the request not to be sent")
+	}
+}
+
+func TestTools_ReadJSONMap(t *testing.T) {
+	var testTools Tools
+
+	req := httptest.NewRequest("POST", "/", bytes.NewReader([]byte(`{"name":"bob","age":42,"score":9.5,"admin":true}`)))
+	m, err := testTools.ReadJSONMap(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s, err := m.String("name"); err != nil || s != "bob" {
+		t.Errorf("wrong string value : %q %v", s, err)
+	}
+
+	if i, err := m.Int("age"); err != nil || i != 42 {
+		t.Errorf("wrong int value : %d %v", i, err)
+	}
+
+	if f, err := m.Float("score"); err != nil || f != 9.5 {
+		t.Errorf("wrong float value : %f %v", f, err)
+	}
+
+	if b, err := m.Bool("admin"); err != nil || !b {
+		t.Errorf("wrong bool value : %t %v", b, err)
+	}
+
+	if i, err := m.Int("score"); err == nil || i != 0 {
+		t.Error("expected error reading a fraction as an int")
+	}
+
+	if s, err := m.String("age"); err == nil || s != "" {
+		t.Error("expected error reading a number as a string")
+	}
+
+	if _, err := m.Bool("missing"); err == nil {
+		t.Error("expected error reading a missing key")
+	}
+
+	req = httptest.NewRequest("POST", "/", bytes.NewReader([]byte(`[1, 2]`)))
+	if _, err := testTools.ReadJSONMap(httptest.NewRecorder(), req); err == nil {
+		t.Error("expected error reading an array into a map")
+	}
+}
+
+func TestTools_UploadQuota(t *testing.T) {
+	var testTools Tools
+
+	handler := testTools.UploadQuota(10, time.Hour)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(addr, body string) int {
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+		req.RemoteAddr = addr
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	if code := send("10.0.0.1:1234", "123456"); code != http.StatusOK {
+		t.Errorf("first upload : expected %d got %d", http.StatusOK, code)
+	}
+
+	if code := send("10.0.0.1:5678", "123456"); code != http.StatusTooManyRequests {
+		t.Errorf("upload over quota : expected %d got %d", http.StatusTooManyRequests, code)
+	}
+
+	if code := send("10.0.0.1:5678", "1234"); code != http.StatusOK {
+		t.Errorf("upload within remaining quota : expected %d got %d", http.StatusOK, code)
+	}
+
+	if code := send("10.0.0.1:5678", "1"); code != http.StatusTooManyRequests {
+		t.Errorf("upload after quota used : expected %d got %d", http.StatusTooManyRequests, code)
+	}
+
+	if code := send("10.0.0.2:1234", "123456"); code != http.StatusOK {
+		t.Errorf("upload from another client : expected %d got %d", http.StatusOK, code)
+	}
+}
+
+type testMetrics struct {
+	uploads, reads, pushes int
+	uploadBytes, readBytes int64
+	pushStatus             int
+}
+
+func (m *testMetrics) ObserveUpload(bytes int64, dur time.Duration) {
+	m.uploads++
+	m.uploadBytes += bytes
+}
+
+func (m *testMetrics) ObserveJSONRead(bytes int64, dur time.Duration, err error) {
+	m.reads++
+	m.readBytes += bytes
+}
+
+func (m *testMetrics) ObservePush(status int, dur time.Duration, err error) {
+	m.pushes++
+	m.pushStatus = status
+}
+
+func TestTools_Metrics(t *testing.T) {
+	metrics := &testMetrics{}
+
+	var testTools Tools
+	testTools.Metrics = metrics
+
+	content, err := os.ReadFile("./testdata/img.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	uploadedFiles, err := testTools.UploadFiles(newUploadRequest(t, testFile{"img.png", content}), "./testdata/uploads/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Remove(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].NewFileName))
+
+	var decodedJSON struct {
+		Foo string `json:"foo"`
+	}
+	body := `{"foo":"bar"}`
+	_ = testTools.ReadJSONFile(httptest.NewRecorder(), httptest.NewRequest("POST", "/", bytes.NewBufferString(body)), &decodedJSON)
+
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		return &http.Response{
+			StatusCode: http.StatusAccepted,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("OK")),
+			Header:     make(http.Header),
+		}
+	})
+	_, _, _ = testTools.PushJSONToRemote("http://example.com", decodedJSON, client)
+
+	if metrics.uploads != 1 || metrics.uploadBytes != int64(len(content)) {
+		t.Errorf("wrong upload metrics : %d files, %d bytes", metrics.uploads, metrics.uploadBytes)
+	}
+
+	if metrics.reads != 1 || metrics.readBytes != int64(len(body)) {
+		t.Errorf("wrong json read metrics : %d reads, %d bytes", metrics.reads, metrics.readBytes)
+	}
+
+	if metrics.pushes != 1 || metrics.pushStatus != http.StatusAccepted {
+		t.Errorf("wrong push metrics : %d pushes, status %d", metrics.pushes, metrics.pushStatus)
+	}
+}
+
+type validateAddress struct {
+	City string `json:"city" validate:"required"`
+}
+
+type validateUser struct {
+	Name    string          `json:"name" validate:"required,min=3,max=10"`
+	Email   string          `json:"email" validate:"required,email"`
+	Age     int             `json:"age" validate:"min=18,max=130"`
+	Tags    []string        `json:"tags" validate:"max=2"`
+	Address validateAddress `json:"address"`
+}
+
+func TestTools_Validate(t *testing.T) {
+	var testTools Tools
+
+	valid := validateUser{Name: "bob", Email: "bob@example.com", Age: 30, Address: validateAddress{City: "Paris"}}
+	failures, err := testTools.Validate(&valid)
+	if err != nil || failures != nil {
+		t.Errorf("expected valid user : %v %v", failures, err)
+	}
+
+	invalid := validateUser{Name: "bo", Email: "not an email", Age: 12, Tags: []string{"a", "b", "c"}}
+	failures, err = testTools.Validate(invalid)
+	if err == nil {
+		t.Error("expected validation error")
+	}
+
+	for _, field := range []string{"name", "email", "age", "tags", "address.city"} {
+		if _, ok := failures[field]; !ok {
+			t.Errorf("expected failure for %s : %v", field, failures)
+		}
+	}
+
+	if _, err := testTools.Validate("not a struct"); err == nil {
+		t.Error("expected error validating a non struct")
+	}
+
+	var bad struct {
+		Name string `validate:"sometimes"`
+	}
+	if _, err := testTools.Validate(bad); err == nil {
+		t.Error("expected error for unknown rule")
+	}
+}
+
+func TestTools_ReadAndValidateJSON(t *testing.T) {
+	var testTools Tools
+
+	var user validateUser
+	req := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"name":"bob","email":"bad","age":30,"address":{"city":"Paris"}}`))
+
+	failures, err := testTools.ReadAndValidateJSON(httptest.NewRecorder(), req, &user)
+	if err == nil {
+		t.Error("expected validation error")
+	}
+
+	if len(failures) != 1 || failures["email"] == "" {
+		t.Errorf("expected only an email failure : %v", failures)
+	}
+}
+
+func TestTools_ErrorJSONDebugErrors(t *testing.T) {
+	for _, debugErrors := range []bool{false, true} {
+		var testTools Tools
+		testTools.DebugErrors = debugErrors
+
+		rr := httptest.NewRecorder()
+		if err := testTools.ErrorJSON(rr, errors.New("some error")); err != nil {
+			t.Fatal(err)
+		}
+
+		var payload map[string]interface{}
+		if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+			t.Fatal(err)
+		}
+
+		trace, ok := payload["trace"].(string)
+		if debugErrors && (!ok || !strings.Contains(trace, "TestTools_ErrorJSONDebugErrors")) {
+			t.Errorf("expected trace to include the caller : %q", trace)
+		}
+
+		if !debugErrors && ok {
+			t.Error("expected no trace when DebugErrors is not set")
+		}
+	}
+}
+
+var csvHeaderTests = []struct {
+	name          string
+	csv           string
+	errorExpected bool
+	message       string
+}{
+	{name: "exact", csv: "id,name,email\n1,bob,bob@example.com\n", errorExpected: false},
+	{name: "reordered with spaces and bom", csv: "\ufeffemail, id ,name\n", errorExpected: false},
+	{name: "missing and unexpected", csv: "id,nam,email,phone\n", errorExpected: true, message: "csv headers do not match : missing columns: name; unexpected columns: nam, phone"},
+	{name: "empty", csv: "", errorExpected: true, message: "csv data is empty"},
+}
+
+func TestTools_ValidateCSVHeaders(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range csvHeaderTests {
+		err := testTools.ValidateCSVHeaders(strings.NewReader(e.csv), []string{"id", "name", "email"})
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error received but not expected : %s", e.name, err.Error())
+		}
+
+		if err != nil && e.message != "" && err.Error() != e.message {
+			t.Errorf("%s : wrong error message : %s", e.name, err.Error())
+		}
+	}
+}
+
+func TestTools_DecodeJSONArray(t *testing.T) {
+	var testTools Tools
+
+	type item struct {
+		ID int `json:"id"`
+	}
+
+	var ids []int
+	err := testTools.DecodeJSONArray(strings.NewReader(`[{"id":1},{"id":2},{"id":3}]`), func(decode func(v interface{}) error) error {
+		var i item
+		if err := decode(&i); err != nil {
+			return err
+		}
+		ids = append(ids, i.ID)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ids) != 3 || ids[2] != 3 {
+		t.Errorf("wrong ids : %v", ids)
+	}
+
+	count := 0
+	err = testTools.DecodeJSONArray(strings.NewReader(`[1, 2, 3]`), func(decode func(v interface{}) error) error {
+		count++
+		return nil
+	})
+	if err != nil || count != 3 {
+		t.Errorf("expected skipped elements to be consumed : %d %v", count, err)
+	}
+
+	count = 0
+	err = testTools.DecodeJSONArray(strings.NewReader(`[{"id":1},{"id":},{"id":3}]`), func(decode func(v interface{}) error) error {
+		count++
+		var i item
+		return decode(&i)
+	})
+	if err == nil {
+		t.Error("expected error for malformed element")
+	}
+
+	if count != 2 {
+		t.Errorf("expected processing to stop at the malformed element : %d", count)
+	}
+
+	err = testTools.DecodeJSONArray(strings.NewReader(`{"id":1}`), func(decode func(v interface{}) error) error {
+		return nil
+	})
+	if err == nil {
+		t.Error("expected error for a value that is not an array")
+	}
+}
+
+func TestTools_BuildMultipartRequest(t *testing.T) {
+	var testTools Tools
+
+	content, err := os.ReadFile("./testdata/img.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	request, err := testTools.BuildMultipartRequest("http://example.com/upload",
+		map[string]string{"title": "holiday"},
+		map[string]io.Reader{"img.png": bytes.NewReader(content)},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if request.Method != "POST" || request.URL.String() != "http://example.com/upload" {
+		t.Errorf("wrong request : %s %s", request.Method, request.URL)
+	}
+
+	if err := request.ParseMultipartForm(1024 * 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	if request.FormValue("title") != "holiday" {
+		t.Errorf("wrong title field : %s", request.FormValue("title"))
+	}
+
+	hdrs := request.MultipartForm.File["img.png"]
+	if len(hdrs) != 1 {
+		t.Fatalf("expected one file part got %d", len(hdrs))
+	}
+
+	if hdrs[0].Filename != "img.png" || hdrs[0].Header.Get("Content-Type") != "image/png" || hdrs[0].Size != int64(len(content)) {
+		t.Errorf("wrong file part : %s %s %d", hdrs[0].Filename, hdrs[0].Header.Get("Content-Type"), hdrs[0].Size)
+	}
+}
+
+func TestTools_UploadFilesRejectPolyglots(t *testing.T) {
+	content, err := os.ReadFile("./testdata/img.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testTools Tools
+	testTools.RejectPolyglots = true
+
+	uploadedFiles, err := testTools.UploadFiles(newUploadRequest(t, testFile{"img.png", content}), "./testdata/uploads/", true)
+	if err != nil {
+		t.Fatalf("clean image rejected : %s", err.Error())
+	}
+	_ = os.Remove(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].NewFileName))
+
+	polyglot := append(append([]byte{}, content...), []byte("<SCRIPT>alert(1)</SCRIPT>")...)
+
+	_, err = testTools.UploadFiles(newUploadRequest(t, testFile{"img.png", polyglot}), "./testdata/uploads/", true)
+	if err == nil {
+		t.Fatal("expected polyglot image to be rejected")
+	}
+
+	if !strings.Contains(err.Error(), "<script") {
+		t.Errorf("expected error to name the suspicious content : %s", err.Error())
+	}
+}
+
+func TestTools_SignURL(t *testing.T) {
+	var testTools Tools
+
+	signed := testTools.SignURL("https://example.com/files/report.pdf?user=42", time.Now().Add(time.Hour), "secret")
+
+	ok, err := testTools.VerifySignedURL(signed, "secret")
+	if !ok || err != nil {
+		t.Errorf("expected signed url to verify : %v", err)
+	}
+
+	if ok, _ := testTools.VerifySignedURL(signed, "other secret"); ok {
+		t.Error("expected url signed with a different secret to fail")
+	}
+
+	tampered := strings.Replace(signed, "user=42", "user=43", 1)
+	if ok, _ := testTools.VerifySignedURL(tampered, "secret"); ok {
+		t.Error("expected tampered url to fail")
+	}
+
+	expired := testTools.SignURL("https://example.com/files/report.pdf", time.Now().Add(-time.Minute), "secret")
+	if ok, err := testTools.VerifySignedURL(expired, "secret"); ok || err == nil || err.Error() != "url has expired" {
+		t.Errorf("expected expired url to fail : %v", err)
+	}
+
+	if ok, _ := testTools.VerifySignedURL("https://example.com/files/report.pdf", "secret"); ok {
+		t.Error("expected unsigned url to fail")
+	}
+}
+
+var contentRangeTests = []struct {
+	name           string
+	rangeHeader    string
+	expectedStatus int
+	expectedBody   string
+}{
+	{name: "no range", rangeHeader: "", expectedStatus: http.StatusOK, expectedBody: "0123456789"},
+	{name: "first bytes", rangeHeader: "bytes=0-3", expectedStatus: http.StatusPartialContent, expectedBody: "0123"},
+	{name: "suffix", rangeHeader: "bytes=-2", expectedStatus: http.StatusPartialContent, expectedBody: "89"},
+	{name: "unsatisfiable", rangeHeader: "bytes=20-30", expectedStatus: http.StatusRequestedRangeNotSatisfiable},
+	{name: "malformed", rangeHeader: "bytes=abc", expectedStatus: http.StatusRequestedRangeNotSatisfiable},
+}
+
+func TestTools_ServeContentRange(t *testing.T) {
+	var testTools Tools
+
+	content := strings.NewReader("0123456789")
+
+	for _, e := range contentRangeTests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if e.rangeHeader != "" {
+			req.Header.Set("Range", e.rangeHeader)
+		}
+
+		rr := httptest.NewRecorder()
+		testTools.ServeContentRange(rr, req, time.Now(), content.Size(), content, "text/plain")
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s : wrong status code : expected %d got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if e.expectedBody != "" && rr.Body.String() != e.expectedBody {
+			t.Errorf("%s : expected body %q got %q", e.name, e.expectedBody, rr.Body.String())
+		}
+	}
+}
+
+var caseConversionTests = []struct {
+	snake string
+	camel string
+}{
+	{snake: "user_id", camel: "userId"},
+	{snake: "first_name", camel: "firstName"},
+	{snake: "name", camel: "name"},
+	{snake: "address_line2", camel: "addressLine2"},
+}
+
+func TestTools_CaseConversion(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range caseConversionTests {
+		if camel := testTools.SnakeToCamel(e.snake); camel != e.camel {
+			t.Errorf("SnakeToCamel(%s) : expected %s got %s", e.snake, e.camel, camel)
+		}
+
+		if snake := testTools.CamelToSnake(e.camel); snake != e.snake {
+			t.Errorf("CamelToSnake(%s) : expected %s got %s", e.camel, e.snake, snake)
+		}
+	}
+
+	if snake := testTools.CamelToSnake("HTTPServerID"); snake != "http_server_id" {
+		t.Errorf("CamelToSnake(HTTPServerID) : expected http_server_id got %s", snake)
+	}
+}
+
+func TestTools_TransformJSONKeys(t *testing.T) {
+	var testTools Tools
+
+	body := []byte(`{"user_id":12345678901234567890,"home_address":{"post_code":"AB1"},"order_items":[{"item_name":"pen"}]}`)
+
+	out, err := testTools.TransformJSONKeys(body, testTools.SnakeToCamel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `{"homeAddress":{"postCode":"AB1"},"orderItems":[{"itemName":"pen"}],"userId":12345678901234567890}`
+	if string(out) != expected {
+		t.Errorf("expected %s got %s", expected, string(out))
+	}
+
+	back, err := testTools.TransformJSONKeys(out, testTools.CamelToSnake)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(string(back), `"order_items":[{"item_name":"pen"}]`) {
+		t.Errorf("round trip failed : %s", string(back))
+	}
+
+	if _, err := testTools.TransformJSONKeys([]byte(`{bad}`), testTools.SnakeToCamel); err == nil {
+		t.Error("expected error for invalid json")
+	}
+}
+
+var allowMethodsTests = []struct {
+	name           string
+	method         string
+	expectedStatus int
+}{
+	{name: "allowed get", method: "GET", expectedStatus: http.StatusOK},
+	{name: "allowed post", method: "POST", expectedStatus: http.StatusOK},
+	{name: "not allowed", method: "DELETE", expectedStatus: http.StatusMethodNotAllowed},
+	{name: "options", method: "OPTIONS", expectedStatus: http.StatusNoContent},
+}
+
+func TestTools_AllowMethods(t *testing.T) {
+	var testTools Tools
+
+	handler := testTools.AllowMethods("GET", "POST")(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for _, e := range allowMethodsTests {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest(e.method, "/", nil))
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s : wrong status code : expected %d got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if e.expectedStatus != http.StatusOK && rr.Header().Get("Allow") != "GET, POST" {
+			t.Errorf("%s : wrong allow header : %s", e.name, rr.Header().Get("Allow"))
+		}
+	}
+}
+
+var jsonContentTypeTests = []struct {
+	name          string
+	contentType   string
+	errorExpected bool
+}{
+	{name: "json", contentType: "application/json", errorExpected: false},
+	{name: "json with charset", contentType: "application/json; charset=utf-8", errorExpected: false},
+	{name: "plain text", contentType: "text/plain", errorExpected: true},
+	{name: "missing", contentType: "", errorExpected: true},
+}
+
+func TestTools_ReadJSONFileRequireContentType(t *testing.T) {
+	var testTool Tools
+	testTool.RequireJSONContentType = true
+
+	for _, e := range jsonContentTypeTests {
+		var decodedJSON struct {
+			Foo string `json:"foo"`
+		}
+
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(`{"foo":"bar"}`))
+		if e.contentType != "" {
+			req.Header.Set("Content-Type", e.contentType)
+		}
+
+		err := testTool.ReadJSONFile(httptest.NewRecorder(), req, &decodedJSON)
+
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error received but not expected : %s", e.name, err.Error())
+		}
+	}
+}
+
+func TestTools_UploadFilesThumbnails(t *testing.T) {
+	content, err := os.ReadFile("./testdata/img.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original, _, err := image.Decode(bytes.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var testTools Tools
+	testTools.ThumbnailSizes = []ImageSize{{Width: 50, Height: 50}, {Width: 120, Height: 40}}
+
+	uploadedFiles, err := testTools.UploadFiles(newUploadRequest(t, testFile{"img.png", content}), "./testdata/uploads/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].NewFileName))
+
+	variants := uploadedFiles[0].Variants
+	if len(variants) != 2 {
+		t.Fatalf("expected 2 variants got %d", len(variants))
+	}
+
+	ratio := float64(original.Bounds().Dx()) / float64(original.Bounds().Dy())
+
+	for i, path := range variants {
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		thumb, _, err := image.Decode(f)
+		f.Close()
+		_ = os.Remove(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		size := testTools.ThumbnailSizes[i]
+		w, h := thumb.Bounds().Dx(), thumb.Bounds().Dy()
+		if w > size.Width || h > size.Height {
+			t.Errorf("variant %s is %dx%d which does not fit in %dx%d", path, w, h, size.Width, size.Height)
+		}
+
+		if w != size.Width && h != size.Height {
+			t.Errorf("variant %s is %dx%d which does not fill %dx%d", path, w, h, size.Width, size.Height)
+		}
+
+		if got := float64(w) / float64(h); got < ratio*0.9 || got > ratio*1.1 {
+			t.Errorf("variant %s has aspect ratio %.2f, expected %.2f", path, got, ratio)
+		}
+	}
+}
+
+var jsonArrayLengthTests = []struct {
+	name          string
+	json          string
+	maxElements   int
+	errorExpected bool
+}{
+	{name: "unlimited", json: `{"items":[1,2,3,4,5]}`, maxElements: 0, errorExpected: false},
+	{name: "within limit", json: `{"items":[1,2,3]}`, maxElements: 3, errorExpected: false},
+	{name: "top level too long", json: `{"items":[1,2,3,4]}`, maxElements: 3, errorExpected: true},
+	{name: "nested too long", json: `{"items":[[1],[{"x":[1,2,3,4]}]]}`, maxElements: 3, errorExpected: true},
+	{name: "object keys not counted", json: `{"items":[{"a":1,"b":2,"c":3,"d":4}]}`, maxElements: 3, errorExpected: false},
+	{name: "nested arrays count once", json: `{"items":[[1,2],[3,4],[5,6]]}`, maxElements: 3, errorExpected: false},
+}
+
+func TestTools_ReadJSONFileMaxArrayElements(t *testing.T) {
+	for _, e := range jsonArrayLengthTests {
+		var testTool Tools
+		testTool.MaxJSONArrayElements = e.maxElements
+
+		var decodedJSON struct {
+			Items interface{} `json:"items"`
+		}
+
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(e.json))
+		err := testTool.ReadJSONFile(httptest.NewRecorder(), req, &decodedJSON)
+
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error received but not expected : %s", e.name, err.Error())
+		}
+	}
+}
+
+func TestTools_ListDir(t *testing.T) {
+	var testTools Tools
+
+	dir := t.TempDir()
+	_ = os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	_ = os.WriteFile(filepath.Join(dir, "a.txt"), []byte("alpha"), 0644)
+	_ = os.Symlink("/etc", filepath.Join(dir, "link"))
+
+	files, err := testTools.ListDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 3 {
+		t.Fatalf("expected 3 entries got %d", len(files))
+	}
+
+	if files[0].Name != "a.txt" || files[0].Size != 5 || files[0].IsDir {
+		t.Errorf("wrong file entry : %+v", files[0])
+	}
+
+	if files[1].Name != "link" || files[1].IsDir || !files[1].IsSymlink {
+		t.Errorf("expected symlink not to be followed : %+v", files[1])
+	}
+
+	if files[0].IsSymlink || files[2].IsSymlink {
+		t.Error("expected only the link to be marked as a symlink")
+	}
+
+	if files[2].Name != "sub" || !files[2].IsDir {
+		t.Errorf("wrong directory entry : %+v", files[2])
+	}
+
+	if _, err := testTools.ListDir(filepath.Join(dir, "missing")); err == nil {
+		t.Error("expected error for a missing directory")
+	}
+}
+
+func TestTools_ListDirHandler(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	testTools.ListDirHandler("./testdata/uploads")(rr, httptest.NewRequest("GET", "/", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("wrong status code : expected %d got %d", http.StatusOK, rr.Code)
+	}
+
+	var payload struct {
+		Data []FileInfo `json:"data"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(payload.Data) == 0 {
+		t.Error("expected directory entries in the response")
+	}
+
+	rr = httptest.NewRecorder()
+	testTools.ListDirHandler("./testdata/missing")(rr, httptest.NewRequest("GET", "/", nil))
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("wrong status code : expected %d got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestTools_ResumableUpload(t *testing.T) {
+	var testTools Tools
+	dir := t.TempDir()
+
+	send := func(method, query string, headers map[string]string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/uploads"+query, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		rr := httptest.NewRecorder()
+		testTools.ResumableUpload(rr, req, dir)
+		return rr
+	}
+
+	rr := send("POST", "", map[string]string{"Upload-Length": "10"}, "")
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("create : wrong status code : expected %d got %d", http.StatusCreated, rr.Code)
+	}
+
+	var payload struct {
+		Data struct {
+			ID string `json:"id"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+	query := "?id=" + payload.Data.ID
+
+	var steps = []struct {
+		name           string
+		method         string
+		offset         string
+		body           string
+		expectedStatus int
+		expectedOffset string
+	}{
+		{name: "initial head", method: "HEAD", expectedStatus: http.StatusOK, expectedOffset: "0"},
+		{name: "first chunk", method: "PATCH", offset: "0", body: "01234", expectedStatus: http.StatusNoContent, expectedOffset: "5"},
+		{name: "stale offset", method: "PATCH", offset: "0", body: "01234", expectedStatus: http.StatusConflict, expectedOffset: "5"},
+		{name: "resumed head", method: "HEAD", expectedStatus: http.StatusOK, expectedOffset: "5"},
+		{name: "last chunk", method: "PATCH", offset: "5", body: "56789", expectedStatus: http.StatusNoContent, expectedOffset: "10"},
+		{name: "chunk past length", method: "PATCH", offset: "10", body: "x", expectedStatus: http.StatusRequestEntityTooLarge, expectedOffset: "10"},
+	}
+
+	for _, e := range steps {
+		headers := map[string]string{}
+		if e.offset != "" {
+			headers["Upload-Offset"] = e.offset
+		}
+
+		rr := send(e.method, query, headers, e.body)
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s : wrong status code : expected %d got %d", e.name, e.expectedStatus, rr.Code)
+		}
+
+		if offset := rr.Header().Get("Upload-Offset"); offset != e.expectedOffset {
+			t.Errorf("%s : wrong offset : expected %s got %s", e.name, e.expectedOffset, offset)
+		}
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, payload.Data.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "0123456789" {
+		t.Errorf("wrong upload content : %s", string(data))
+	}
+
+	if rr := send("HEAD", "?id=../../etc/passwd", nil, ""); rr.Code != http.StatusBadRequest {
+		t.Errorf("invalid id : wrong status code : expected %d got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	if rr := send("HEAD", "?id=missing", nil, ""); rr.Code != http.StatusNotFound {
+		t.Errorf("missing upload : wrong status code : expected %d got %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+var sortTests = []struct {
+	name          string
+	query         string
+	expected      []SortField
+	errorExpected bool
+}{
+	{name: "none", query: "", expected: nil, errorExpected: false},
+	{name: "single default direction", query: "?sort=name", expected: []SortField{{Field: "name"}}, errorExpected: false},
+	{name: "multiple", query: "?sort=name:asc,created_at:DESC", expected: []SortField{{Field: "name"}, {Field: "created_at", Descending: true}}, errorExpected: false},
+	{name: "unknown field", query: "?sort=password:asc", expected: nil, errorExpected: true},
+	{name: "injection attempt", query: "?sort=name%3Bdrop%20table%20users", expected: nil, errorExpected: true},
+	{name: "bad direction", query: "?sort=name:sideways", expected: nil, errorExpected: true},
+}
+
+func TestTools_ParseSort(t *testing.T) {
+	var testTools Tools
+	allowed := map[string]bool{"name": true, "created_at": true}
+
+	for _, e := range sortTests {
+		fields, err := testTools.ParseSort(httptest.NewRequest("GET", "/"+e.query, nil), allowed)
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error received but not expected : %s", e.name, err.Error())
+		}
+
+		if len(fields) != len(e.expected) {
+			t.Errorf("%s : expected %v got %v", e.name, e.expected, fields)
+			continue
+		}
+
+		for i := range fields {
+			if fields[i] != e.expected[i] {
+				t.Errorf("%s : expected %v got %v", e.name, e.expected[i], fields[i])
+			}
+		}
+	}
+}
+
+func TestTools_IsAnimatedImage(t *testing.T) {
+	var testTools Tools
+
+	palette := color.Palette{color.Black, color.White}
+	frame := func() *image.Paletted {
+		return image.NewPaletted(image.Rect(0, 0, 4, 4), palette)
+	}
+
+	var static, animated bytes.Buffer
+	_ = gif.EncodeAll(&static, &gif.GIF{Image: []*image.Paletted{frame()}, Delay: []int{0}})
+	_ = gif.EncodeAll(&animated, &gif.GIF{Image: []*image.Paletted{frame(), frame()}, Delay: []int{10, 10}})
+
+	pngData, err := os.ReadFile("./testdata/img.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	webpChunk := func(id string, data []byte) []byte {
+		size := len(data)
+		chunk := append([]byte(id), byte(size), byte(size>>8), byte(size>>16), byte(size>>24))
+		chunk = append(chunk, data...)
+		if size%2 == 1 {
+			chunk = append(chunk, 0)
+		}
+		return chunk
+	}
+	webp := func(chunks ...[]byte) []byte {
+		body := []byte("WEBP")
+		for _, c := range chunks {
+			body = append(body, c...)
+		}
+		size := len(body)
+		return append([]byte{'R', 'I', 'F', 'F', byte(size), byte(size >> 8), byte(size >> 16), byte(size >> 24)}, body...)
+	}
+
+	var animationTests = []struct {
+		name     string
+		data     []byte
+		expected bool
+	}{
+		{name: "static gif", data: static.Bytes(), expected: false},
+		{name: "animated gif", data: animated.Bytes(), expected: true},
+		{name: "static png", data: pngData, expected: false},
+		{name: "static webp", data: webp(webpChunk("VP8 ", []byte{1, 2, 3})), expected: false},
+		{name: "animated webp flag", data: webp(webpChunk("VP8X", []byte{0x02, 0, 0, 0, 0, 0, 0, 0, 0, 0})), expected: true},
+		{name: "animated webp chunk", data: webp(webpChunk("VP8X", make([]byte, 10)), webpChunk("ANIM", make([]byte, 6))), expected: true},
+		{name: "not an image", data: []byte("hello world"), expected: false},
+	}
+
+	for _, e := range animationTests {
+		if animated := testTools.IsAnimatedImage(e.data); animated != e.expected {
+			t.Errorf("%s : expected %t got %t", e.name, e.expected, animated)
+		}
+	}
+
+	testTools.DetectAnimation = true
+	uploadedFiles, err := testTools.UploadFiles(newUploadRequest(t, testFile{"anim.gif", animated.Bytes()}), "./testdata/uploads/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Remove(fmt.Sprintf("./testdata/uploads/%s", uploadedFiles[0].NewFileName))
+
+	if !uploadedFiles[0].Animated {
+		t.Error("expected uploaded gif to be marked as animated")
+	}
+}
+
+func TestTools_TimeoutHandler(t *testing.T) {
+	var testTools Tools
+
+	fast := testTools.TimeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Test", "fast")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte("done"))
+	}), time.Second)
+
+	rr := httptest.NewRecorder()
+	fast.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	if rr.Code != http.StatusCreated || rr.Body.String() != "done" || rr.Header().Get("X-Test") != "fast" {
+		t.Errorf("wrong fast response : %d %q %v", rr.Code, rr.Body.String(), rr.Header())
+	}
+
+	writeErr := make(chan error, 1)
+	slow := testTools.TimeoutHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		_, err := w.Write([]byte("too late"))
+		writeErr <- err
+	}), 20*time.Millisecond)
+
+	rr = httptest.NewRecorder()
+	slow.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("wrong status code : expected %d got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+
+	var payload JSONResponse
+	if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil || !payload.Error {
+		t.Errorf("expected JSON error response : %v", err)
+	}
+
+	if err := <-writeErr; err != http.ErrHandlerTimeout {
+		t.Errorf("expected late write to fail with ErrHandlerTimeout got %v", err)
+	}
+}
+
+var canonicalSlugTests = []struct {
+	s        string
+	expected bool
+}{
+	{s: "now-is-the-time", expected: true},
+	{s: "now-is-the-time-123", expected: true},
+	{s: "Now-Is-The-Time", expected: false},
+	{s: "now--is-the-time", expected: false},
+	{s: "-now-is-the-time", expected: false},
+	{s: "now is the time", expected: false},
+	{s: "", expected: false},
+}
+
+func TestTools_IsCanonicalSlug(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range canonicalSlugTests {
+		if canonical := testTools.IsCanonicalSlug(e.s); canonical != e.expected {
+			t.Errorf("%q : expected %t got %t", e.s, e.expected, canonical)
+		}
+	}
+}
+
+func TestTools_WriteJSONWithWarnings(t *testing.T) {
+	var testTools Tools
+
+	rr := httptest.NewRecorder()
+	err := testTools.WriteJSONWithWarnings(rr, http.StatusOK, map[string]int{"count": 2}, []string{"field \"name\" is deprecated"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var payload JSONResponse
+	if err := json.NewDecoder(rr.Body).Decode(&payload); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload.Error || len(payload.Warnings) != 1 || payload.Data == nil {
+		t.Errorf("wrong payload : %+v", payload)
+	}
+
+	rr = httptest.NewRecorder()
+	_ = testTools.WriteJSON(rr, http.StatusOK, JSONResponse{Message: "foo"})
+
+	if strings.Contains(rr.Body.String(), "warnings") {
+		t.Errorf("expected warnings to be omitted when empty : %s", rr.Body.String())
+	}
+}
+
+func TestTools_PushJSONToRemoteInto(t *testing.T) {
+	payload := `{"name":"toolkit"}`
+
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	_, _ = gz.Write([]byte(payload))
+	_ = gz.Close()
+
+	var zlibbed bytes.Buffer
+	zw := zlib.NewWriter(&zlibbed)
+	_, _ = zw.Write([]byte(payload))
+	_ = zw.Close()
+
+	var raw bytes.Buffer
+	fw, _ := flate.NewWriter(&raw, flate.DefaultCompression)
+	_, _ = fw.Write([]byte(payload))
+	_ = fw.Close()
+
+	var large bytes.Buffer
+	gz = gzip.NewWriter(&large)
+	_, _ = gz.Write([]byte(`{"name":"` + strings.Repeat("a", 2048) + `"}`))
+	_ = gz.Close()
+
+	var pushIntoTests = []struct {
+		name          string
+		encoding      string
+		body          []byte
+		maxSize       int
+		errorExpected bool
+	}{
+		{name: "plain", encoding: "", body: []byte(payload), errorExpected: false},
+		{name: "gzip", encoding: "gzip", body: gzipped.Bytes(), errorExpected: false},
+		{name: "zlib deflate", encoding: "deflate", body: zlibbed.Bytes(), errorExpected: false},
+		{name: "raw deflate", encoding: "deflate", body: raw.Bytes(), errorExpected: false},
+		{name: "unsupported", encoding: "br", body: []byte(payload), errorExpected: true},
+		{name: "too large", encoding: "gzip", body: large.Bytes(), maxSize: 1024, errorExpected: true},
+	}
+
+	for _, e := range pushIntoTests {
+		client := NewTestClient(func(req *http.Request) *http.Response {
+			header := make(http.Header)
+			if e.encoding != "" {
+				header.Set("Content-Encoding", e.encoding)
+			}
+			return &http.Response{
+				StatusCode: 200,
+				Body:       ioutil.NopCloser(bytes.NewReader(e.body)),
+				Header:     header,
+			}
+		})
+
+		var testTools Tools
+		testTools.MaxJSONSize = e.maxSize
+
+		var into struct {
+			Name string `json:"name"`
+		}
+		status, err := testTools.PushJSONToRemoteInto("http://example.com", map[string]string{"foo": "bar"}, &into, client)
+
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+		if !e.errorExpected {
+			if err != nil {
+				t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+			}
+			if into.Name != "toolkit" {
+				t.Errorf("%s : expected name toolkit but got %q", e.name, into.Name)
+			}
+		}
+		if status != 200 {
+			t.Errorf("%s : expected status 200 but got %d", e.name, status)
+		}
+	}
+}
+
+func TestTools_UploadToTemp(t *testing.T) {
+	var testTools Tools
+
+	request := newUploadRequest(t, testFile{name: "notes.txt", content: []byte("some notes")})
+
+	files, err := testTools.UploadToTemp(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 {
+		t.Fatalf("expected 1 temp file but got %d", len(files))
+	}
+
+	f := files[0]
+	if filepath.Ext(f.Path) != ".txt" {
+		t.Errorf("expected temp file to keep its extension but got %s", f.Path)
+	}
+
+	content, err := os.ReadFile(f.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "some notes" || f.FileSize != int64(len(content)) {
+		t.Errorf("unexpected temp file content %q with size %d", content, f.FileSize)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(f.Path); !os.IsNotExist(err) {
+		t.Error("temp file still exists after Close")
+	}
+	if err := f.Close(); err != nil {
+		t.Error("second Close returned an error", err)
+	}
+
+	// a rejected file is not left behind
+	testTools.AllowedFileTypes = []string{"image/png"}
+	request = newUploadRequest(t, testFile{name: "notes.txt", content: []byte("some notes")})
+
+	files, err = testTools.UploadToTemp(request)
+	if err == nil {
+		t.Error("expected error for file type that is not permitted")
+	}
+	if files != nil {
+		t.Error("expected no temp files when the upload fails")
+	}
+}
+
+var minFileSizeTests = []struct {
+	name          string
+	minSize       int
+	content       []byte
+	errorExpected bool
+}{
+	{name: "disabled", minSize: 0, content: []byte("x"), errorExpected: false},
+	{name: "empty file", minSize: 1, content: []byte{}, errorExpected: true},
+	{name: "too small", minSize: 10, content: []byte("tiny"), errorExpected: true},
+	{name: "exactly minimum", minSize: 4, content: []byte("tiny"), errorExpected: false},
+}
+
+func TestTools_MinFileSize(t *testing.T) {
+	for _, e := range minFileSizeTests {
+		var testTools Tools
+		testTools.MinFileSize = e.minSize
+
+		request := newUploadRequest(t, testFile{name: "small.txt", content: e.content})
+
+		uploadedFiles, err := testTools.UploadFiles(request, "./testdata/uploads/", true)
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+		}
+
+		for _, f := range uploadedFiles {
+			_ = os.Remove(filepath.Join("./testdata/uploads/", f.NewFileName))
+		}
+	}
+}
+
+func TestTools_MultipartMemoryLimit(t *testing.T) {
+	var testTools Tools
+	testTools.MultipartMemoryLimit = 1
+
+	request := newUploadRequest(t, testFile{name: "notes.txt", content: []byte(strings.Repeat("a", 4096))})
+
+	files, err := testTools.UploadToTemp(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		_ = f.Close()
+	}
+
+	// with a tiny memory limit the file part is stored on disk rather than in memory
+	infile, err := request.MultipartForm.File["file"][0].Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer infile.Close()
+
+	if _, ok := infile.(*os.File); !ok {
+		t.Error("expected file part to be stored on disk")
+	}
+
+	_ = request.MultipartForm.RemoveAll()
+}
+
+var verifyChecksumTests = []struct {
+	name          string
+	expected      string
+	match         bool
+	errorExpected bool
+}{
+	{name: "matching", expected: "dffd6021bb2bd5b0af676290809ec3a53191dd81c7f70a4b28688a362182986f", match: true, errorExpected: false},
+	{name: "upper case", expected: "DFFD6021BB2BD5B0AF676290809EC3A53191DD81C7F70A4B28688A362182986F", match: true, errorExpected: false},
+	{name: "different", expected: "0000000000000000000000000000000000000000000000000000000000000000", match: false, errorExpected: false},
+	{name: "not hex", expected: "not a checksum", match: false, errorExpected: true},
+}
+
+func TestTools_VerifyChecksum(t *testing.T) {
+	var testTools Tools
+
+	path := filepath.Join(t.TempDir(), "hello.txt")
+	if err := os.WriteFile(path, []byte("Hello, World!"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, e := range verifyChecksumTests {
+		match, err := testTools.VerifyChecksum(path, e.expected, sha256.New())
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+		}
+		if match != e.match {
+			t.Errorf("%s : expected match %t but got %t", e.name, e.match, match)
+		}
+	}
+
+	if _, err := testTools.VerifyChecksum("./testdata/missing.txt", verifyChecksumTests[0].expected, nil); err == nil {
+		t.Error("expected error for missing file")
+	}
+}
+
+func signTestJWT(header, claims, secret string) string {
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestTools_ParseHMACJWT(t *testing.T) {
+	hs256 := `{"alg":"HS256","typ":"JWT"}`
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Hour).Unix()
+
+	var jwtTests = []struct {
+		name        string
+		token       string
+		expectedErr error
+	}{
+		{name: "valid", token: signTestJWT(hs256, fmt.Sprintf(`{"sub":"42","exp":%d,"nbf":%d}`, future, past), "secret"), expectedErr: nil},
+		{name: "no exp", token: signTestJWT(hs256, `{"sub":"42"}`, "secret"), expectedErr: nil},
+		{name: "wrong secret", token: signTestJWT(hs256, `{"sub":"42"}`, "other"), expectedErr: ErrInvalidJWTSignature},
+		{name: "expired", token: signTestJWT(hs256, fmt.Sprintf(`{"sub":"42","exp":%d}`, past), "secret"), expectedErr: ErrJWTExpired},
+		{name: "not yet valid", token: signTestJWT(hs256, fmt.Sprintf(`{"sub":"42","nbf":%d}`, future), "secret"), expectedErr: ErrJWTNotYetValid},
+		{name: "alg none", token: signTestJWT(`{"alg":"none"}`, `{"sub":"42"}`, "secret"), expectedErr: ErrInvalidJWT},
+		{name: "two parts", token: "abc.def", expectedErr: ErrInvalidJWT},
+		{name: "bad claims", token: signTestJWT(hs256, `not json`, "secret"), expectedErr: ErrInvalidJWT},
+	}
+
+	var testTools Tools
+
+	for _, e := range jwtTests {
+		claims, err := testTools.ParseHMACJWT(e.token, "secret")
+		if e.expectedErr == nil {
+			if err != nil {
+				t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+			} else if claims["sub"] != "42" {
+				t.Errorf("%s : expected sub claim 42 but got %v", e.name, claims["sub"])
+			}
+			continue
+		}
+
+		if !errors.Is(err, e.expectedErr) {
+			t.Errorf("%s : expected error %v but got %v", e.name, e.expectedErr, err)
+		}
+	}
+}
+
+func TestTools_ProcessJSONArray(t *testing.T) {
+	var testTools Tools
+
+	var mu sync.Mutex
+	sum := 0
+	err := testTools.ProcessJSONArray(strings.NewReader(`[1, 2, 3, 4, 5, 6, 7, 8, 9, 10]`), 3, func(raw json.RawMessage) error {
+		var n int
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return err
+		}
+		mu.Lock()
+		sum += n
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sum != 55 {
+		t.Errorf("expected sum of 55 but got %d", sum)
+	}
+
+	// the first error from fn is returned
+	stop := errors.New("stop")
+	err = testTools.ProcessJSONArray(strings.NewReader(`[1, 2, 3, 4, 5, 6, 7, 8, 9, 10]`), 2, func(raw json.RawMessage) error {
+		if string(raw) == "3" {
+			return stop
+		}
+		return nil
+	})
+	if !errors.Is(err, stop) {
+		t.Errorf("expected error from fn but got %v", err)
+	}
+
+	// malformed json is reported
+	err = testTools.ProcessJSONArray(strings.NewReader(`[1, 2,`), 2, func(raw json.RawMessage) error { return nil })
+	if err == nil {
+		t.Error("expected error for malformed JSON")
+	}
+
+	// the total size is limited by MaxJSONSize
+	testTools.MaxJSONSize = 16
+	err = testTools.ProcessJSONArray(strings.NewReader(`["`+strings.Repeat("a", 32)+`"]`), 2, func(raw json.RawMessage) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "must not be larger than") {
+		t.Errorf("expected size error but got %v", err)
+	}
+}
+
+var normalizeUsernameTests = []struct {
+	name          string
+	input         string
+	opts          UsernameOptions
+	expected      string
+	errorExpected bool
+}{
+	{name: "unchanged", input: "alice", opts: UsernameOptions{}, expected: "alice", errorExpected: false},
+	{name: "lowercase", input: "  Alice  ", opts: UsernameOptions{Lowercase: true}, expected: "alice", errorExpected: false},
+	{name: "keep case", input: "Alice", opts: UsernameOptions{}, expected: "Alice", errorExpected: false},
+	{name: "strip disallowed", input: "al!ce@home", opts: UsernameOptions{}, expected: "alcehome", errorExpected: false},
+	{name: "allowed symbols", input: "_alice.smith_", opts: UsernameOptions{AllowedSymbols: "_."}, expected: "alice.smith", errorExpected: false},
+	{name: "too short", input: "a!b", opts: UsernameOptions{}, errorExpected: true},
+	{name: "too long", input: "abcdefghijk", opts: UsernameOptions{MaxLength: 10}, errorExpected: true},
+	{name: "custom minimum", input: "ab", opts: UsernameOptions{MinLength: 2}, expected: "ab", errorExpected: false},
+	{name: "reserved", input: "Admin", opts: UsernameOptions{Reserved: []string{"admin", "root"}}, errorExpected: true},
+	{name: "homoglyph", input: "\u0430dmin", opts: UsernameOptions{Reserved: []string{"admin"}}, errorExpected: true},
+	{name: "precomposed accent", input: "jos\u00e9", opts: UsernameOptions{}, errorExpected: true},
+	{name: "combining accent", input: "jose\u0301", opts: UsernameOptions{}, errorExpected: true},
+	{name: "strip emoji", input: "alice\U0001F600", opts: UsernameOptions{}, expected: "alice", errorExpected: false},
+}
+
+func TestTools_NormalizeUsername(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range normalizeUsernameTests {
+		username, err := testTools.NormalizeUsername(e.input, e.opts)
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+		if !e.errorExpected {
+			if err != nil {
+				t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+			}
+			if username != e.expected {
+				t.Errorf("%s : expected %q but got %q", e.name, e.expected, username)
+			}
+		}
+	}
+}
+
+var writeRedirectTests = []struct {
+	name          string
+	url           string
+	status        int
+	location      string
+	errorExpected bool
+}{
+	{name: "found", url: "https://example.com/new", status: http.StatusFound, location: "https://example.com/new", errorExpected: false},
+	{name: "permanent", url: "/new", status: http.StatusMovedPermanently, location: "/new", errorExpected: false},
+	{name: "temporary", url: "/new", status: http.StatusTemporaryRedirect, location: "/new", errorExpected: false},
+	{name: "not a redirect", url: "/new", status: http.StatusOK, errorExpected: true},
+	{name: "empty url", url: "", status: http.StatusFound, errorExpected: true},
+}
+
+func TestTools_WriteRedirect(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range writeRedirectTests {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/old", nil)
+
+		err := testTools.WriteRedirect(rr, req, e.url, e.status)
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s : error expected but not received", e.name)
+			}
+			if rr.Header().Get("Location") != "" {
+				t.Errorf("%s : expected no Location header but got %s", e.name, rr.Header().Get("Location"))
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+		}
+		if rr.Code != e.status {
+			t.Errorf("%s : expected status %d but got %d", e.name, e.status, rr.Code)
+		}
+		if rr.Header().Get("Location") != e.location {
+			t.Errorf("%s : expected Location %s but got %s", e.name, e.location, rr.Header().Get("Location"))
+		}
+	}
+}
+
+func TestTools_ReadBody(t *testing.T) {
+	type signup struct {
+		Name   string   `json:"name"`
+		Age    int      `form:"age"`
+		Agree  bool     `json:"agree,omitempty"`
+		Tags   []string `form:"tag"`
+		Secret string   `json:"-"`
+	}
+
+	multipartBody := new(bytes.Buffer)
+	mw := multipart.NewWriter(multipartBody)
+	_ = mw.WriteField("name", "Jane")
+	_ = mw.WriteField("age", "42")
+	_ = mw.WriteField("agree", "true")
+	_ = mw.WriteField("tag", "a")
+	_ = mw.WriteField("tag", "b")
+	_ = mw.Close()
+
+	var readBodyTests = []struct {
+		name          string
+		contentType   string
+		body          string
+		errorExpected bool
+		unsupported   bool
+	}{
+		{name: "json", contentType: "application/json", body: `{"name":"Jane","age":42,"agree":true,"tags":["a","b"]}`, errorExpected: false},
+		{name: "url encoded", contentType: "application/x-www-form-urlencoded", body: "name=Jane&age=42&agree=true&tag=a&tag=b&Secret=x", errorExpected: false},
+		{name: "multipart", contentType: mw.FormDataContentType(), body: multipartBody.String(), errorExpected: false},
+		{name: "bad number", contentType: "application/x-www-form-urlencoded", body: "name=Jane&age=old", errorExpected: true},
+		{name: "xml", contentType: "application/xml", body: "<name>Jane</name>", errorExpected: true, unsupported: true},
+		{name: "no content type", contentType: "", body: "name=Jane", errorExpected: true, unsupported: true},
+	}
+
+	var testTools Tools
+
+	for _, e := range readBodyTests {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(e.body))
+		if e.contentType != "" {
+			req.Header.Set("Content-Type", e.contentType)
+		}
+		rr := httptest.NewRecorder()
+
+		var dst signup
+		err := testTools.ReadBody(rr, req, &dst)
+
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s : error expected but not received", e.name)
+			}
+			if e.unsupported && !errors.Is(err, ErrUnsupportedMediaType) {
+				t.Errorf("%s : expected ErrUnsupportedMediaType but got %v", e.name, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+			continue
+		}
+
+		if dst.Name != "Jane" || dst.Age != 42 || !dst.Agree {
+			t.Errorf("%s : unexpected result %+v", e.name, dst)
+		}
+		if e.name != "json" && (len(dst.Tags) != 2 || dst.Tags[1] != "b") {
+			t.Errorf("%s : expected tags to be decoded but got %v", e.name, dst.Tags)
+		}
+		if dst.Secret != "" {
+			t.Errorf("%s : expected ignored field to be left alone but got %q", e.name, dst.Secret)
+		}
+	}
+}
+
+func TestTools_EncodeCursor(t *testing.T) {
+	var testTools Tools
+	testTools.CursorSecret = "secret"
+
+	type cursor struct {
+		LastID string `json:"last_id"`
+		Limit  int    `json:"limit"`
+	}
+
+	encoded, err := testTools.EncodeCursor(cursor{LastID: "abc123", Limit: 20})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded cursor
+	if err := testTools.DecodeCursor(encoded, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.LastID != "abc123" || decoded.Limit != 20 {
+		t.Errorf("unexpected decoded cursor %+v", decoded)
+	}
+
+	// tamper with the payload but keep the signature
+	payload, _ := json.Marshal(cursor{LastID: "zzz", Limit: 1000})
+	tampered := base64.RawURLEncoding.EncodeToString(payload) + encoded[strings.Index(encoded, "."):]
+
+	var cursorTests = []struct {
+		name   string
+		cursor string
+	}{
+		{name: "tampered", cursor: tampered},
+		{name: "no signature", cursor: strings.Split(encoded, ".")[0]},
+		{name: "garbage", cursor: "not.a-cursor"},
+	}
+
+	for _, e := range cursorTests {
+		if err := testTools.DecodeCursor(e.cursor, &decoded); err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+	}
+
+	// a different secret does not accept the cursor
+	other := Tools{CursorSecret: "other"}
+	if err := other.DecodeCursor(encoded, &decoded); err == nil {
+		t.Error("expected error decoding cursor with a different secret")
+	}
+
+	var noSecret Tools
+	if _, err := noSecret.EncodeCursor(cursor{}); err == nil {
+		t.Error("expected error encoding cursor without a secret")
+	}
+}
+
+func TestUnique(t *testing.T) {
+	items := []string{"b", "a", "b", "c", "a"}
+
+	unique := Unique(items)
+	if strings.Join(unique, ",") != "b,a,c" {
+		t.Errorf("wrong unique elements : %v", unique)
+	}
+	if strings.Join(items, ",") != "b,a,b,c,a" {
+		t.Errorf("input was modified : %v", items)
+	}
+
+	if unique := Unique([]int{7, 7, 7}); len(unique) != 1 || unique[0] != 7 {
+		t.Errorf("expected a single element for all duplicates : %v", unique)
+	}
+
+	if unique := Unique([]int{}); unique != nil {
+		t.Errorf("expected nil for empty slice : %v", unique)
+	}
+}
+
+var dateRangeTests = []struct {
+	name          string
+	query         string
+	defaultRange  time.Duration
+	from          string
+	to            string
+	errorExpected bool
+}{
+	{name: "valid", query: "from=2024-01-01&to=2024-01-31", from: "2024-01-01", to: "2024-01-31", errorExpected: false},
+	{name: "same day", query: "from=2024-01-01&to=2024-01-01", from: "2024-01-01", to: "2024-01-01", errorExpected: false},
+	{name: "inverted", query: "from=2024-02-01&to=2024-01-01", errorExpected: true},
+	{name: "invalid from", query: "from=01/01/2024&to=2024-01-31", errorExpected: true},
+	{name: "invalid to", query: "from=2024-01-01&to=soon", errorExpected: true},
+	{name: "missing", query: "from=2024-01-01", errorExpected: true},
+	{name: "default from", query: "to=2024-01-31", defaultRange: 7 * 24 * time.Hour, from: "2024-01-24", to: "2024-01-31", errorExpected: false},
+}
+
+func TestTools_ReadDateRange(t *testing.T) {
+	for _, e := range dateRangeTests {
+		var testTools Tools
+		testTools.DefaultDateRange = e.defaultRange
+
+		req := httptest.NewRequest("GET", "/report?"+e.query, nil)
+
+		from, to, err := testTools.ReadDateRange(req, "2006-01-02")
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+		if !e.errorExpected {
+			if err != nil {
+				t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+			}
+			if from.Format("2006-01-02") != e.from || to.Format("2006-01-02") != e.to {
+				t.Errorf("%s : expected %s to %s but got %s to %s", e.name, e.from, e.to, from.Format("2006-01-02"), to.Format("2006-01-02"))
+			}
+		}
+	}
+
+	// with a default range, a missing to is now
+	testTools := Tools{DefaultDateRange: time.Hour}
+	from, to, err := testTools.ReadDateRange(httptest.NewRequest("GET", "/report", nil), time.RFC3339)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(to) > time.Minute || to.Sub(from) != time.Hour {
+		t.Errorf("unexpected default range %s to %s", from, to)
+	}
+}
+
+func TestTools_ErrorHTML(t *testing.T) {
+	var testTools Tools
+
+	attack := errors.New(`<script>alert("x")</script>`)
+
+	rr := httptest.NewRecorder()
+	if err := testTools.ErrorHTML(rr, attack, http.StatusNotFound); err != nil {
+		t.Fatal(err)
+	}
+
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected status 404 but got %d", rr.Code)
+	}
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/html") {
+		t.Errorf("expected html content type but got %s", rr.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rr.Body.String(), "404 Not Found") {
+		t.Error("expected status text in page")
+	}
+	if strings.Contains(rr.Body.String(), "alert") {
+		t.Error("error should not be shown unless DebugErrors is set")
+	}
+
+	// in debug mode the error is shown, escaped
+	testTools.DebugErrors = true
+	rr = httptest.NewRecorder()
+	_ = testTools.ErrorHTML(rr, attack, http.StatusInternalServerError)
+
+	if strings.Contains(rr.Body.String(), "<script>") {
+		t.Error("error was not html escaped")
+	}
+	if !strings.Contains(rr.Body.String(), "&lt;script&gt;") {
+		t.Error("expected escaped error in debug mode")
+	}
+}
+
+func TestTools_CompressUploads(t *testing.T) {
+	var testTools Tools
+	testTools.CompressUploads = true
+
+	content := []byte(strings.Repeat("GET /index.html 200\n", 500))
+	request := newUploadRequest(t, testFile{name: "access.log", content: content})
+
+	uploadedFiles, err := testTools.UploadFiles(request, "./testdata/uploads/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f := uploadedFiles[0]
+	path := filepath.Join("./testdata/uploads/", f.NewFileName)
+	defer os.Remove(path)
+
+	if !strings.HasSuffix(f.NewFileName, ".log.gz") {
+		t.Errorf("expected stored file name to end in .log.gz but got %s", f.NewFileName)
+	}
+	if f.FileSize != int64(len(content)) {
+		t.Errorf("expected original size %d but got %d", len(content), f.FileSize)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.CompressedSize != info.Size() || f.CompressedSize >= f.FileSize {
+		t.Errorf("unexpected compressed size %d for stored file of %d bytes", f.CompressedSize, info.Size())
+	}
+
+	stored, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stored.Close()
+
+	gz, err := gzip.NewReader(stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	decompressed, err := io.ReadAll(gz)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decompressed, content) {
+		t.Error("decompressed file does not match the upload")
+	}
+}
+
+var pdfUploadTests = []struct {
+	name          string
+	content       string
+	errorExpected bool
+}{
+	{name: "valid", content: "%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\ntrailer\n<< /Root 1 0 R >>\nstartxref\n9\n%%EOF\n", errorExpected: false},
+	{name: "truncated", content: "%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\n", errorExpected: true},
+	{name: "encrypted", content: "%PDF-1.4\n1 0 obj\n<< /Type /Catalog >>\nendobj\ntrailer\n<< /Root 1 0 R /Encrypt 2 0 R >>\nstartxref\n9\n%%EOF\n", errorExpected: true},
+}
+
+func TestTools_ValidatePDFUploads(t *testing.T) {
+	for _, e := range pdfUploadTests {
+		var testTools Tools
+		testTools.ValidatePDFUploads = true
+
+		request := newUploadRequest(t, testFile{name: "doc.pdf", content: []byte(e.content)})
+
+		uploadedFiles, err := testTools.UploadFiles(request, "./testdata/uploads/", true)
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+		}
+
+		for _, f := range uploadedFiles {
+			_ = os.Remove(filepath.Join("./testdata/uploads/", f.NewFileName))
+		}
+	}
+}
+
+var slugifySEOTests = []struct {
+	name          string
+	s             string
+	stopWords     []string
+	expected      string
+	errorExpected bool
+}{
+	{name: "default stop words", s: "The History of the World", expected: "history-world", errorExpected: false},
+	{name: "punctuation", s: "A Guide to Go: Tips & Tricks!", expected: "guide-go-tips-tricks", errorExpected: false},
+	{name: "custom stop words", s: "The History of the World", stopWords: []string{"history"}, expected: "the-of-the-world", errorExpected: false},
+	{name: "no stop words", s: "The History of the World", stopWords: []string{}, expected: "the-history-of-the-world", errorExpected: false},
+	{name: "only stop words", s: "Of The", expected: "of-the", errorExpected: false},
+	{name: "empty", s: "", errorExpected: true},
+}
+
+func TestTools_SlugifySEO(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range slugifySEOTests {
+		slug, err := testTools.SlugifySEO(e.s, e.stopWords)
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+		if !e.errorExpected {
+			if err != nil {
+				t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+			}
+			if slug != e.expected {
+				t.Errorf("%s : expected %q but got %q", e.name, e.expected, slug)
+			}
+		}
+	}
+}
+
+func TestTools_PushJSONToMany(t *testing.T) {
+	var mu sync.Mutex
+	active, maxActive := 0, 0
+
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+
+		time.Sleep(10 * time.Millisecond)
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+
+		status := http.StatusOK
+		if req.URL.Host == "down.example.com" {
+			status = http.StatusBadGateway
+		}
+		return &http.Response{
+			StatusCode: status,
+			Body:       ioutil.NopCloser(bytes.NewBufferString("OK")),
+			Header:     make(http.Header),
+		}
+	})
+
+	urls := []string{
+		"http://one.example.com",
+		"http://down.example.com",
+		"http://three.example.com",
+		"http://four.example.com",
+		"http://five.example.com",
+		"::not a url",
+	}
+
+	var testTools Tools
+	results := testTools.PushJSONToMany(urls, map[string]string{"event": "ping"}, 2, client)
+
+	if len(results) != len(urls) {
+		t.Fatalf("expected %d results but got %d", len(urls), len(results))
+	}
+	for i, res := range results {
+		if res.URL != urls[i] {
+			t.Errorf("expected result %d for %s but got %s", i, urls[i], res.URL)
+		}
+	}
+
+	if results[0].StatusCode != http.StatusOK || results[0].Err != nil {
+		t.Errorf("unexpected result for working url: %+v", results[0])
+	}
+	if results[1].StatusCode != http.StatusBadGateway {
+		t.Errorf("expected status 502 for failing url but got %d", results[1].StatusCode)
+	}
+	if results[5].Err == nil {
+		t.Error("expected error for invalid url")
+	}
+
+	if maxActive > 2 {
+		t.Errorf("expected at most 2 concurrent pushes but got %d", maxActive)
+	}
+}
+
+func TestTools_PreventOverwrite(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "report.txt"), []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// by default the existing file is replaced
+	var testTools Tools
+	request := newUploadRequest(t, testFile{name: "report.txt", content: []byte("first")})
+	if _, err := testTools.UploadFiles(request, dir, false); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "report.txt")); string(content) != "first" {
+		t.Errorf("expected file to be overwritten but it contains %q", content)
+	}
+
+	// with PreventOverwrite the upload is rejected
+	testTools.PreventOverwrite = true
+	request = newUploadRequest(t, testFile{name: "report.txt", content: []byte("second")})
+	if _, err := testTools.UploadFiles(request, dir, false); err == nil {
+		t.Error("expected error uploading over an existing file")
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "report.txt")); string(content) != "first" {
+		t.Errorf("expected existing file to be kept but it contains %q", content)
+	}
+
+	// with OverwriteRename a numeric suffix is added
+	testTools.OverwriteMode = OverwriteRename
+	for _, expected := range []string{"report-1.txt", "report-2.txt"} {
+		request = newUploadRequest(t, testFile{name: "report.txt", content: []byte("third")})
+		uploadedFiles, err := testTools.UploadFiles(request, dir, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uploadedFiles[0].NewFileName != expected {
+			t.Errorf("expected new file name %s but got %s", expected, uploadedFiles[0].NewFileName)
+		}
+		if _, err := os.Stat(filepath.Join(dir, expected)); err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestTools_TrimStringFields(t *testing.T) {
+	type address struct {
+		City string `json:"city"`
+	}
+	type signup struct {
+		Name     string            `json:"name"`
+		Password string            `json:"password" trim:"-"`
+		Tags     []string          `json:"tags"`
+		Address  address           `json:"address"`
+		Previous *address          `json:"previous"`
+		Labels   map[string]string `json:"labels"`
+		Age      int               `json:"age"`
+	}
+
+	body := `{"name":"  Jane ","password":" secret ","tags":[" a","b "],"address":{"city":" Paris "},` +
+		`"previous":{"city":"\tLyon\n"},"labels":{"team":" blue "},"age":42}`
+
+	var testTools Tools
+	testTools.TrimStringFields = true
+
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	rr := httptest.NewRecorder()
+
+	var dst signup
+	if err := testTools.ReadJSONFile(rr, req, &dst); err != nil {
+		t.Fatal(err)
+	}
+
+	if dst.Name != "Jane" {
+		t.Errorf("expected name to be trimmed but got %q", dst.Name)
+	}
+	if dst.Password != " secret " {
+		t.Errorf("expected opted out field to be left alone but got %q", dst.Password)
+	}
+	if dst.Tags[0] != "a" || dst.Tags[1] != "b" {
+		t.Errorf("expected tags to be trimmed but got %q", dst.Tags)
+	}
+	if dst.Address.City != "Paris" || dst.Previous.City != "Lyon" {
+		t.Errorf("expected nested strings to be trimmed but got %q and %q", dst.Address.City, dst.Previous.City)
+	}
+	if dst.Labels["team"] != "blue" {
+		t.Errorf("expected map values to be trimmed but got %q", dst.Labels["team"])
+	}
+	if dst.Age != 42 {
+		t.Errorf("expected age 42 but got %d", dst.Age)
+	}
+}
+
+var spaTests = []struct {
+	name           string
+	path           string
+	expectedStatus int
+	expectedBody   string
+}{
+	{name: "root", path: "/", expectedStatus: http.StatusOK, expectedBody: "<app>"},
+	{name: "asset", path: "/assets/app.js", expectedStatus: http.StatusOK, expectedBody: "console.log(1)"},
+	{name: "client route", path: "/users/42/settings", expectedStatus: http.StatusOK, expectedBody: "<app>"},
+	{name: "index", path: "/index.html", expectedStatus: http.StatusOK, expectedBody: "<app>"},
+	{name: "missing asset", path: "/assets/old.js", expectedStatus: http.StatusNotFound},
+	{name: "traversal", path: "/../secret.txt", expectedStatus: http.StatusNotFound},
+	{name: "encoded traversal", path: "/%2e%2e/secret.txt", expectedStatus: http.StatusNotFound},
+}
+
+func TestTools_SPAHandler(t *testing.T) {
+	root := t.TempDir()
+	staticDir := filepath.Join(root, "public")
+	if err := os.MkdirAll(filepath.Join(staticDir, "assets"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.WriteFile(filepath.Join(staticDir, "index.html"), []byte("<app>"), 0644)
+	_ = os.WriteFile(filepath.Join(staticDir, "assets", "app.js"), []byte("console.log(1)"), 0644)
+	_ = os.WriteFile(filepath.Join(root, "secret.txt"), []byte("secret"), 0644)
+
+	var testTools Tools
+	handler := testTools.SPAHandler(staticDir, "index.html")
+
+	for _, e := range spaTests {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("GET", "/", nil)
+		req.URL.Path = e.path
+		if u, err := req.URL.Parse(e.path); err == nil {
+			req.URL = u
+		}
+
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s : expected status %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+		if e.expectedBody != "" && rr.Body.String() != e.expectedBody {
+			t.Errorf("%s : expected body %q but got %q", e.name, e.expectedBody, rr.Body.String())
+		}
+		if strings.Contains(rr.Body.String(), "secret") {
+			t.Errorf("%s : file outside the static directory was served", e.name)
+		}
+	}
+}
+
+func TestTools_JSONSize(t *testing.T) {
+	var testTools Tools
+
+	payload := JSONResponse{Message: "hello"}
+
+	size, out, err := testTools.JSONSize(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	_ = testTools.WriteJSON(rr, http.StatusOK, payload)
+
+	if size != rr.Body.Len() || size != len(out) {
+		t.Errorf("expected size %d but got %d", rr.Body.Len(), size)
+	}
+	if !bytes.Equal(out, rr.Body.Bytes()) {
+		t.Errorf("expected marshalled json %s but got %s", rr.Body.String(), out)
+	}
+
+	if _, _, err := testTools.JSONSize(make(chan int)); err == nil {
+		t.Error("expected error for value that cannot be marshalled")
+	}
+}
+
+var duplicateKeyTests = []struct {
+	name          string
+	json          string
+	errorExpected bool
+}{
+	{name: "no duplicates", json: `{"foo":"bar","baz":1}`, errorExpected: false},
+	{name: "duplicate", json: `{"foo":"bar","foo":"baz"}`, errorExpected: true},
+	{name: "same key in different objects", json: `{"a":{"foo":1},"b":{"foo":2},"foo":3}`, errorExpected: false},
+	{name: "nested duplicate", json: `{"a":{"foo":1,"foo":2}}`, errorExpected: true},
+	{name: "duplicate after nested object", json: `{"a":{"b":[1,{"c":2}]},"a":3}`, errorExpected: true},
+	{name: "duplicate in array element", json: `{"items":[{"id":1},{"id":2,"id":3}]}`, errorExpected: true},
+	{name: "value looks like key", json: `{"foo":"foo","bar":"foo"}`, errorExpected: false},
+}
+
+func TestTools_RejectDuplicateJSONKeys(t *testing.T) {
+	var testTools Tools
+	testTools.RejectDuplicateJSONKeys = true
+	testTools.AllowUnknownFields = true
+
+	for _, e := range duplicateKeyTests {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(e.json))
+		rr := httptest.NewRecorder()
+
+		var decoded map[string]interface{}
+		err := testTools.ReadJSONFile(rr, req, &decoded)
+
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+		}
+	}
+
+	// the offending key is named in the error
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"role":"user","role":"admin"}`))
+	var decoded map[string]interface{}
+	err := testTools.ReadJSONFile(httptest.NewRecorder(), req, &decoded)
+	if err == nil || !strings.Contains(err.Error(), `"role"`) {
+		t.Errorf("expected error naming the duplicate key but got %v", err)
+	}
+}
+
+func TestTools_BufferedResponseWriter(t *testing.T) {
+	var testTools Tools
+
+	// a small body stays in memory
+	rr := httptest.NewRecorder()
+	bw := testTools.NewBufferedResponseWriter(rr, 64)
+	bw.Header().Set("Content-Type", "text/csv")
+	bw.WriteHeader(http.StatusCreated)
+	_, _ = io.WriteString(bw, "a,b\n")
+
+	if rr.Body.Len() != 0 {
+		t.Error("expected nothing to be sent before Close")
+	}
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusCreated || rr.Body.String() != "a,b\n" || rr.Header().Get("Content-Length") != "4" {
+		t.Errorf("unexpected response %d %q with length %s", rr.Code, rr.Body.String(), rr.Header().Get("Content-Length"))
+	}
+
+	// a large body spills to a temporary file, which is removed on Close
+	rr = httptest.NewRecorder()
+	bw = testTools.NewBufferedResponseWriter(rr, 64)
+	expected := ""
+	for i := 0; i < 100; i++ {
+		line := fmt.Sprintf("row %d\n", i)
+		expected += line
+		_, _ = io.WriteString(bw, line)
+	}
+
+	if bw.file == nil {
+		t.Fatal("expected body to spill to a temporary file")
+	}
+	tempName := bw.file.Name()
+
+	if err := bw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if rr.Code != http.StatusOK || rr.Body.String() != expected {
+		t.Errorf("unexpected response %d with %d bytes", rr.Code, rr.Body.Len())
+	}
+	if _, err := os.Stat(tempName); !os.IsNotExist(err) {
+		t.Error("temporary file was not removed on Close")
+	}
+
+	// Discard removes the temporary file without sending anything
+	rr = httptest.NewRecorder()
+	bw = testTools.NewBufferedResponseWriter(rr, 8)
+	_, _ = io.WriteString(bw, "more than eight bytes")
+	tempName = bw.file.Name()
+
+	if err := bw.Discard(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tempName); !os.IsNotExist(err) {
+		t.Error("temporary file was not removed on Discard")
+	}
+	if err := bw.Close(); err != nil || rr.Body.Len() != 0 {
+		t.Error("expected Close after Discard to do nothing")
+	}
+	if _, err := io.WriteString(bw, "late"); err == nil {
+		t.Error("expected error writing after Discard")
+	}
+}
+
+func TestTools_DetectCharset(t *testing.T) {
+	utf16le := []byte{'h', 0, 'i', 0, ' ', 0, 't', 0, 'h', 0, 'e', 0, 'r', 0, 'e', 0}
+	utf16be := []byte{0, 'h', 0, 'i', 0, ' ', 0, 't', 0, 'h', 0, 'e', 0, 'r', 0, 'e'}
+
+	var charsetTests = []struct {
+		name          string
+		sample        []byte
+		expected      string
+		text          string
+		errorExpected bool
+	}{
+		{name: "ascii", sample: []byte("hello there"), expected: "utf-8", text: "hello there"},
+		{name: "utf-8", sample: []byte("café crème"), expected: "utf-8", text: "café crème"},
+		{name: "utf-8 bom", sample: append([]byte{0xEF, 0xBB, 0xBF}, "café"...), expected: "utf-8", text: "café"},
+		{name: "latin-1", sample: []byte{'c', 'a', 'f', 0xE9}, expected: "iso-8859-1", text: "café"},
+		{name: "utf-16le bom", sample: append([]byte{0xFF, 0xFE}, utf16le...), expected: "utf-16le", text: "hi there"},
+		{name: "utf-16be bom", sample: append([]byte{0xFE, 0xFF}, utf16be...), expected: "utf-16be", text: "hi there"},
+		{name: "utf-16le", sample: utf16le, expected: "utf-16le", text: "hi there"},
+		{name: "utf-16be", sample: utf16be, expected: "utf-16be", text: "hi there"},
+		{name: "binary", sample: []byte{0x89, 'P', 'N', 'G', 0, 0, 0, 0x0D, 'I', 'H', 'D', 'R', 0, 0, 1, 0}, errorExpected: true},
+		{name: "empty", sample: []byte{}, errorExpected: true},
+	}
+
+	var testTools Tools
+
+	for _, e := range charsetTests {
+		charset, err := testTools.DetectCharset(e.sample)
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s : error expected but not received", e.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+			continue
+		}
+		if charset != e.expected {
+			t.Errorf("%s : expected %s but got %s", e.name, e.expected, charset)
+		}
+
+		if e.text != "" {
+			text, err := testTools.TranscodeToUTF8(e.sample, charset)
+			if err != nil {
+				t.Errorf("%s : error transcoding: %s", e.name, err.Error())
+			}
+			if string(text) != e.text {
+				t.Errorf("%s : expected transcoded text %q but got %q", e.name, e.text, text)
+			}
+		}
+	}
+
+	if _, err := testTools.TranscodeToUTF8([]byte("x"), "ebcdic"); err == nil {
+		t.Error("expected error for unsupported charset")
+	}
+}
+
+func TestTools_DetectUploadCharset(t *testing.T) {
+	var testTools Tools
+	testTools.DetectUploadCharset = true
+
+	request := newUploadRequest(t, testFile{name: "notes.txt", content: []byte{'c', 'a', 'f', 0xE9, ' ', 'a', 'u', ' ', 'l', 'a', 'i', 't'}})
+
+	uploadedFiles, err := testTools.UploadFiles(request, "./testdata/uploads/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filepath.Join("./testdata/uploads/", uploadedFiles[0].NewFileName))
+
+	if uploadedFiles[0].Charset != "iso-8859-1" {
+		t.Errorf("expected charset iso-8859-1 but got %q", uploadedFiles[0].Charset)
+	}
+
+	// a sample that ends part way through a character is still UTF-8
+	request = newUploadRequest(t, testFile{name: "long.txt", content: []byte(strings.Repeat("a", 4095) + "é")})
+
+	uploadedFiles, err = testTools.UploadFiles(request, "./testdata/uploads/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(filepath.Join("./testdata/uploads/", uploadedFiles[0].NewFileName))
+
+	if uploadedFiles[0].Charset != "utf-8" {
+		t.Errorf("expected charset utf-8 but got %q", uploadedFiles[0].Charset)
+	}
+}
+
+func TestTools_UploadIdleTimeout(t *testing.T) {
+	pr, pw := io.Pipe()
+	defer pw.Close()
+
+	writer := multipart.NewWriter(pw)
+	go func() {
+		part, _ := writer.CreateFormFile("file", "slow.txt")
+		_, _ = part.Write([]byte("the first few bytes"))
+		// then stall without finishing the upload
+	}()
+
+	request := httptest.NewRequest("POST", "/", pr)
+	request.Header.Set("Content-Type", writer.FormDataContentType())
+
+	var testTools Tools
+	testTools.UploadIdleTimeout = 50 * time.Millisecond
+
+	start := time.Now()
+	_, err := testTools.UploadFiles(request, "./testdata/uploads/", true)
+	if !errors.Is(err, ErrUploadTimeout) {
+		t.Errorf("expected ErrUploadTimeout but got %v", err)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Error("upload was not abandoned promptly")
+	}
+
+	// the stalled body is closed, so the client can no longer write to it
+	closed := make(chan struct{})
+	go func() {
+		for {
+			if _, err := pw.Write([]byte("more")); errors.Is(err, io.ErrClosedPipe) {
+				close(closed)
+				return
+			}
+		}
+	}()
+	select {
+	case <-closed:
+	case <-time.After(2 * time.Second):
+		t.Error("expected the body to be closed after the timeout")
+	}
+
+	// an upload that keeps sending data is not affected
+	request = newUploadRequest(t, testFile{name: "fast.txt", content: []byte("all at once")})
+	uploadedFiles, err := testTools.UploadFiles(request, "./testdata/uploads/", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Remove(filepath.Join("./testdata/uploads/", uploadedFiles[0].NewFileName))
+}
+
+var canonicalURLTests = []struct {
+	name        string
+	url         string
+	host        string
+	tls         bool
+	stripParams []string
+	expected    string
+}{
+	{name: "plain", url: "/posts/hello", host: "example.com", expected: "http://example.com/posts/hello"},
+	{name: "lowercase host", url: "/", host: "WWW.Example.COM", expected: "http://www.example.com/"},
+	{name: "default http port", url: "/a", host: "example.com:80", expected: "http://example.com/a"},
+	{name: "default https port", url: "/a", host: "example.com:443", tls: true, expected: "https://example.com/a"},
+	{name: "other port", url: "/a", host: "example.com:8080", expected: "http://example.com:8080/a"},
+	{name: "sorted query", url: "/search?q=go&page=2&lang=en", host: "example.com", expected: "http://example.com/search?lang=en&page=2&q=go"},
+	{name: "tracking params", url: "/a?utm_source=news&id=7&fbclid=xyz&UTM_Medium=email", host: "example.com", expected: "http://example.com/a?id=7"},
+	{name: "custom strip", url: "/a?ref=home&id=7&utm_source=news", host: "example.com", stripParams: []string{"ref"}, expected: "http://example.com/a?id=7&utm_source=news"},
+}
+
+func TestTools_CanonicalURL(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range canonicalURLTests {
+		req := httptest.NewRequest("GET", e.url, nil)
+		req.Host = e.host
+		if e.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+
+		canonical := testTools.CanonicalURL(req, e.stripParams)
+		if canonical != e.expected {
+			t.Errorf("%s : expected %s but got %s", e.name, e.expected, canonical)
+		}
+	}
+}
+
+func buildTestZip(t *testing.T, files map[string][]byte) []byte {
+	buf := new(bytes.Buffer)
+	zw := zip.NewWriter(buf)
+
+	for name, content := range files {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestTools_ValidateArchiveContents(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	pngData := new(bytes.Buffer)
+	_ = png.Encode(pngData, img)
+
+	var archiveTests = []struct {
+		name          string
+		files         map[string][]byte
+		maxFileSize   int
+		maxTotal      int64
+		maxEntries    int
+		entries       int
+		errorExpected bool
+	}{
+		{name: "allowed", files: map[string][]byte{"a.png": pngData.Bytes(), "photos/b.png": pngData.Bytes()}, entries: 2, errorExpected: false},
+		{name: "disallowed type", files: map[string][]byte{"a.png": pngData.Bytes(), "notes.txt": []byte("hello")}, errorExpected: true},
+		{name: "traversal", files: map[string][]byte{"../evil.png": pngData.Bytes()}, errorExpected: true},
+		{name: "absolute", files: map[string][]byte{"/etc/evil.png": pngData.Bytes()}, errorExpected: true},
+		{name: "too large", files: map[string][]byte{"a.png": append(pngData.Bytes(), make([]byte, 4096)...)}, maxFileSize: 2048, errorExpected: true},
+		{name: "total too large", files: map[string][]byte{"a.png": pngData.Bytes(), "b.png": pngData.Bytes(), "c.png": pngData.Bytes()}, maxTotal: int64(pngData.Len()*2 + 1), errorExpected: true},
+		{name: "total within limit", files: map[string][]byte{"a.png": pngData.Bytes(), "b.png": pngData.Bytes()}, maxTotal: int64(pngData.Len() * 2), entries: 2, errorExpected: false},
+		{name: "too many entries", files: map[string][]byte{"a.png": pngData.Bytes(), "b.png": pngData.Bytes(), "c.png": pngData.Bytes()}, maxEntries: 2, errorExpected: true},
+	}
+
+	for _, e := range archiveTests {
+		var testTools Tools
+		testTools.AllowedFileTypes = []string{"image/png"}
+		testTools.MaxFileSize = e.maxFileSize
+		testTools.MaxDecompressedSize = e.maxTotal
+		testTools.MaxArchiveEntries = e.maxEntries
+
+		entries, err := testTools.ValidateArchiveContents(bytes.NewReader(buildTestZip(t, e.files)))
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+		if !e.errorExpected {
+			if err != nil {
+				t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+			}
+			if len(entries) != e.entries {
+				t.Errorf("%s : expected %d entries but got %d", e.name, e.entries, len(entries))
+			}
+			for _, entry := range entries {
+				if entry.FileType != "image/png" || entry.Size != int64(pngData.Len()) {
+					t.Errorf("%s : unexpected entry %+v", e.name, entry)
+				}
+			}
+		}
+	}
+
+	var testTools Tools
+	if _, err := testTools.ValidateArchiveContents(strings.NewReader("not a zip")); err == nil {
+		t.Error("expected error for data that is not a zip")
+	}
+}
+
+var paginationLinkTests = []struct {
+	name     string
+	page     int
+	total    int
+	expected string
+}{
+	{name: "first page", page: 1, total: 25, expected: `<http://example.com/items?page=1&per_page=10&q=go>; rel="first", ` +
+		`<http://example.com/items?page=2&per_page=10&q=go>; rel="next", <http://example.com/items?page=3&per_page=10&q=go>; rel="last"`},
+	{name: "middle page", page: 2, total: 25, expected: `<http://example.com/items?page=1&per_page=10&q=go>; rel="first", ` +
+		`<http://example.com/items?page=1&per_page=10&q=go>; rel="prev", <http://example.com/items?page=3&per_page=10&q=go>; rel="next", ` +
+		`<http://example.com/items?page=3&per_page=10&q=go>; rel="last"`},
+	{name: "last page", page: 3, total: 25, expected: `<http://example.com/items?page=1&per_page=10&q=go>; rel="first", ` +
+		`<http://example.com/items?page=2&per_page=10&q=go>; rel="prev", <http://example.com/items?page=3&per_page=10&q=go>; rel="last"`},
+	{name: "no results", page: 1, total: 0, expected: `<http://example.com/items?page=1&per_page=10&q=go>; rel="first", ` +
+		`<http://example.com/items?page=1&per_page=10&q=go>; rel="last"`},
+}
+
+func TestTools_SetPaginationLinks(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range paginationLinkTests {
+		req := httptest.NewRequest("GET", "http://example.com/items?q=go&page=9&per_page=10", nil)
+		rr := httptest.NewRecorder()
+
+		meta := testTools.NewPaginationMeta(e.page, 10, e.total)
+		testTools.SetPaginationLinks(rr, req, meta)
+
+		if link := rr.Header().Get("Link"); link != e.expected {
+			t.Errorf("%s : expected Link\n%s\nbut got\n%s", e.name, e.expected, link)
+		}
+	}
+}
+
+var safeRedirectTests = []struct {
+	name     string
+	target   string
+	expected bool
+}{
+	{name: "relative path", target: "/dashboard?tab=1", expected: true},
+	{name: "allowed host", target: "https://example.com/home", expected: true},
+	{name: "allowed host upper case", target: "https://EXAMPLE.com/home", expected: true},
+	{name: "allowed subdomain", target: "https://app.example.org/", expected: true},
+	{name: "wildcard does not match apex", target: "https://example.org/", expected: false},
+	{name: "other host", target: "https://evil.com/", expected: false},
+	{name: "lookalike host", target: "https://example.com.evil.com/", expected: false},
+	{name: "suffix lookalike", target: "https://evilexample.org/", expected: false},
+	{name: "protocol relative", target: "//evil.com/", expected: false},
+	{name: "backslash", target: "/\\evil.com", expected: false},
+	{name: "javascript", target: "javascript:alert(1)", expected: false},
+	{name: "data", target: "data:text/html,hi", expected: false},
+	{name: "userinfo", target: "https://example.com@evil.com/", expected: false},
+	{name: "control character", target: "/\t/evil.com", expected: false},
+	{name: "relative without slash", target: "dashboard", expected: false},
+	{name: "empty", target: "", expected: false},
+}
+
+func TestTools_IsSafeRedirect(t *testing.T) {
+	var testTools Tools
+	allowed := []string{"example.com", "*.example.org"}
+
+	for _, e := range safeRedirectTests {
+		if safe := testTools.IsSafeRedirect(e.target, allowed); safe != e.expected {
+			t.Errorf("%s : expected %t but got %t", e.name, e.expected, safe)
+		}
+	}
+}
+
+var copyNTests = []struct {
+	name          string
+	src           string
+	max           int64
+	copied        int64
+	errorExpected bool
+}{
+	{name: "under limit", src: "hello", max: 10, copied: 5, errorExpected: false},
+	{name: "at limit", src: "hello", max: 5, copied: 5, errorExpected: false},
+	{name: "over limit", src: "hello world", max: 5, copied: 5, errorExpected: true},
+	{name: "empty", src: "", max: 5, copied: 0, errorExpected: false},
+}
+
+func TestTools_CopyN(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range copyNTests {
+		var dst bytes.Buffer
+		n, err := testTools.CopyN(&dst, strings.NewReader(e.src), e.max)
+
+		if e.errorExpected && !errors.Is(err, ErrLimitExceeded) {
+			t.Errorf("%s : expected ErrLimitExceeded but got %v", e.name, err)
+		}
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+		}
+		if n != e.copied || int64(dst.Len()) != e.copied {
+			t.Errorf("%s : expected %d bytes copied but got %d", e.name, e.copied, n)
+		}
+	}
+}
+
+func TestTools_UploadFilesMaxFileSize(t *testing.T) {
+	var testTools Tools
+	testTools.MaxFileSize = 1024
+
+	request := newUploadRequest(t, testFile{name: "big.txt", content: []byte(strings.Repeat("a", 2048))})
+
+	before, _ := os.ReadDir("./testdata/uploads/")
+	if _, err := testTools.UploadFiles(request, "./testdata/uploads/", true); err == nil {
+		t.Error("expected error for file larger than MaxFileSize")
+	}
+
+	after, _ := os.ReadDir("./testdata/uploads/")
+	if len(after) != len(before) {
+		t.Error("partially written file was not removed")
+	}
+}
+
+func TestTools_CSRFMiddleware(t *testing.T) {
+	var testTools Tools
+
+	var seen string
+	handler := testTools.CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("csrf_token"); err == nil {
+			seen = cookie.Value
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// a GET without a cookie is given one
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/form", nil))
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != "csrf_token" || cookies[0].Value == "" {
+		t.Fatalf("expected csrf_token cookie to be set but got %v", cookies)
+	}
+	token := cookies[0].Value
+	if seen != token {
+		t.Error("expected the handler to see the new token")
+	}
+
+	var csrfTests = []struct {
+		name           string
+		cookie         string
+		header         string
+		form           string
+		expectedStatus int
+	}{
+		{name: "matching header", cookie: token, header: token, expectedStatus: http.StatusOK},
+		{name: "matching form field", cookie: token, form: "csrf_token=" + url.QueryEscape(token), expectedStatus: http.StatusOK},
+		{name: "mismatched header", cookie: token, header: "forged", expectedStatus: http.StatusForbidden},
+		{name: "missing token", cookie: token, expectedStatus: http.StatusForbidden},
+		{name: "missing cookie", header: token, expectedStatus: http.StatusForbidden},
+	}
+
+	for _, e := range csrfTests {
+		req := httptest.NewRequest("POST", "/form", strings.NewReader(e.form))
+		if e.form != "" {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+		if e.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: "csrf_token", Value: e.cookie})
+		}
+		if e.header != "" {
+			req.Header.Set("X-CSRF-Token", e.header)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s : expected status %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func TestReadJSONSlice(t *testing.T) {
+	type item struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+
+	var jsonSliceTests = []struct {
+		name          string
+		json          string
+		maxElements   int
+		maxSize       int
+		length        int
+		errorExpected bool
+	}{
+		{name: "array", json: `[{"id":1,"name":"a"},{"id":2,"name":"b"}]`, length: 2, errorExpected: false},
+		{name: "empty array", json: `[]`, length: 0, errorExpected: false},
+		{name: "object", json: `{"id":1,"name":"a"}`, errorExpected: true},
+		{name: "wrong element type", json: `[{"id":"one"}]`, errorExpected: true},
+		{name: "too many elements", json: `[{"id":1},{"id":2},{"id":3}]`, maxElements: 2, errorExpected: true},
+		{name: "too large", json: `[{"id":1,"name":"` + strings.Repeat("a", 64) + `"}]`, maxSize: 32, errorExpected: true},
+	}
+
+	for _, e := range jsonSliceTests {
+		var testTools Tools
+		testTools.MaxJSONArrayElements = e.maxElements
+		testTools.MaxJSONSize = e.maxSize
+
+		req := httptest.NewRequest("POST", "/", strings.NewReader(e.json))
+		rr := httptest.NewRecorder()
+
+		items, err := ReadJSONSlice[item](&testTools, rr, req)
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+		if !e.errorExpected {
+			if err != nil {
+				t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+			}
+			if len(items) != e.length {
+				t.Errorf("%s : expected %d items but got %d", e.name, e.length, len(items))
+			}
+		}
+	}
+}
+
+var unsafeSVGTests = []struct {
+	name          string
+	svg           string
+	errorExpected bool
+	construct     string
+}{
+	{name: "safe", svg: `<svg xmlns="http://www.w3.org/2000/svg" width="10" height="10"><circle cx="5" cy="5" r="4" fill="red"/></svg>`, errorExpected: false},
+	{name: "script", svg: `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`, errorExpected: true, construct: "<script>"},
+	{name: "event handler", svg: `<svg xmlns="http://www.w3.org/2000/svg" onload="alert(1)"></svg>`, errorExpected: true, construct: "onload"},
+	{name: "javascript link", svg: `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink"><a xlink:href=" java&#x09;script:alert(1)"><text>x</text></a></svg>`, errorExpected: true, construct: "javascript:"},
+	{name: "foreign object", svg: `<svg xmlns="http://www.w3.org/2000/svg"><foreignObject><body/></foreignObject></svg>`, errorExpected: true, construct: "<foreignObject>"},
+	{name: "malformed", svg: `<svg xmlns="http://www.w3.org/2000/svg"><g></svg>`, errorExpected: true, construct: "not a valid svg"},
+}
+
+func TestTools_RejectUnsafeSVG(t *testing.T) {
+	for _, e := range unsafeSVGTests {
+		var testTools Tools
+		testTools.AllowedFileTypes = []string{"image/svg+xml"}
+		testTools.RejectUnsafeSVG = true
+
+		request := newUploadRequest(t, testFile{name: "logo.svg", content: []byte(e.svg)})
+
+		uploadedFiles, err := testTools.UploadFiles(request, "./testdata/uploads/", true)
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s : error expected but not received", e.name)
+			} else if !strings.Contains(err.Error(), e.construct) {
+				t.Errorf("%s : expected error to mention %s but got %s", e.name, e.construct, err.Error())
+			}
+		}
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+		}
+
+		for _, f := range uploadedFiles {
+			_ = os.Remove(filepath.Join("./testdata/uploads/", f.NewFileName))
+		}
+	}
+}
+
+func TestTools_JSONDiff(t *testing.T) {
+	var testTools Tools
+
+	before := []byte(`{"name":"bob","age":30,"address":{"city":"Paris","zip":"75001"},"tags":["a","b","c"],"old":true}`)
+	after := []byte(`{"name":"bob","age":31,"address":{"city":"Lyon"},"tags":["a","x"],"email":"bob@example.com"}`)
+
+	diff, err := testTools.JSONDiff(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, _ := json.Marshal(diff)
+	expected := `{"added":{"email":"bob@example.com"},` +
+		`"changed":{"address.city":{"from":"Paris","to":"Lyon"},"age":{"from":30,"to":31},"tags[1]":{"from":"b","to":"x"}},` +
+		`"removed":{"address.zip":"75001","old":true,"tags[2]":"c"}}`
+	if string(out) != expected {
+		t.Errorf("unexpected diff\n%s\nexpected\n%s", out, expected)
+	}
+
+	// a value that changes type is reported as changed, and nested additions at their own path
+	diff, err = testTools.JSONDiff([]byte(`{"a":{"b":1}}`), []byte(`{"a":[1],"c":{"d":{"e":1}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, _ = json.Marshal(diff)
+	expected = `{"added":{"c":{"d":{"e":1}}},"changed":{"a":{"from":{"b":1},"to":[1]}},"removed":{}}`
+	if string(out) != expected {
+		t.Errorf("unexpected diff\n%s\nexpected\n%s", out, expected)
+	}
+
+	// identical documents have no differences
+	diff, _ = testTools.JSONDiff(before, before)
+	out, _ = json.Marshal(diff)
+	if string(out) != `{"added":{},"changed":{},"removed":{}}` {
+		t.Errorf("expected no differences but got %s", out)
+	}
+
+	if _, err := testTools.JSONDiff([]byte(`{`), after); err == nil {
+		t.Error("expected error for invalid JSON")
+	}
+}
+
+func TestTools_ResponseRecorder(t *testing.T) {
+	var testTools Tools
+
+	var rec *ResponseRecorder
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+		_, _ = io.WriteString(w, "hello ")
+		w.(http.Flusher).Flush()
+		_, _ = io.WriteString(w, "world")
+	})
+
+	rr := httptest.NewRecorder()
+	rec = testTools.NewResponseRecorder(rr)
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+
+	if rec.StatusCode != http.StatusAccepted || rr.Code != http.StatusAccepted {
+		t.Errorf("expected status 202 but recorded %d and sent %d", rec.StatusCode, rr.Code)
+	}
+	if rec.BytesWritten != 11 || rr.Body.String() != "hello world" {
+		t.Errorf("expected 11 bytes but recorded %d and sent %q", rec.BytesWritten, rr.Body.String())
+	}
+	if !rr.Flushed {
+		t.Error("expected Flush to be passed through")
+	}
+
+	// a handler that never calls WriteHeader gets a 200
+	rec = testTools.NewResponseRecorder(httptest.NewRecorder())
+	_, _ = rec.Write([]byte("ok"))
+	if rec.StatusCode != http.StatusOK {
+		t.Errorf("expected default status 200 but got %d", rec.StatusCode)
+	}
+}
+
+func TestTools_ReadJSONThen(t *testing.T) {
+	type signup struct {
+		Email string `json:"email"`
+		Plan  string `json:"plan"`
+	}
+
+	normalize := func(data interface{}) error {
+		s := data.(*signup)
+		s.Email = strings.ToLower(s.Email)
+		if s.Plan == "" {
+			s.Plan = "free"
+		}
+		if !strings.Contains(s.Email, "@") {
+			return errors.New("email is invalid")
+		}
+		return nil
+	}
+
+	var testTools Tools
+
+	var dst signup
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"email":"Jane@Example.com"}`))
+	if err := testTools.ReadJSONThen(httptest.NewRecorder(), req, &dst, normalize); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Email != "jane@example.com" || dst.Plan != "free" {
+		t.Errorf("expected hook to run but got %+v", dst)
+	}
+
+	// the hook's error is returned
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"email":"nobody"}`))
+	if err := testTools.ReadJSONThen(httptest.NewRecorder(), req, &signup{}, normalize); err == nil || err.Error() != "email is invalid" {
+		t.Errorf("expected error from hook but got %v", err)
+	}
+
+	// the hook is not called when the body cannot be read
+	called := false
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"email":`))
+	err := testTools.ReadJSONThen(httptest.NewRecorder(), req, &signup{}, func(data interface{}) error {
+		called = true
+		return nil
+	})
+	if err == nil || called {
+		t.Error("expected read error without calling the hook")
+	}
+}
+
+var tlsVersionTests = []struct {
+	name           string
+	tls            *tls.ConnectionState
+	allowNonTLS    bool
+	expectedStatus int
+}{
+	{name: "tls 1.3", tls: &tls.ConnectionState{Version: tls.VersionTLS13}, expectedStatus: http.StatusOK},
+	{name: "tls 1.2", tls: &tls.ConnectionState{Version: tls.VersionTLS12}, expectedStatus: http.StatusOK},
+	{name: "tls 1.1", tls: &tls.ConnectionState{Version: tls.VersionTLS11}, expectedStatus: http.StatusUpgradeRequired},
+	{name: "no tls", tls: nil, expectedStatus: http.StatusUpgradeRequired},
+	{name: "no tls allowed", tls: nil, allowNonTLS: true, expectedStatus: http.StatusOK},
+}
+
+func TestTools_RequireTLSVersion(t *testing.T) {
+	for _, e := range tlsVersionTests {
+		var testTools Tools
+		testTools.AllowNonTLSRequests = e.allowNonTLS
+
+		handler := testTools.RequireTLSVersion(tls.VersionTLS12)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.TLS = e.tls
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s : expected status %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+func TestTools_SlugifyBatchUnique(t *testing.T) {
+	var testTools Tools
+
+	slugs, err := testTools.SlugifyBatchUnique([]string{"C++", "Go", "C#", "go!", "C", "Go 2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"c", "go", "c-2", "go-2", "c-3", "go-2-2"}
+	if strings.Join(slugs, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v but got %v", expected, slugs)
+	}
+
+	if slugs, err := testTools.SlugifyBatchUnique(nil); err != nil || len(slugs) != 0 {
+		t.Errorf("expected no slugs for no items but got %v, %v", slugs, err)
+	}
+
+	if _, err := testTools.SlugifyBatchUnique([]string{"ok", "!!!"}); err == nil {
+		t.Error("expected error for item that cannot be slugified")
+	}
+}
+
+var aspectRatioTests = []struct {
+	name          string
+	width         int
+	height        int
+	minRatio      float64
+	maxRatio      float64
+	errorExpected bool
+}{
+	{name: "disabled", width: 10, height: 100, errorExpected: false},
+	{name: "banner in range", width: 300, height: 100, minRatio: 2.5, maxRatio: 4, errorExpected: false},
+	{name: "too tall", width: 100, height: 100, minRatio: 2.5, maxRatio: 4, errorExpected: true},
+	{name: "too wide", width: 500, height: 100, minRatio: 2.5, maxRatio: 4, errorExpected: true},
+	{name: "only minimum", width: 500, height: 100, minRatio: 2.5, errorExpected: false},
+}
+
+func TestTools_AspectRatio(t *testing.T) {
+	for _, e := range aspectRatioTests {
+		var testTools Tools
+		testTools.MinAspectRatio = e.minRatio
+		testTools.MaxAspectRatio = e.maxRatio
+
+		pngData := new(bytes.Buffer)
+		_ = png.Encode(pngData, image.NewRGBA(image.Rect(0, 0, e.width, e.height)))
+
+		request := newUploadRequest(t, testFile{name: "banner.png", content: pngData.Bytes()})
+
+		uploadedFiles, err := testTools.UploadFiles(request, "./testdata/uploads/", true)
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+		}
+
+		for _, f := range uploadedFiles {
+			_ = os.Remove(filepath.Join("./testdata/uploads/", f.NewFileName))
+		}
+	}
+}
+
+func TestTools_StaticAsset(t *testing.T) {
+	var testTools Tools
+
+	robots := []byte("User-agent: *\nDisallow:\n")
+	handler := testTools.StaticAsset("robots.txt", robots, "")
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/robots.txt", nil))
+
+	if rr.Code != http.StatusOK || !bytes.Equal(rr.Body.Bytes(), robots) {
+		t.Errorf("unexpected response %d %q", rr.Code, rr.Body.String())
+	}
+	if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("expected text/plain content type but got %s", rr.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(rr.Header().Get("Cache-Control"), "immutable") {
+		t.Errorf("expected immutable Cache-Control but got %s", rr.Header().Get("Cache-Control"))
+	}
+
+	etag := rr.Header().Get("ETag")
+	if etag == "" {
+		t.Fatal("expected an ETag")
+	}
+
+	// a matching If-None-Match gets a 304
+	req := httptest.NewRequest("GET", "/robots.txt", nil)
+	req.Header.Set("If-None-Match", etag)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNotModified || rr.Body.Len() != 0 {
+		t.Errorf("expected 304 with no body but got %d with %d bytes", rr.Code, rr.Body.Len())
+	}
+
+	// the content type given is used, and different content has a different ETag
+	favicon := testTools.StaticAsset("favicon.ico", []byte{0, 0, 1, 0}, "image/x-icon")
+	rr = httptest.NewRecorder()
+	favicon.ServeHTTP(rr, httptest.NewRequest("GET", "/favicon.ico", nil))
+
+	if rr.Header().Get("Content-Type") != "image/x-icon" {
+		t.Errorf("expected image/x-icon but got %s", rr.Header().Get("Content-Type"))
+	}
+	if rr.Header().Get("ETag") == etag {
+		t.Error("expected different content to have a different ETag")
+	}
+}
+
+var queryListTests = []struct {
+	name     string
+	query    string
+	expected string
+}{
+	{name: "simple", query: "tags=a,b,c", expected: "a|b|c"},
+	{name: "white space and empty", query: "tags=%20a%20,,b%20,", expected: "a|b"},
+	{name: "repeated", query: "tags=a,b&tags=c", expected: "a|b|c"},
+	{name: "missing", query: "other=a", expected: ""},
+}
+
+func TestTools_QueryList(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range queryListTests {
+		req := httptest.NewRequest("GET", "/?"+e.query, nil)
+		if list := strings.Join(testTools.QueryList(req, "tags"), "|"); list != e.expected {
+			t.Errorf("%s : expected %q but got %q", e.name, e.expected, list)
+		}
+	}
+
+	allowed := []string{"name", "created", "size"}
+
+	req := httptest.NewRequest("GET", "/?fields=name,size", nil)
+	if list, err := testTools.QueryListValidated(req, "fields", allowed); err != nil || len(list) != 2 {
+		t.Errorf("expected two valid fields but got %v, %v", list, err)
+	}
+
+	req = httptest.NewRequest("GET", "/?fields=name,password,secret", nil)
+	_, err := testTools.QueryListValidated(req, "fields", allowed)
+	if err == nil || !strings.Contains(err.Error(), "password, secret") {
+		t.Errorf("expected error naming the unknown values but got %v", err)
+	}
+}
+
+func TestTools_JSONRewriteFn(t *testing.T) {
+	type user struct {
+		FullName string `json:"full_name"`
+	}
+
+	var testTools Tools
+
+	// rename the deprecated "name" field sent by old clients
+	testTools.JSONRewriteFn = func(body []byte) ([]byte, error) {
+		var m map[string]interface{}
+		if err := json.Unmarshal(body, &m); err != nil {
+			return nil, err
+		}
+		if name, ok := m["name"]; ok {
+			m["full_name"] = name
+			delete(m, "name")
+		}
+		return json.Marshal(m)
+	}
+
+	for _, body := range []string{`{"name":"Jane Doe"}`, `{"full_name":"Jane Doe"}`} {
+		req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+
+		var dst user
+		if err := testTools.ReadJSONFile(httptest.NewRecorder(), req, &dst); err != nil {
+			t.Fatalf("%s : %s", body, err)
+		}
+		if dst.FullName != "Jane Doe" {
+			t.Errorf("%s : expected full name Jane Doe but got %q", body, dst.FullName)
+		}
+	}
+
+	// an error from the rewrite is returned
+	testTools.JSONRewriteFn = func(body []byte) ([]byte, error) {
+		return nil, errors.New("unsupported payload version")
+	}
+	req := httptest.NewRequest("POST", "/", strings.NewReader(`{"full_name":"Jane Doe"}`))
+	if err := testTools.ReadJSONFile(httptest.NewRecorder(), req, &user{}); err == nil || err.Error() != "unsupported payload version" {
+		t.Errorf("expected error from rewrite but got %v", err)
+	}
+}
+
+var requestIDTests = []struct {
+	name      string
+	incoming  string
+	keepsID   bool
+	generated bool
+}{
+	{name: "incoming id", incoming: "abc-123", keepsID: true},
+	{name: "uuid", incoming: "3f2b8c1e-9d4a-4e8b-a1c2-7f6e5d4c3b2a", keepsID: true},
+	{name: "no id", incoming: "", generated: true},
+	{name: "unsafe id", incoming: "abc\r\nX-Injected: 1", generated: true},
+	{name: "too long", incoming: strings.Repeat("a", 200), generated: true},
+}
+
+func TestTools_RequestID(t *testing.T) {
+	var testTools Tools
+
+	for _, e := range requestIDTests {
+		var seen string
+		handler := testTools.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = testTools.RequestIDFromContext(r.Context())
+		}))
+
+		req := httptest.NewRequest("GET", "/", nil)
+		if e.incoming != "" {
+			req.Header["X-Request-Id"] = []string{e.incoming}
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		echoed := rr.Header().Get("X-Request-ID")
+		if seen == "" || seen != echoed {
+			t.Errorf("%s : expected context id %q to match the response header %q", e.name, seen, echoed)
+		}
+		if e.keepsID && seen != e.incoming {
+			t.Errorf("%s : expected incoming id %q to be kept but got %q", e.name, e.incoming, seen)
+		}
+		if e.generated && (seen == e.incoming || len(seen) != 24) {
+			t.Errorf("%s : expected a generated id but got %q", e.name, seen)
+		}
+	}
+
+	if id := testTools.RequestIDFromContext(context.Background()); id != "" {
+		t.Errorf("expected no id in an empty context but got %q", id)
+	}
+}
+
+type csvAddress struct {
+	City    string `csv:"city"`
+	Country string `csv:"country"`
+}
+
+type csvAudit struct {
+	CreatedBy string `csv:"created_by"`
+}
+
+type csvPerson struct {
+	csvAudit
+	Name     string      `csv:"name"`
+	Age      int         `csv:"age"`
+	Score    float64     `csv:"score"`
+	Active   bool        `csv:"active"`
+	Joined   time.Time   `csv:"joined"`
+	Address  *csvAddress `csv:"address"`
+	Password string      `csv:"-"`
+	Nickname *string
+	internal string
+}
+
+func TestTools_WriteCSVStructs(t *testing.T) {
+	var testTools Tools
+
+	nick := "ally"
+	joined := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	people := []*csvPerson{
+		{csvAudit: csvAudit{CreatedBy: "admin"}, Name: "Alice, Jr", Age: 30, Score: 1.5, Active: true, Joined: joined, Address: &csvAddress{City: "Paris", Country: "FR"}, Password: "secret", Nickname: &nick, internal: "x"},
+		{Name: "Bob", Age: 41},
+		nil,
+	}
+
+	rr := httptest.NewRecorder()
+	if err := testTools.WriteCSVStructs(rr, "people.csv", people); err != nil {
+		t.Fatalf("error not expected but received: %s", err)
+	}
+
+	if ct := rr.Header().Get("Content-Type"); ct != "text/csv; charset=utf-8" {
+		t.Errorf("wrong content type: %s", ct)
+	}
+	if cd := rr.Header().Get("Content-Disposition"); cd != `attachment; filename="people.csv"` {
+		t.Errorf("wrong content disposition: %s", cd)
+	}
+
+	expected := "created_by,name,age,score,active,joined,address.city,address.country,Nickname\n" +
+		"admin,\"Alice, Jr\",30,1.5,true,2024-01-02T03:04:05Z,Paris,FR,ally\n" +
+		",Bob,41,0,false,0001-01-01T00:00:00Z,,,\n" +
+		",,,,,,,,\n"
+	if rr.Body.String() != expected {
+		t.Errorf("wrong csv written, expected:\n%s\ngot:\n%s", expected, rr.Body.String())
+	}
+
+	for _, bad := range []interface{}{csvPerson{}, []string{"a"}, nil} {
+		if err := testTools.WriteCSVStructs(httptest.NewRecorder(), "bad.csv", bad); err == nil {
+			t.Errorf("error expected for %T but not received", bad)
+		}
+	}
+}
+
+func gzipBytes(t *testing.T, content []byte) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write(content); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+var autoDecompressTests = []struct {
+	name            string
+	filename        string
+	content         []byte
+	allowedTypes    []string
+	maxDecompressed int64
+	disabled        bool
+	expectedName    string
+	expectedContent []byte
+	errorExpected   bool
+}{
+	{name: "gz extension", filename: "notes.txt.gz", content: []byte("hello, world\n"), expectedName: "notes.txt", expectedContent: []byte("hello, world\n")},
+	{name: "sniffed gzip", filename: "notes.txt", content: []byte("sniffed\n"), expectedName: "notes.txt", expectedContent: []byte("sniffed\n")},
+	{name: "inner type allowed", filename: "notes.txt.gz", content: []byte("plain text\n"), allowedTypes: []string{"text/plain; charset=utf-8"}, expectedName: "notes.txt", expectedContent: []byte("plain text\n")},
+	{name: "inner type not allowed", filename: "notes.txt.gz", content: []byte("plain text\n"), allowedTypes: []string{"application/x-gzip"}, errorExpected: true},
+	{name: "too large decompressed", filename: "big.txt.gz", content: bytes.Repeat([]byte("a"), 10000), maxDecompressed: 1000, errorExpected: true},
+	{name: "disabled", filename: "notes.txt.gz", content: []byte("left alone\n"), disabled: true, expectedName: "notes.txt.gz"},
+}
+
+func TestTools_AutoDecompressUploads(t *testing.T) {
+	for _, e := range autoDecompressTests {
+		var testTools Tools
+		testTools.AutoDecompressUploads = !e.disabled
+		testTools.AllowedFileTypes = e.allowedTypes
+		testTools.MaxDecompressedSize = e.maxDecompressed
+
+		compressed := gzipBytes(t, e.content)
+		request := newUploadRequest(t, testFile{name: e.filename, content: compressed})
+
+		uploadedFiles, err := testTools.UploadFiles(request, "./testdata/uploads/", false)
+		for _, f := range uploadedFiles {
+			defer os.Remove(filepath.Join("./testdata/uploads/", f.NewFileName))
+		}
+
+		if e.errorExpected {
+			if err == nil {
+				t.Errorf("%s : error expected but not received", e.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s : error not expected but received: %s", e.name, err)
+			continue
+		}
+
+		f := uploadedFiles[0]
+		if f.NewFileName != e.expectedName {
+			t.Errorf("%s : expected file to be stored as %s but got %s", e.name, e.expectedName, f.NewFileName)
+		}
+		if f.OriginalFileName != e.filename {
+			t.Errorf("%s : expected original file name %s but got %s", e.name, e.filename, f.OriginalFileName)
+		}
+		if f.Decompressed == e.disabled {
+			t.Errorf("%s : expected Decompressed to be %t", e.name, !e.disabled)
+		}
+
+		stored, err := os.ReadFile(filepath.Join("./testdata/uploads/", f.NewFileName))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := e.expectedContent
+		if e.disabled {
+			expected = compressed
+		}
+		if !bytes.Equal(stored, expected) {
+			t.Errorf("%s : stored file does not have the expected content", e.name)
+		}
+	}
+}
+
+func TestTools_AutoDecompressUploadsInvalidGzip(t *testing.T) {
+	var testTools Tools
+	testTools.AutoDecompressUploads = true
+
+	request := newUploadRequest(t, testFile{name: "broken.txt.gz", content: []byte("not gzip at all")})
+	uploadedFiles, err := testTools.UploadFiles(request, "./testdata/uploads/", false)
+	for _, f := range uploadedFiles {
+		os.Remove(filepath.Join("./testdata/uploads/", f.NewFileName))
+	}
+	if err == nil {
+		t.Error("error expected for invalid gzip but not received")
+	}
+}
+
+func TestTools_PushJSONToRemoteSafeOutboundOnlyRedirect(t *testing.T) {
+	followed := false
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		if req.URL.Host != "8.8.8.8" {
+			followed = true
+			return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewBufferString("OK")), Header: make(http.Header)}
+		}
+		header := make(http.Header)
+		header.Set("Location", "http://169.254.169.254/latest/meta-data")
+		return &http.Response{StatusCode: http.StatusTemporaryRedirect, Body: ioutil.NopCloser(bytes.NewBufferString("")), Header: header}
+	})
+
+	var testTools Tools
+	testTools.SafeOutboundOnly = true
+
+	_, _, err := testTools.PushJSONToRemote("https://8.8.8.8/hook", map[string]string{"foo": "bar"}, client)
+	if err == nil {
+		t.Error("expected error following a redirect to an unsafe url")
+	}
+	if followed {
+		t.Error("expected the redirect not to be followed")
+	}
+}
+
+func TestTools_SafeOutboundClientDial(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var testTools Tools
+	client := testTools.safeOutboundClient(&http.Client{})
+
+	// the pre-flight check is skipped here, so only the dialer stands between the client and the server
+	resp, err := client.Get(server.URL)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("expected dialling a loopback address to fail")
+	}
+	if !strings.Contains(err.Error(), "disallowed address") {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+type csvCategory struct {
+	Name   string       `csv:"name"`
+	Parent *csvCategory `csv:"parent"`
+	Owner  csvOwner     `csv:"owner"`
+}
+
+type csvOwner struct {
+	Name     string       `csv:"name"`
+	Favorite *csvCategory `csv:"favorite"`
+}
+
+func TestTools_WriteCSVStructsSelfReferential(t *testing.T) {
+	var testTools Tools
+
+	parent := &csvCategory{Name: "root"}
+	categories := []csvCategory{{Name: "a", Parent: parent, Owner: csvOwner{Name: "bob", Favorite: parent}}}
+
+	done := make(chan error, 1)
+	rr := httptest.NewRecorder()
+	go func() {
+		done <- testTools.WriteCSVStructs(rr, "categories.csv", categories)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("error not expected but received: %s", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("WriteCSVStructs did not return for a self-referential type")
+	}
+
+	expected := "name,owner.name\na,bob\n"
+	if rr.Body.String() != expected {
+		t.Errorf("wrong csv written, expected:\n%s\ngot:\n%s", expected, rr.Body.String())
+	}
+}
+
+func TestTools_UploadQuotaUnknownLength(t *testing.T) {
+	var testTools Tools
+
+	var readErr error
+	var read int64
+	handler := testTools.UploadQuota(10, time.Hour)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		read, readErr = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest("POST", "/", io.NopCloser(strings.NewReader(strings.Repeat("x", 100))))
+	req.ContentLength = -1
+	req.RemoteAddr = "10.0.0.1:1234"
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if readErr == nil {
+		t.Error("expected an error reading a body larger than the quota")
+	}
+	if read > 10 {
+		t.Errorf("expected at most 10 bytes to be read but %d were", read)
+	}
+
+	req = httptest.NewRequest("POST", "/", bytes.NewBufferString("1"))
+	req.RemoteAddr = "10.0.0.1:1234"
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("upload after quota used : expected %d got %d", http.StatusTooManyRequests, rr.Code)
+	}
+}
+
+func TestTools_UploadQuotaConcurrent(t *testing.T) {
+	var testTools Tools
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := testTools.UploadQuota(10, time.Hour)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(body string) int {
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+		req.RemoteAddr = "10.0.0.1:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	first := make(chan int)
+	go func() { first <- send("12345678") }()
+	<-started
+
+	// the first request has reserved 8 bytes while it is still being handled
+	if code := send("12345"); code != http.StatusTooManyRequests {
+		t.Errorf("concurrent upload over quota : expected %d got %d", http.StatusTooManyRequests, code)
+	}
+
+	close(release)
+	if code := <-first; code != http.StatusOK {
+		t.Errorf("first upload : expected %d got %d", http.StatusOK, code)
+	}
+}
+
+func TestTools_UploadQuotaEviction(t *testing.T) {
+	var testTools Tools
+
+	handler := testTools.UploadQuota(10, 20*time.Millisecond)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(addr, body string) int {
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+		req.RemoteAddr = addr
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	send("10.0.0.1:1234", "1234567890")
+	if code := send("10.0.0.1:1234", "1"); code != http.StatusTooManyRequests {
+		t.Errorf("upload after quota used : expected %d got %d", http.StatusTooManyRequests, code)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if code := send("10.0.0.1:1234", "1"); code != http.StatusOK {
+		t.Errorf("upload after window passed : expected %d got %d", http.StatusOK, code)
+	}
+}
+
+func TestTools_ValidateArchiveContentsZipBomb(t *testing.T) {
+	// many entries of highly compressible data, each well under MaxFileSize
+	files := make(map[string][]byte)
+	for i := 0; i < 20; i++ {
+		files[fmt.Sprintf("%d.txt", i)] = bytes.Repeat([]byte("a"), 1024*1024)
+	}
+	archive := buildTestZip(t, files)
+
+	var testTools Tools
+	testTools.MaxFileSize = 2 * 1024 * 1024
+	testTools.MaxDecompressedSize = 4 * 1024 * 1024
+
+	_, err := testTools.ValidateArchiveContents(bytes.NewReader(archive))
+	if err == nil || !strings.Contains(err.Error(), "decompresses to more than") {
+		t.Errorf("expected the total decompressed size to be limited but got: %v", err)
+	}
+}
+
+// pngHeader returns the start of a PNG that declares itself to be width by height pixels
+func pngHeader(width, height uint32) []byte {
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], width)
+	binary.BigEndian.PutUint32(ihdr[4:], height)
+	ihdr[8], ihdr[9] = 8, 2
+
+	chunk := append([]byte("IHDR"), ihdr...)
+	length, crc := make([]byte, 4), make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(ihdr)))
+	binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(chunk))
+
+	data := append([]byte("\x89PNG\r\n\x1a\n"), length...)
+	data = append(data, chunk...)
+	return append(data, crc...)
+}
+
+func TestTools_ThumbnailsMaxPixels(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	content := new(bytes.Buffer)
+	_ = png.Encode(content, img)
+
+	var pixelTests = []struct {
+		name      string
+		content   []byte
+		maxPixels int
+	}{
+		{name: "declared size over default", content: pngHeader(50000, 50000)},
+		{name: "over MaxImagePixels", content: content.Bytes(), maxPixels: 100 * 99},
+	}
+
+	for _, e := range pixelTests {
+		var testTools Tools
+		testTools.ThumbnailSizes = []ImageSize{{Width: 50, Height: 50}}
+		testTools.MaxImagePixels = e.maxPixels
+
+		before, _ := os.ReadDir("./testdata/uploads/")
+
+		uploadedFiles, err := testTools.UploadFiles(newUploadRequest(t, testFile{"huge.png", e.content}), "./testdata/uploads/", true)
+		for _, f := range uploadedFiles {
+			_ = os.Remove(filepath.Join("./testdata/uploads/", f.NewFileName))
+		}
+		if err == nil || !strings.Contains(err.Error(), "maximum of") {
+			t.Errorf("%s : expected an image over the pixel limit to be rejected but got: %v", e.name, err)
+		}
+
+		after, _ := os.ReadDir("./testdata/uploads/")
+		if len(after) != len(before) {
+			t.Errorf("%s : expected nothing to be written for a rejected image", e.name)
+		}
+	}
+}
+
+func TestTools_WriteThumbnailsRemovesVariantsOnError(t *testing.T) {
+	var testTools Tools
+	testTools.ThumbnailSizes = []ImageSize{{Width: 50, Height: 50}, {Width: 20, Height: 20}}
+
+	img := image.NewRGBA(image.Rect(0, 0, 100, 100))
+	content := new(bytes.Buffer)
+	_ = png.Encode(content, img)
+
+	// a directory where the second variant should go makes writing it fail
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "img_20x20.png"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	variants, err := testTools.writeThumbnails(bytes.NewReader(content.Bytes()), "image/png", dir, "img.png")
+	if err == nil {
+		t.Fatal("error expected but not received")
+	}
+	if len(variants) != 0 {
+		t.Errorf("expected no variants to be returned but got %v", variants)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "img_50x50.png")); !os.IsNotExist(err) {
+		t.Error("expected the variant already written to be removed")
+	}
+}
+
+func TestTools_UploadFilesToTarLimits(t *testing.T) {
+	var testTools Tools
+	testTools.MaxFileSize = 10
+
+	_, err := testTools.UploadFilesToTar(newUploadRequest(t, testFile{"big.txt", []byte(strings.Repeat("x", 11))}), io.Discard)
+	if err == nil {
+		t.Error("expected error for a file larger than MaxFileSize")
+	}
+
+	testTools.MaxFileSize = 0
+	testTools.MaxFileCount = 2
+	files := []testFile{{"a.txt", []byte("a")}, {"b.txt", []byte("b")}, {"c.txt", []byte("c")}}
+
+	var archive bytes.Buffer
+	_, err = testTools.UploadFilesToTar(newUploadRequest(t, files...), &archive)
+	if err == nil {
+		t.Error("expected error for more files than MaxFileCount")
+	}
+	if archive.Len() != 0 {
+		t.Error("expected nothing to be written when there are too many files")
+	}
+
+	uploadedFiles, err := testTools.UploadFilesToTar(newUploadRequest(t, files[:2]...), io.Discard)
+	if err != nil {
+		t.Errorf("error not expected but received: %s", err)
+	}
+	if len(uploadedFiles) != 2 {
+		t.Errorf("expected 2 files but got %d", len(uploadedFiles))
+	}
+}
+
+func TestTools_UploadFilesMaxFileCount(t *testing.T) {
+	var testTools Tools
+	testTools.MaxFileCount = 1
+
+	uploadedFiles, err := testTools.UploadFiles(newUploadRequest(t, testFile{"a.txt", []byte("a")}, testFile{"b.txt", []byte("b")}), "./testdata/uploads/")
+	for _, f := range uploadedFiles {
+		os.Remove(filepath.Join("./testdata/uploads/", f.NewFileName))
+	}
+	if err == nil {
+		t.Error("expected error for more files than MaxFileCount")
+	}
+	if len(uploadedFiles) != 0 {
+		t.Errorf("expected no files to be stored but %d were", len(uploadedFiles))
+	}
+}
+
+func TestTools_UploadToTempMaxFileSize(t *testing.T) {
+	var testTools Tools
+	testTools.MaxFileSize = 10
+
+	before, _ := filepath.Glob(filepath.Join(os.TempDir(), "upload-*.log"))
+
+	request := newUploadRequest(t, testFile{name: "big.log", content: []byte(strings.Repeat("x", 100))})
+	files, err := testTools.UploadToTemp(request)
+	if err == nil {
+		t.Error("expected error for a file larger than MaxFileSize")
+	}
+	if files != nil {
+		t.Error("expected no temp files when the upload fails")
+	}
+
+	after, _ := filepath.Glob(filepath.Join(os.TempDir(), "upload-*.log"))
+	if len(after) != len(before) {
+		t.Error("expected the partial temp file to be removed")
+	}
+}
+
+func TestTools_PushJSONToRemoteMaxRetryWait(t *testing.T) {
+	calls := 0
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		calls++
+		header := make(http.Header)
+		if calls == 1 {
+			header.Set("Retry-After", "3600")
+			return &http.Response{StatusCode: http.StatusServiceUnavailable, Body: ioutil.NopCloser(bytes.NewBufferString("")), Header: header}
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: ioutil.NopCloser(bytes.NewBufferString("OK")), Header: header}
+	})
+
+	var testTools Tools
+	testTools.MaxPushRetries = 1
+	testTools.MaxRetryWait = 10 * time.Millisecond
+
+	start := time.Now()
+	_, status, err := testTools.PushJSONToRemote("http://example.com", map[string]string{"foo": "bar"}, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status != http.StatusOK || calls != 2 {
+		t.Errorf("expected a successful retry but got status %d after %d calls", status, calls)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the wait to be capped but it took %s", elapsed)
+	}
+}
+
+func TestTools_PushJSONToRemoteContextCancel(t *testing.T) {
+	client := NewTestClient(func(req *http.Request) *http.Response {
+		header := make(http.Header)
+		header.Set("Retry-After", "3600")
+		return &http.Response{StatusCode: http.StatusTooManyRequests, Body: ioutil.NopCloser(bytes.NewBufferString("")), Header: header}
+	})
+
+	var testTools Tools
+	testTools.MaxPushRetries = 100
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, _, err := testTools.PushJSONToRemoteContext(ctx, "http://example.com", map[string]string{"foo": "bar"}, client)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the context deadline to stop the retries but got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected the wait to be cancelled but it took %s", elapsed)
+	}
+}
+
+func TestTools_UploadOneFileRejected(t *testing.T) {
+	var testTools Tools
+	testTools.AllowedFileTypes = []string{"image/png"}
+
+	request := newUploadRequest(t, testFile{"notes.txt", []byte("plain text")})
+	_, err := testTools.UploadOneFile(request, "./testdata/uploads/")
+	if err == nil || !strings.Contains(err.Error(), "not permitted") {
+		t.Errorf("expected the reason the file was rejected but got: %v", err)
+	}
+}
+
+var svgDetectionTests = []struct {
+	name         string
+	allowedTypes []string
+	rejectUnsafe bool
+	content      string
+	expected     string
+}{
+	{name: "text mentioning svg", allowedTypes: []string{"text/plain; charset=utf-8"}, content: "use an <svg> element for icons", expected: "text/plain; charset=utf-8"},
+	{name: "xml svg allowed as xml", allowedTypes: []string{"text/xml; charset=utf-8"}, content: `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg"></svg>`, expected: "text/xml; charset=utf-8"},
+	{name: "svg allowed", allowedTypes: []string{"image/svg+xml"}, content: `<svg xmlns="http://www.w3.org/2000/svg"></svg>`, expected: "image/svg+xml"},
+	{name: "reject unsafe svg", rejectUnsafe: true, content: `<svg xmlns="http://www.w3.org/2000/svg"></svg>`, expected: "image/svg+xml"},
+}
+
+func TestTools_DetectContentTypeSVG(t *testing.T) {
+	for _, e := range svgDetectionTests {
+		var testTools Tools
+		testTools.AllowedFileTypes = e.allowedTypes
+		testTools.RejectUnsafeSVG = e.rejectUnsafe
+
+		if fileType := testTools.detectContentType([]byte(e.content), "file"); fileType != e.expected {
+			t.Errorf("%s : expected %s but got %s", e.name, e.expected, fileType)
+		}
+	}
+}
+
+// countingZeroReader is an endless stream of zeros that counts the bytes read from it
+type countingZeroReader struct {
+	n int64
+}
+
+func (c *countingZeroReader) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+func TestTools_IsAnimatedBoundedRead(t *testing.T) {
+	// a huge chunk before the image data is skipped rather than held in memory
+	ancillary := []byte{0x7f, 0xff, 0xff, 0xff, 't', 'E', 'X', 't'}
+	rest := &countingZeroReader{}
+	data := io.MultiReader(bytes.NewReader(pngHeader(10, 10)), bytes.NewReader(ancillary), io.LimitReader(rest, 64*1024*1024))
+
+	if isAnimated(data) {
+		t.Error("expected a png without an animation chunk not to be animated")
+	}
+
+	// the image data itself is never read
+	header := append(pngHeader(10, 10), 0x7f, 0xff, 0xff, 0xff, 'I', 'D', 'A', 'T')
+	rest = &countingZeroReader{}
+	if isAnimated(io.MultiReader(bytes.NewReader(header), rest)) {
+		t.Error("expected a png without an animation chunk not to be animated")
+	}
+	if rest.n > 64*1024 {
+		t.Errorf("expected detection to stop at the image data but %d more bytes were read", rest.n)
+	}
+}
+
+func TestTools_SPAHandlerHiddenAndSymlinks(t *testing.T) {
+	root := t.TempDir()
+	staticDir := filepath.Join(root, "public")
+	if err := os.MkdirAll(filepath.Join(staticDir, ".git"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.WriteFile(filepath.Join(staticDir, "index.html"), []byte("<app>"), 0644)
+	_ = os.WriteFile(filepath.Join(staticDir, "app.js"), []byte("console.log(1)"), 0644)
+	_ = os.WriteFile(filepath.Join(staticDir, ".env"), []byte("secret"), 0644)
+	_ = os.WriteFile(filepath.Join(staticDir, ".git", "config"), []byte("secret"), 0644)
+	_ = os.WriteFile(filepath.Join(root, "outside.txt"), []byte("secret"), 0644)
+
+	if err := os.Symlink(filepath.Join(root, "outside.txt"), filepath.Join(staticDir, "escape.txt")); err != nil {
+		t.Skip("symlinks are not supported:", err)
+	}
+	_ = os.Symlink(filepath.Join(staticDir, ".env"), filepath.Join(staticDir, "env.txt"))
+	_ = os.Symlink(filepath.Join(staticDir, "app.js"), filepath.Join(staticDir, "latest.js"))
+
+	var testTools Tools
+	handler := testTools.SPAHandler(staticDir, "index.html")
+
+	var hiddenTests = []struct {
+		path           string
+		expectedStatus int
+		expectedBody   string
+	}{
+		{path: "/.env", expectedStatus: http.StatusNotFound},
+		{path: "/.git/config", expectedStatus: http.StatusNotFound},
+		{path: "/.git", expectedStatus: http.StatusNotFound},
+		{path: "/escape.txt", expectedStatus: http.StatusNotFound},
+		{path: "/env.txt", expectedStatus: http.StatusNotFound},
+		{path: "/latest.js", expectedStatus: http.StatusOK, expectedBody: "console.log(1)"},
+		{path: "/settings", expectedStatus: http.StatusOK, expectedBody: "<app>"},
+	}
+
+	for _, e := range hiddenTests {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", e.path, nil))
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s : expected status %d but got %d", e.path, e.expectedStatus, rr.Code)
+		}
+		if e.expectedBody != "" && rr.Body.String() != e.expectedBody {
+			t.Errorf("%s : expected body %q but got %q", e.path, e.expectedBody, rr.Body.String())
+		}
+		if strings.Contains(rr.Body.String(), "secret") {
+			t.Errorf("%s : a hidden or outside file was served", e.path)
+		}
+	}
+}
+
+func TestTools_DecodeJSONArrayIgnoredError(t *testing.T) {
+	var testTools Tools
+
+	done := make(chan error, 1)
+	calls := 0
+	go func() {
+		done <- testTools.DecodeJSONArray(strings.NewReader(`[{"id":1},{"id":},{"id":3}]`), func(decode func(v interface{}) error) error {
+			calls++
+			var item struct{ ID int }
+			_ = decode(&item)
+			return nil
+		})
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected the decode error to be returned even though the callback ignored it")
+		}
+		if calls != 2 {
+			t.Errorf("expected iteration to stop at the bad element but the callback was called %d times", calls)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("DecodeJSONArray did not return when the callback ignored a decode error")
+	}
+}
+
+func TestTools_RejectUnsafeSVGLongProlog(t *testing.T) {
+	prolog := `<?xml version="1.0"?><!--` + strings.Repeat(" padding", 75) + `-->`
+	evil := prolog + `<svg xmlns="http://www.w3.org/2000/svg"><script>alert(1)</script></svg>`
+
+	var prologTests = []struct {
+		name          string
+		filename      string
+		content       string
+		errorExpected bool
+	}{
+		{name: "svg after long prolog", filename: "evil.svg", content: evil, errorExpected: true},
+		{name: "svg after long prolog named xml", filename: "evil.xml", content: evil, errorExpected: true},
+		{name: "safe svg after long prolog", filename: "logo.svg", content: prolog + `<svg xmlns="http://www.w3.org/2000/svg"></svg>`, errorExpected: false},
+		{name: "plain text", filename: "notes.txt", content: "tom & jerry <3 " + strings.Repeat("notes ", 200), errorExpected: false},
+	}
+
+	for _, e := range prologTests {
+		var testTools Tools
+		testTools.RejectUnsafeSVG = true
+
+		uploadedFiles, err := testTools.UploadFiles(newUploadRequest(t, testFile{name: e.filename, content: []byte(e.content)}), "./testdata/uploads/", true)
+		for _, f := range uploadedFiles {
+			_ = os.Remove(filepath.Join("./testdata/uploads/", f.NewFileName))
+		}
+
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+		}
+	}
+}
+
+func TestTools_ThumbnailsFailureRemovesOriginal(t *testing.T) {
+	var testTools Tools
+	testTools.ThumbnailSizes = []ImageSize{{Width: 50, Height: 50}}
+
+	before, _ := os.ReadDir("./testdata/uploads/")
+
+	// a valid header with no image data passes the size check but cannot be decoded
+	uploadedFiles, err := testTools.UploadFiles(newUploadRequest(t, testFile{"broken.png", pngHeader(10, 10)}), "./testdata/uploads/", true)
+	for _, f := range uploadedFiles {
+		_ = os.Remove(filepath.Join("./testdata/uploads/", f.NewFileName))
+	}
+	if err == nil {
+		t.Error("expected error for an image that cannot be decoded")
+	}
+
+	after, _ := os.ReadDir("./testdata/uploads/")
+	if len(after) != len(before) {
+		t.Error("expected the original to be removed when its thumbnails cannot be made")
+	}
+}
+
+func TestTools_ValidateArchiveContentsSpecialEntries(t *testing.T) {
+	build := func(name string, mode os.FileMode, content string) []byte {
+		buf := new(bytes.Buffer)
+		zw := zip.NewWriter(buf)
+		hdr := &zip.FileHeader{Name: name, Method: zip.Deflate}
+		hdr.SetMode(mode)
+		w, err := zw.CreateHeader(hdr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write([]byte(content))
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+
+	var specialEntryTests = []struct {
+		name          string
+		archive       []byte
+		errorExpected bool
+	}{
+		{name: "symlink", archive: build("link", os.ModeSymlink|0777, "/etc/passwd"), errorExpected: true},
+		{name: "directory traversal", archive: build("../escape/", os.ModeDir|0755, ""), errorExpected: true},
+		{name: "absolute directory", archive: build("/etc/", os.ModeDir|0755, ""), errorExpected: true},
+		{name: "safe directory", archive: build("docs/", os.ModeDir|0755, ""), errorExpected: false},
+		{name: "regular file", archive: build("notes.txt", 0644, "hello"), errorExpected: false},
+	}
+
+	for _, e := range specialEntryTests {
+		var testTools Tools
+
+		_, err := testTools.ValidateArchiveContents(bytes.NewReader(e.archive))
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+		}
+	}
+}
+
+func TestTools_VerifySignatureFamilies(t *testing.T) {
+	docx := buildTestZip(t, map[string][]byte{"[Content_Types].xml": []byte("<Types/>"), "word/document.xml": []byte("<w:document/>")})
+
+	var familyTests = []struct {
+		name          string
+		filename      string
+		content       []byte
+		errorExpected bool
+	}{
+		{name: "csv", filename: "people.csv", content: []byte("name,age\nbob,42\n"), errorExpected: false},
+		{name: "json", filename: "data.json", content: []byte(`{"name":"bob"}`), errorExpected: false},
+		{name: "xml", filename: "feed.xml", content: []byte(`<?xml version="1.0"?><feed/>`), errorExpected: false},
+		{name: "docx", filename: "report.docx", content: docx, errorExpected: false},
+		{name: "xlsx", filename: "sheet.xlsx", content: docx, errorExpected: false},
+		{name: "text as docx", filename: "report.docx", content: []byte("not a document"), errorExpected: true},
+		{name: "text as png", filename: "img.png", content: []byte("not an image"), errorExpected: true},
+		{name: "zip as csv", filename: "people.csv", content: docx, errorExpected: true},
+	}
+
+	for _, e := range familyTests {
+		var testTools Tools
+		testTools.VerifyFileSignature = true
+
+		uploadedFiles, err := testTools.UploadFiles(newUploadRequest(t, testFile{e.filename, e.content}), "./testdata/uploads/", true)
+		for _, f := range uploadedFiles {
+			_ = os.Remove(filepath.Join("./testdata/uploads/", f.NewFileName))
+		}
+
+		if e.errorExpected && err == nil {
+			t.Errorf("%s : error expected but not received", e.name)
+		}
+		if !e.errorExpected && err != nil {
+			t.Errorf("%s : error not expected but received: %s", e.name, err.Error())
+		}
+	}
+}
+
+func TestTools_VerifySignedRequest(t *testing.T) {
+	var testTools Tools
+
+	signed := testTools.SignURL("https://example.com/files/report%20final.pdf?user=42", time.Now().Add(time.Hour), "secret")
+
+	req := httptest.NewRequest("GET", signed, nil)
+	if ok, err := testTools.VerifySignedRequest(req, "secret"); !ok || err != nil {
+		t.Errorf("expected signed request to verify : %v", err)
+	}
+
+	// a handler only sees the path and query in r.URL
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ok, err := testTools.VerifySignedURL(r.URL.String(), "secret"); !ok || err != nil {
+			http.Error(w, fmt.Sprint(err), http.StatusForbidden)
+		}
+	}))
+	defer server.Close()
+
+	u, _ := url.Parse(signed)
+	resp, err := http.Get(server.URL + u.RequestURI())
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected signed url to verify in a handler but got %d", resp.StatusCode)
+	}
+
+	tampered := httptest.NewRequest("GET", strings.Replace(signed, "user=42", "user=43", 1), nil)
+	if ok, _ := testTools.VerifySignedRequest(tampered, "secret"); ok {
+		t.Error("expected tampered request to fail")
+	}
+}
+
+func TestTools_CSRFMiddlewareMultipart(t *testing.T) {
+	var testTools Tools
+
+	var parsedBefore bool
+	handler := testTools.CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parsedBefore = r.MultipartForm != nil
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	token := testTools.GenerateCSRFToken()
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	_ = writer.WriteField("csrf_token", token)
+	_ = writer.Close()
+
+	// the token in a multipart body is not read, so the body is left for the handler
+	req := httptest.NewRequest("POST", "/upload", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.AddCookie(&http.Cookie{Name: "csrf_token", Value: token})
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("multipart without header : expected %d got %d", http.StatusForbidden, rr.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/upload", bytes.NewReader(body.Bytes()))
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set("X-CSRF-Token", token)
+	req.AddCookie(&http.Cookie{Name: "csrf_token", Value: token})
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("multipart with header : expected %d got %d", http.StatusOK, rr.Code)
+	}
+	if parsedBefore {
+		t.Error("expected the multipart body not to be parsed by the middleware")
+	}
+}
+
+func TestTools_TrimStringFieldsInterfaces(t *testing.T) {
+	var testTools Tools
+	testTools.TrimStringFields = true
+
+	body := `{"name":" Jane ","tags":[" a ",{"city":" Paris "}],"nested":{"team":" blue "},"age":42}`
+
+	// strings held in interface values, at any depth, are trimmed
+	req := httptest.NewRequest("POST", "/", strings.NewReader(body))
+	m, err := testTools.ReadJSONMap(httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if m["name"] != "Jane" {
+		t.Errorf("expected name to be trimmed but got %q", m["name"])
+	}
+	tags := m["tags"].([]interface{})
+	if tags[0] != "a" {
+		t.Errorf("expected tags to be trimmed but got %q", tags[0])
+	}
+	if city := tags[1].(map[string]interface{})["city"]; city != "Paris" {
+		t.Errorf("expected object in array to be trimmed but got %q", city)
+	}
+	if team := m["nested"].(map[string]interface{})["team"]; team != "blue" {
+		t.Errorf("expected nested object to be trimmed but got %q", team)
+	}
+	if m["age"] != float64(42) {
+		t.Errorf("expected age 42 but got %v", m["age"])
+	}
+
+	// an interface{} struct field is trimmed as well
+	var dst struct {
+		Extra interface{} `json:"extra"`
+	}
+	req = httptest.NewRequest("POST", "/", strings.NewReader(`{"extra":" value "}`))
+	if err := testTools.ReadJSONFile(httptest.NewRecorder(), req, &dst); err != nil {
+		t.Fatal(err)
+	}
+	if dst.Extra != "value" {
+		t.Errorf("expected interface field to be trimmed but got %q", dst.Extra)
+	}
+}
+
+func TestTools_UploadQuotaKeyFn(t *testing.T) {
+	var testTools Tools
+	testTools.UploadQuotaKeyFn = func(r *http.Request) string {
+		return r.Header.Get("X-Real-IP")
+	}
+
+	handler := testTools.UploadQuota(10, time.Hour)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(realIP, body string) int {
+		req := httptest.NewRequest("POST", "/", bytes.NewBufferString(body))
+		req.RemoteAddr = "10.0.0.1:1234"
+		if realIP != "" {
+			req.Header.Set("X-Real-IP", realIP)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// clients behind the same proxy each get their own quota
+	if code := send("203.0.113.1", "123456"); code != http.StatusOK {
+		t.Errorf("first client : expected %d got %d", http.StatusOK, code)
+	}
+	if code := send("203.0.113.2", "123456"); code != http.StatusOK {
+		t.Errorf("second client : expected %d got %d", http.StatusOK, code)
+	}
+	if code := send("203.0.113.1", "123456"); code != http.StatusTooManyRequests {
+		t.Errorf("first client over quota : expected %d got %d", http.StatusTooManyRequests, code)
+	}
+
+	// an empty key falls back to the remote address
+	if code := send("", "123456"); code != http.StatusOK {
+		t.Errorf("remote address : expected %d got %d", http.StatusOK, code)
+	}
+	if code := send("", "123456"); code != http.StatusTooManyRequests {
+		t.Errorf("remote address over quota : expected %d got %d", http.StatusTooManyRequests, code)
+	}
+}